@@ -2,25 +2,26 @@ package main
 
 import (
 	"archive/zip"
+	"context"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"math"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
 
 	"github.com/ddvk/rmapi-hwr/hwr"
+	"github.com/ddvk/rmapi-hwr/hwr/logging"
 	"github.com/juruen/rmapi/archive"
 	"github.com/juruen/rmapi/encoding/rm"
 )
 
-func loadRmPage(filename string) (zip *archive.Zip, err error) {
+func loadRmPage(filename string, limits hwr.Limits) (zip *archive.Zip, err error) {
 	zip = archive.NewZip()
 	file, err := os.Open(filename)
 	if err != nil {
@@ -43,22 +44,10 @@ func loadRmPage(filename string) (zip *archive.Zip, err error) {
 
 	zip.Pages = append(zip.Pages, page)
 
-	return zip, nil
+	return zip, hwr.CheckPages(zip, limits)
 
 }
 
-// ContentFile represents the structure of the .content file in newer Remarkable formats
-type ContentFile struct {
-	CPages struct {
-		Pages []struct {
-			ID string `json:"id"`
-		} `json:"pages"`
-		LastOpened struct {
-			Value string `json:"value"`
-		} `json:"lastOpened"`
-	} `json:"cPages"`
-}
-
 // parseRmVersion6 parses version 6 .rm files and converts them to the internal format
 func parseRmVersion6(data []byte) (*rm.Rm, error) {
 	if len(data) < 43 {
@@ -309,62 +298,22 @@ func parseRmVersion6(data []byte) (*rm.Rm, error) {
 	return rmData, nil
 }
 
-func loadRmZip(filename string) (zipArchive *archive.Zip, err error) {
-	zipArchive = archive.NewZip()
+// loadRmZip loads a document downloaded with rmapi or exported as .rmdoc.
+func loadRmZip(filename string, limits hwr.Limits) (*archive.Zip, error) {
 	file, err := os.Open(filename)
-
 	if err != nil {
-		return
+		return nil, err
 	}
-
 	defer file.Close()
 
 	fi, err := file.Stat()
 	if err != nil {
-		return
-	}
-	
-	// Try the standard rmapi Read first
-	err = zipArchive.Read(file, fi.Size())
-	if err == nil {
-		numPages := len(zipArchive.Pages)
-		log.Printf("Standard rmapi Read() succeeded: found %d pages", numPages)
-		if numPages > 0 {
-			// Check if pages have data
-			pagesWithData := 0
-			for i, page := range zipArchive.Pages {
-				if page.Data != nil {
-					layers := len(page.Data.Layers)
-					totalLines := 0
-					for _, layer := range page.Data.Layers {
-						totalLines += len(layer.Lines)
-					}
-					log.Printf("Page %d: %d layers, %d lines", i, layers, totalLines)
-					if layers > 0 && totalLines > 0 {
-						pagesWithData++
-					}
-				}
-			}
-			log.Printf("Pages with data: %d/%d", pagesWithData, numPages)
-			if pagesWithData > 0 {
-				return zipArchive, nil
-			} else {
-				log.Printf("Standard parser found pages but no data, trying new format parser")
-			}
-		} else {
-			log.Printf("Standard parser found 0 pages, trying new format parser")
-		}
-	} else {
-		log.Printf("Standard rmapi Read() failed: %v, trying new format parser", err)
+		return nil, err
 	}
-
-	// If standard read failed or found no pages, try new format
-	// Reset file position
-	file.Seek(0, 0)
-	return loadRmZipNewFormat(file)
+	return hwr.LoadZip(context.Background(), file, fi.Size(), limits)
 }
 
-func loadRmZipStandardOnly(filename string) (zipArchive *archive.Zip, err error) {
+func loadRmZipStandardOnly(filename string, limits hwr.Limits) (zipArchive *archive.Zip, err error) {
 	zipArchive = archive.NewZip()
 	file, err := os.Open(filename)
 	if err != nil {
@@ -376,15 +325,22 @@ func loadRmZipStandardOnly(filename string) (zipArchive *archive.Zip, err error)
 	if err != nil {
 		return
 	}
+	reader, err := zip.NewReader(file, fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("can't open as zip: %w", err)
+	}
+	if err := hwr.CheckArchive(reader, limits); err != nil {
+		return nil, err
+	}
 	
-	log.Printf("Using standard rmapi parser only")
+	slog.Debug("Using standard rmapi parser only")
 	err = zipArchive.Read(file, fi.Size())
 	if err != nil {
 		return nil, fmt.Errorf("standard parser failed: %w", err)
 	}
 	
 	numPages := len(zipArchive.Pages)
-	log.Printf("Standard parser found %d pages", numPages)
+	slog.Debug("Standard parser found pages", "pages", numPages)
 	
 	// Verify pages have data
 	for i, page := range zipArchive.Pages {
@@ -398,133 +354,73 @@ func loadRmZipStandardOnly(filename string) (zipArchive *archive.Zip, err error)
 					totalPoints += len(line.Points)
 				}
 			}
-			log.Printf("Page %d: %d layers, %d lines, %d points", i, layers, totalLines, totalPoints)
+			slog.Debug("Page data", "page", i, "layers", layers, "lines", totalLines, "points", totalPoints)
 		} else {
-			log.Printf("Page %d: no data", i)
+			slog.Debug("Page has no data", "page", i)
 		}
 	}
 	
-	return zipArchive, nil
+	return zipArchive, hwr.CheckPages(zipArchive, limits)
 }
 
-func loadRmZipNewFormat(file *os.File) (zipArchive *archive.Zip, err error) {
-	zipArchive = archive.NewZip()
-	
-	// Get file size for zip.NewReader
-	fi, err := file.Stat()
-	if err != nil {
-		return nil, fmt.Errorf("can't stat file: %w", err)
-	}
-	
-	// Reset file position
-	file.Seek(0, 0)
-	
-	// Open as standard ZIP archive
-	reader, err := zip.NewReader(file, fi.Size())
-	if err != nil {
-		return nil, fmt.Errorf("can't open as zip: %w", err)
-	}
+// resourceFlag collects repeatable [lang=]path flag values.
+type resourceFlag []struct{ lang, path string }
 
-	// Find the .content file to get page list
-	var contentFile *zip.File
-	var docUUID string
-	for _, f := range reader.File {
-		if strings.HasSuffix(f.Name, ".content") {
-			contentFile = f
-			// Extract UUID from filename (format: UUID.content)
-			baseName := filepath.Base(f.Name)
-			docUUID = strings.TrimSuffix(baseName, ".content")
-			break
+func (f *resourceFlag) String() string {
+	specs := make([]string, 0, len(*f))
+	for _, r := range *f {
+		if r.lang == hwr.AllLanguages {
+			specs = append(specs, r.path)
+		} else {
+			specs = append(specs, r.lang+"="+r.path)
 		}
 	}
+	return strings.Join(specs, ",")
+}
 
-	if contentFile == nil {
-		return nil, errors.New("no .content file found in archive")
-	}
-
-	// Read and parse content file
-	contentReader, err := contentFile.Open()
-	if err != nil {
-		return nil, fmt.Errorf("can't open content file: %w", err)
-	}
-	defer contentReader.Close()
-
-	contentData, err := ioutil.ReadAll(contentReader)
-	if err != nil {
-		return nil, fmt.Errorf("can't read content file: %w", err)
-	}
-
-	var content ContentFile
-	err = json.Unmarshal(contentData, &content)
-	if err != nil {
-		return nil, fmt.Errorf("can't parse content file: %w", err)
+func (f *resourceFlag) Set(value string) error {
+	lang, path, found := strings.Cut(value, "=")
+	if !found {
+		lang, path = hwr.AllLanguages, value
 	}
-
-	// Set UUID
-	zipArchive.UUID = docUUID
-
-	// Set Content metadata if available
-	if len(content.CPages.Pages) > 0 {
-		// Find last opened page index
-		lastOpenedID := content.CPages.LastOpened.Value
-		for i, page := range content.CPages.Pages {
-			if page.ID == lastOpenedID {
-				zipArchive.Content.LastOpenedPage = i
-				break
-			}
-		}
+	if path == "" {
+		return errors.New("missing file name")
 	}
+	*f = append(*f, struct{ lang, path string }{lang, path})
+	return nil
+}
 
-	// Read each page .rm file
-	for _, pageInfo := range content.CPages.Pages {
-		pageID := pageInfo.ID
-		// Pages are stored in subdirectories: UUID/pageID.rm
-		pagePath := fmt.Sprintf("%s/%s.rm", docUUID, pageID)
-		
-		var pageFile *zip.File
-		for _, f := range reader.File {
-			if f.Name == pagePath {
-				pageFile = f
-				break
-			}
-		}
-
-		if pageFile == nil {
-			log.Printf("Warning: page file not found: %s", pagePath)
-			continue
-		}
-
-		// Read page data
-		pageReader, err := pageFile.Open()
-		if err != nil {
-			log.Printf("Warning: can't open page file %s: %v", pagePath, err)
-			continue
+// isFlagSet reports whether a flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
+	})
+	return set
+}
 
-		pageData, err := ioutil.ReadAll(pageReader)
-		pageReader.Close()
+// loadResources loads the lexicon and grammar files given on the command line.
+func loadResources(lexicons, grammars resourceFlag) (hwr.ResourceSet, error) {
+	resources := make(hwr.ResourceSet)
+	for _, l := range lexicons {
+		words, err := hwr.LoadLexicon(l.path)
 		if err != nil {
-			log.Printf("Warning: can't read page file %s: %v", pagePath, err)
-			continue
+			return nil, err
 		}
-
-		// Parse .rm file (now supports V3, V5, and V6)
-		page := archive.Page{}
-		page.Data = rm.New()
-		err = page.Data.UnmarshalBinary(pageData)
+		resources.AddLexicon(l.lang, words)
+		slog.Info("Loaded lexicon", "entries", len(words), "file", l.path)
+	}
+	for _, g := range grammars {
+		grammar, err := hwr.LoadMathGrammar(g.path)
 		if err != nil {
-			log.Printf("Warning: can't parse page file %s: %v", pagePath, err)
-			continue
+			return nil, err
 		}
-
-		zipArchive.Pages = append(zipArchive.Pages, page)
-	}
-
-	if len(zipArchive.Pages) == 0 {
-		return nil, errors.New("no pages found in archive")
+		resources.SetMathGrammar(g.lang, grammar)
+		slog.Info("Loaded math grammar", "file", g.path)
 	}
-
-	return zipArchive, nil
+	return resources, nil
 }
 
 func main() {
@@ -534,32 +430,120 @@ func main() {
 		output := flag.CommandLine.Output()
 		fmt.Fprintf(output, "Usage: %s [options] somefile.zip\n", exec)
 		fmt.Fprintln(output, "\twhere somefile.zip is what you got with rmapi get")
-		fmt.Fprintln(output, "\tOutputs: Text->text, Math->LaTex, Diagram->svg")
+		fmt.Fprintln(output, "\tOutputs: Text->text, Math->LaTex, Diagram->svg (or mermaid, dot, drawio, json with -diagram-format), Raw->json")
 		fmt.Fprintln(output, "\tUse -debug-raw to output raw extracted data structure before MyScript conversion")
 		fmt.Fprintln(output, "Options:")
 		flag.PrintDefaults()
 	}
-	var inputType = flag.String("type", "Text", "type of the content: Text, Math, Diagram")
+	var inputType = flag.String("type", "Text", "type of the content: Text, Math, Diagram, Raw (mixed text and shapes)")
 	var lang = flag.String("lang", "en_US", "language culture")
 	//todo: page range, all pages etc
 	var page = flag.Int("page", -1, "page to convert (default all)")
 	//var outputFile = flag.String("o", "-", "output default stdout, wip")
 	var addPages = flag.Bool("a", false, "add page headers")
-	var visualize = flag.Bool("visualize", false, "render strokes to PNG for debugging (saves to <filename>_page_<N>.png)")
+	var visualize = flag.Bool("visualize", false, "render strokes to an image for debugging (saves to <filename>_page_<N>.<format>, or <filename>.pdf)")
+	var visualizeFormat = flag.String("format", hwr.VisualizeFormatPNG, fmt.Sprintf("image format of -visualize, one of %v", hwr.VisualizeFormats()))
+	var background = flag.Bool("background", false, "draw the strokes of -visualize png and pdf over the pages of the annotated PDF or EPUB, at their position")
+	var fullPage = flag.Bool("full-page", false, "render the whole device page with -visualize, rather than cropping to the strokes")
+	var template = flag.Bool("template", false, "draw the page template (lines, grid or dots) of -visualize -full-page and pdf pages")
+	var theme = flag.String("theme", hwr.ThemeLight, fmt.Sprintf("colors of -visualize, one of %v", hwr.Themes()))
+	var paletteFile = flag.String("palette", "", "YAML/JSON file mapping pen colors (black, blue... or IDs) to #rrggbb colors for -visualize")
+	var texture = flag.Bool("texture", false, "simulate pencil grain, brush bristles and calligraphy nibs with -visualize")
+	var supersampling = flag.Int("supersampling", 1, "draw the strokes of -visualize png at this many times the resolution, then average them down (1 to 4)")
+	var animate = flag.String("animate", "", fmt.Sprintf("replay the writing of pages to an animation, one of %v (saves to <filename>_page_<N>.<format>), drawn as -visualize draws them", hwr.AnimationFormats()))
+	var animateMode = flag.String("animate-mode", hwr.AnimateStrokes, fmt.Sprintf("how strokes appear in -animate, one of %v", hwr.AnimationModes()))
+	var animateSpeed = flag.Float64("animate-speed", 0, "strokes, or points with -animate-mode point, drawn per second by -animate (default 5 strokes, 200 points)")
+	var debugOverlay = flag.Bool("debug-overlay", false, "recognize pages and draw the recognized words, their lines and the strokes of each word over -visualize png images (saves to <filename>_page_<N>_overlay.png)")
 	var forceStandardParser = flag.Bool("force-standard", false, "force using standard rmapi parser (skip new format parser)")
 	var debugRawData = flag.Bool("debug-raw", false, "output raw extracted data structure before MyScript conversion (saves to <filename>_raw_page_<N>.json)")
 	var splitPages = flag.Bool("split", false, "output each page to a separate .txt file (saves to <filename>_page_<N>.txt)")
 	var batchSize = flag.Int64("b", 3, "batch size")
+	var lexicons, grammars resourceFlag
+	flag.Var(&lexicons, "lexicon", "custom lexicon file, one word per line, as [lang=]file (repeatable)")
+	flag.Var(&grammars, "grammar", "custom math grammar file, as [lang=]file (repeatable)")
+	var pageLangs = flag.String("page-lang", "", "language per page, e.g. 1=fr_FR,2-4=en_US (pages are 1-indexed)")
+	var detectLangs = flag.String("detect-lang", "", "comma separated candidate languages, each page is recognized with the most confident one")
+	var diagramFormat = flag.String("diagram-format", hwr.DiagramFormatSVG, fmt.Sprintf("diagram output format, one of %v", hwr.DiagramFormats()))
+	var profileName = flag.String("profile", "", fmt.Sprintf("recognition profile: a YAML/JSON file or one of %v", hwr.ProfileNames()))
+	var logLevel = flag.String("log-level", "info", "log level: debug, info, warn or error")
+	var quiet = flag.Bool("quiet", false, "only log errors, same as -log-level error")
+	var noLimits = flag.Bool("no-limits", false, "accept documents beyond the size, page and point limits")
 	flag.Parse()
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *quiet {
+		level = slog.LevelError
+	}
+	// logs go to stderr, stdout is left to the recognized text
+	if err := logging.Setup(os.Stderr, level, logging.FormatText); err != nil {
+		log.Fatal(err)
+	}
+
+	resources, err := loadResources(lexicons, grammars)
+	if err != nil {
+		log.Fatal(err)
+	}
 	
+	langs, err := hwr.ParsePageLangs(*pageLangs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !hwr.IsDiagramFormat(*diagramFormat) {
+		log.Fatalf("unsupported diagram format: %s", *diagramFormat)
+	}
+	if !hwr.IsVisualizeFormat(*visualizeFormat) {
+		log.Fatalf("unsupported visualization format: %s", *visualizeFormat)
+	}
+	if *supersampling < 1 || *supersampling > 4 {
+		log.Fatalf("unsupported supersampling: %d", *supersampling)
+	}
+	if !hwr.IsTheme(*theme) {
+		log.Fatalf("unsupported theme: %s", *theme)
+	}
+	if *animate != "" && !hwr.IsAnimationFormat(*animate) {
+		log.Fatalf("unsupported animation format: %s", *animate)
+	}
+	if !hwr.IsAnimationMode(*animateMode) {
+		log.Fatalf("unsupported animation mode: %s", *animateMode)
+	}
+	if *debugOverlay && (*animate != "" || *visualizeFormat != hwr.VisualizeFormatPNG) {
+		log.Fatal("-debug-overlay draws png images, it can't be used with -animate, -format svg or -format pdf")
+	}
+	var palette map[uint32][3]uint8
+	if *paletteFile != "" {
+		palette, err = hwr.LoadPalette(*paletteFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	cfg := hwr.Config{
-		Page:         *page,
-		Lang:         *lang,
-		InputType:    *inputType,
-		AddPages:     *addPages,
-		BatchSize:    *batchSize,
-		DebugRawData: *debugRawData,
-		SplitPages:   *splitPages,
+		Page:          *page,
+		Lang:          *lang,
+		InputType:     *inputType,
+		AddPages:      *addPages,
+		BatchSize:     *batchSize,
+		DebugRawData:  *debugRawData,
+		SplitPages:    *splitPages,
+		Resources:     resources,
+		PageLangs:     langs,
+		DetectLangs:   hwr.ParseLangList(*detectLangs),
+		DiagramFormat: *diagramFormat,
+		DebugOverlay:  *debugOverlay,
+	}
+
+	if *profileName != "" {
+		profile, err := hwr.LoadProfile(*profileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Profile = profile
+		if profile.Lang != "" && !isFlagSet("lang") {
+			cfg.Lang = profile.Lang
+		}
 	}
 
 	args := flag.Args()
@@ -571,18 +555,21 @@ func main() {
 	ext := path.Ext(filename)
 	cfg.OutputFile = strings.TrimSuffix(filename, ext)
 
-	var err error
 	var z *archive.Zip
+	limits := hwr.DefaultLimits()
+	if *noLimits {
+		limits = hwr.Limits{}
+	}
 
 	switch ext {
 	case ".zip", ".rmdoc":
 		if *forceStandardParser {
-			z, err = loadRmZipStandardOnly(filename)
+			z, err = loadRmZipStandardOnly(filename, limits)
 		} else {
-			z, err = loadRmZip(filename)
+			z, err = loadRmZip(filename, limits)
 		}
 	case ".rm":
-		z, err = loadRmPage(filename)
+		z, err = loadRmPage(filename, limits)
 	default:
 		log.Fatal("Unsupported file")
 
@@ -591,8 +578,18 @@ func main() {
 		log.Fatalln(err, "Can't read file ", filename)
 	}
 
+	visualizeConfig := hwr.DefaultVisualizationConfig()
+	visualizeConfig.Background = *background
+	visualizeConfig.FullPage = *fullPage
+	visualizeConfig.Template = *template
+	visualizeConfig.Supersampling = *supersampling
+	visualizeConfig.Texture = *texture
+	visualizeConfig.Theme = *theme
+	visualizeConfig.Palette = palette
+	cfg.Overlay = visualizeConfig
+
 	// Visualize if requested
-	if *visualize {
+	if *visualize || *animate != "" {
 		pagesToVisualize := []int{}
 		if *page >= 0 {
 			pagesToVisualize = []int{*page - 1} // Convert to 0-based
@@ -603,16 +600,41 @@ func main() {
 			}
 		}
 
+		if *animate != "" {
+			animation := hwr.AnimationConfig{Format: *animate, Mode: *animateMode, Speed: *animateSpeed}
+			for _, p := range pagesToVisualize {
+				output := fmt.Sprintf("%s_page_%d.%s", cfg.OutputFile, p, *animate)
+				if err := hwr.AnimatePage(context.Background(), z, p, output, visualizeConfig, animation); err != nil {
+					slog.Error("Error animating page", "page", p, "err", err)
+				} else {
+					slog.Info("Saved animation", "file", output)
+				}
+			}
+			return
+		}
+		if *visualizeFormat == hwr.VisualizeFormatPDF {
+			// a single document with all pages
+			output := cfg.OutputFile + ".pdf"
+			if err := hwr.VisualizePDF(context.Background(), z, pagesToVisualize, output, visualizeConfig); err != nil {
+				log.Fatalf("Error visualizing pages: %v", err)
+			}
+			slog.Info("Saved visualization", "file", output)
+			return
+		}
+
 		for _, p := range pagesToVisualize {
-			outputPNG := fmt.Sprintf("%s_page_%d.png", cfg.OutputFile, p)
-			log.Printf("Visualizing page %d to %s", p, outputPNG)
-			if err := hwr.VisualizePage(z, p, outputPNG); err != nil {
-				log.Printf("Error visualizing page %d: %v", p, err)
+			output := fmt.Sprintf("%s_page_%d.%s", cfg.OutputFile, p, *visualizeFormat)
+			slog.Debug("Visualizing page", "page", p, "file", output)
+			if err := hwr.VisualizePageFormat(context.Background(), z, p, output, *visualizeFormat, visualizeConfig); err != nil {
+				slog.Error("Error visualizing page", "page", p, "err", err)
 			} else {
-				log.Printf("Saved visualization to %s", outputPNG)
+				slog.Info("Saved visualization", "file", output)
 			}
 		}
-		return
+		// the overlays are drawn once the pages are recognized
+		if !*debugOverlay {
+			return
+		}
 	}
 
 	hwr.Hwr(z, cfg)
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// minAPIKeyLength rejects keys that are easy to guess.
+const minAPIKeyLength = 16
+
+// apiKey is a client allowed to use the API, with its page quotas (0 for unlimited).
+type apiKey struct {
+	Name         string `yaml:"name"`
+	Key          string `yaml:"key"`
+	DailyPages   int    `yaml:"daily_pages"`
+	MonthlyPages int    `yaml:"monthly_pages"`
+}
+
+// apiKeyConfig is the API_KEYS_FILE, in YAML or JSON.
+type apiKeyConfig struct {
+	Keys []apiKey `yaml:"keys"`
+}
+
+// apiClient is an API key with its usage. Usage is kept in memory and
+// resets when the server restarts.
+type apiClient struct {
+	apiKey
+	mu         sync.Mutex
+	day        string // date of dayPages, 2006-01-02
+	dayPages   int
+	month      string // month of monthPages, 2006-01
+	monthPages int
+	totalPages int
+	requests   int
+}
+
+// Auth authenticates the API clients. Without keys every request is
+// anonymous and unlimited.
+type Auth struct {
+	clients   []*apiClient
+	anonymous *apiClient
+}
+
+type contextKey int
+
+const clientContextKey contextKey = 0
+
+// LoadAuth reads the API keys file, an empty path disables authentication.
+func LoadAuth(path string) (*Auth, error) {
+	auth := &Auth{anonymous: &apiClient{apiKey: apiKey{Name: "anonymous"}}}
+	if path == "" {
+		return auth, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read API keys: %w", err)
+	}
+	var config apiKeyConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("can't parse API keys %s: %w", path, err)
+	}
+	if len(config.Keys) == 0 {
+		return nil, fmt.Errorf("no keys in %s", path)
+	}
+
+	names := make(map[string]bool)
+	keys := make(map[string]bool)
+	for i, key := range config.Keys {
+		switch {
+		case key.Name == "":
+			return nil, fmt.Errorf("key %d: missing name", i+1)
+		case names[key.Name]:
+			return nil, fmt.Errorf("key %s: duplicate name", key.Name)
+		case len(key.Key) < minAPIKeyLength:
+			return nil, fmt.Errorf("key %s: shorter than %d characters", key.Name, minAPIKeyLength)
+		case keys[key.Key]:
+			return nil, fmt.Errorf("key %s: duplicate key", key.Name)
+		case key.DailyPages < 0 || key.MonthlyPages < 0:
+			return nil, fmt.Errorf("key %s: negative quota", key.Name)
+		}
+		names[key.Name] = true
+		keys[key.Key] = true
+		auth.clients = append(auth.clients, &apiClient{apiKey: key})
+	}
+	return auth, nil
+}
+
+// Enabled reports whether requests need an API key.
+func (a *Auth) Enabled() bool {
+	return len(a.clients) > 0
+}
+
+// lookup returns the client of a bearer token.
+func (a *Auth) lookup(token string) (*apiClient, bool) {
+	var found *apiClient
+	// compare with every key, in constant time
+	for _, c := range a.clients {
+		if subtle.ConstantTimeCompare([]byte(c.Key), []byte(token)) == 1 {
+			found = c
+		}
+	}
+	return found, found != nil
+}
+
+// requireAPIKey authenticates the request with its bearer token before calling next.
+func (s *Server) requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := s.auth.anonymous
+		if s.auth.Enabled() {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			var ok bool
+			if found {
+				client, ok = s.auth.lookup(strings.TrimSpace(token))
+			}
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="rmapi-hwr"`)
+				writeError(w, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid API key")
+				return
+			}
+		}
+
+		client.mu.Lock()
+		client.requests++
+		client.mu.Unlock()
+		next(w, r.WithContext(context.WithValue(r.Context(), clientContextKey, client)))
+	}
+}
+
+// requestClient returns the client authenticated by requireAPIKey.
+func (s *Server) requestClient(r *http.Request) *apiClient {
+	if client, ok := r.Context().Value(clientContextKey).(*apiClient); ok {
+		return client
+	}
+	return s.auth.anonymous
+}
+
+// chargePages counts pages sent for recognition against the quotas of the
+// client. Nothing is counted if a quota would be exceeded; the returned
+// duration is the time until that quota resets.
+func (c *apiClient) chargePages(pages int, now time.Time) (time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if c.day != day {
+		c.day, c.dayPages = day, 0
+	}
+	if c.month != month {
+		c.month, c.monthPages = month, 0
+	}
+
+	if c.DailyPages > 0 && c.dayPages+pages > c.DailyPages {
+		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		return tomorrow.Sub(now), fmt.Errorf("Daily quota of %d pages exceeded (%d used, %d requested)", c.DailyPages, c.dayPages, pages)
+	}
+	if c.MonthlyPages > 0 && c.monthPages+pages > c.MonthlyPages {
+		nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+		return nextMonth.Sub(now), fmt.Errorf("Monthly quota of %d pages exceeded (%d used, %d requested)", c.MonthlyPages, c.monthPages, pages)
+	}
+
+	c.dayPages += pages
+	c.monthPages += pages
+	c.totalPages += pages
+	return 0, nil
+}
+
+// chargeRequest charges the pages of a recognition request to its client and
+// answers 429 if a quota is exceeded.
+func (s *Server) chargeRequest(w http.ResponseWriter, r *http.Request, pages int) bool {
+	retryAfter, err := s.requestClient(r).chargePages(pages, time.Now())
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, codeQuotaExceeded, err.Error())
+		return false
+	}
+	return true
+}
+
+// usageJSON returns the usage and quotas of the client.
+func (c *apiClient) usageJSON(now time.Time) map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	dayPages, monthPages := c.dayPages, c.monthPages
+	if c.day != day {
+		dayPages = 0
+	}
+	if c.month != month {
+		monthPages = 0
+	}
+
+	return map[string]interface{}{
+		"key": c.Name,
+		"day": map[string]interface{}{
+			"date":  day,
+			"pages": dayPages,
+			"limit": c.DailyPages,
+		},
+		"month": map[string]interface{}{
+			"month": month,
+			"pages": monthPages,
+			"limit": c.MonthlyPages,
+		},
+		"total_pages": c.totalPages,
+		"requests":    c.requests,
+	}
+}
+
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.requestClient(r).usageJSON(time.Now()))
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddvk/rmapi-hwr/hwr/apiclient"
+	"github.com/ddvk/rmapi-hwr/hwr/client"
+	"github.com/juruen/rmapi/encoding/rm"
+)
+
+// recognizedText is the answer of the fake MyScript API to every page.
+const recognizedText = "hello world"
+
+// newContractClient starts the API on a test server, recognizing with a fake
+// MyScript API, and returns a client checking every exchange against the spec.
+func newContractClient(t *testing.T) *apiclient.Client {
+	t.Helper()
+	return newContractClientWith(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(recognizedText))
+	})
+}
+
+// newContractClientWith is newContractClient with the MyScript API answering
+// authenticated requests with recognize.
+func newContractClientWith(t *testing.T, recognize http.HandlerFunc) *apiclient.Client {
+	t.Helper()
+	myscript := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("applicationKey") == "" || r.Header.Get("hmac") == "" {
+			http.Error(w, "missing credentials", http.StatusUnauthorized)
+			return
+		}
+		recognize(w, r)
+	}))
+	t.Cleanup(myscript.Close)
+	endpoint := client.Endpoint
+	client.Endpoint = myscript.URL
+	t.Cleanup(func() { client.Endpoint = endpoint })
+
+	t.Setenv("PORT", "0")
+	t.Setenv("OUTPUT_DIR", t.TempDir())
+	t.Setenv("RMAPI_HWR_APPLICATIONKEY", "application-key")
+	t.Setenv("RMAPI_HWR_HMAC", "hmac-key")
+	t.Setenv("API_KEYS_FILE", "")
+	t.Setenv("HWR_PROFILE", "")
+	api := httptest.NewServer(NewServer().handler())
+	t.Cleanup(api.Close)
+
+	c := apiclient.New(api.URL, "")
+	c.HTTPClient = &http.Client{Transport: contractTransport{t: t, spec: loadOpenAPI(t)}}
+	return c
+}
+
+// invalidRequests returns a copy of c that only checks responses against the
+// spec, for requests the spec doesn't allow on purpose.
+func invalidRequests(c *apiclient.Client) *apiclient.Client {
+	transport := c.HTTPClient.Transport.(contractTransport)
+	transport.responsesOnly = true
+	invalid := *c
+	invalid.HTTPClient = &http.Client{Transport: transport}
+	return &invalid
+}
+
+// testDocument returns a v5 notebook of pages with a few strokes each. rmapi
+// can't write .rm files, they are encoded here.
+func testDocument(t *testing.T, pages int) []byte {
+	t.Helper()
+	const id = "00000000-0000-0000-0000-000000000000"
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	add := func(name string, data []byte) {
+		f, err := w.Create(name)
+		if err == nil {
+			_, err = f.Write(data)
+		}
+		if err != nil {
+			t.Fatalf("writing test document: %v", err)
+		}
+	}
+	add(id+".content", []byte(fmt.Sprintf(`{"fileType": "notebook", "pageCount": %d}`, pages)))
+	add(id+".pagedata", []byte(strings.Repeat("Blank\n", pages)))
+	for p := 0; p < pages; p++ {
+		page := new(bytes.Buffer)
+		page.WriteString(rm.HeaderV5)
+		write := func(v any) { binary.Write(page, binary.LittleEndian, v) }
+		write(uint32(1)) // layers
+		write(uint32(3)) // lines
+		for i := 0; i < 3; i++ {
+			write([]uint32{uint32(rm.BallPointV5), uint32(rm.Black), 0})
+			write([]float32{float32(rm.Medium), 0})
+			write(uint32(20)) // points
+			for j := 0; j < 20; j++ {
+				// x, y, speed, direction, width, pressure
+				write([]float32{float32(200 + 40*i + 3*j), float32(300 + 100*p + 2*j), 1, 0, 2, 0.5})
+			}
+		}
+		add(fmt.Sprintf("%s/%d.rm", id, p), page.Bytes())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("writing test document: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// clientError returns the *apiclient.Error of err, failing the test otherwise.
+func clientError(t *testing.T, err error) *apiclient.Error {
+	t.Helper()
+	var e *apiclient.Error
+	if !errors.As(err, &e) {
+		t.Fatalf("got error %v, want an *apiclient.Error", err)
+	}
+	return e
+}
+
+// zipEntries returns the names of the entries of a zip.
+func zipEntries(t *testing.T, data []byte) []string {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("reading zip: %v", err)
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestContractHealth(t *testing.T) {
+	c := newContractClient(t)
+	health, err := c.Health(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Status != "ok" {
+		t.Errorf("status %q, want ok", health.Status)
+	}
+}
+
+func TestContractRecognize(t *testing.T) {
+	c := newContractClient(t)
+	ctx := context.Background()
+	doc := testDocument(t, 2)
+
+	result, err := c.Recognize(ctx, "notes.zip", bytes.NewReader(doc), apiclient.Options{Type: "Text", Lang: "en_US", Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Filename != "notes.zip" || result.Pages != 2 {
+		t.Errorf("got %q with %d pages, want notes.zip with 2 pages", result.Filename, result.Pages)
+	}
+	for p := 0; p < 2; p++ {
+		if result.Text[p] != recognizedText {
+			t.Errorf("page %d: text %q, want %q", p, result.Text[p], recognizedText)
+		}
+		if result.Langs[p] != "en_US" {
+			t.Errorf("page %d: lang %q, want en_US", p, result.Langs[p])
+		}
+	}
+
+	_, err = c.Recognize(ctx, "notes.zip", bytes.NewReader(doc), apiclient.Options{Page: 5})
+	if e := clientError(t, err); e.StatusCode != http.StatusBadRequest || e.Code != codePageOutOfRange {
+		t.Errorf("page 5 of 2: got %d %s, want 400 %s", e.StatusCode, e.Code, codePageOutOfRange)
+	}
+
+	_, err = c.Recognize(ctx, "notes.zip", strings.NewReader("not a zip"), apiclient.Options{})
+	if e := clientError(t, err); e.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid document: got %d %s, want 400", e.StatusCode, e.Code)
+	}
+}
+
+func TestContractRecognizeStream(t *testing.T) {
+	c := newContractClient(t)
+	var events []apiclient.StreamEvent
+	err := c.RecognizeStream(context.Background(), "notes.zip", bytes.NewReader(testDocument(t, 2)), apiclient.Options{}, func(e apiclient.StreamEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[2].Type != "done" || events[2].Recognized != 2 {
+		t.Fatalf("got events %+v, want 2 pages and done", events)
+	}
+	for _, e := range events[:2] {
+		if e.Type != "page" || e.Text != recognizedText {
+			t.Errorf("got event %+v, want page %q", e, recognizedText)
+		}
+	}
+}
+
+func TestContractRecognizeStreamCompletionOrder(t *testing.T) {
+	// page 0 is held until page 1 was streamed
+	release := make(chan struct{})
+	c := newContractClientWith(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte(`"y":[300,`)) {
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(recognizedText))
+	})
+	// the contract transport reads the whole stream before returning it
+	c.HTTPClient = http.DefaultClient
+	var events []apiclient.StreamEvent
+	err := c.RecognizeStream(context.Background(), "notes.zip", bytes.NewReader(testDocument(t, 2)), apiclient.Options{}, func(e apiclient.StreamEvent) error {
+		if len(events) == 0 {
+			close(release)
+		}
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].Page != 1 || events[1].Page != 0 || events[2].Type != "done" {
+		t.Fatalf("got events %+v, want page 1, page 0 and done", events)
+	}
+}
+
+func TestContractConvert(t *testing.T) {
+	c := newContractClient(t)
+	ctx := context.Background()
+	doc := testDocument(t, 2)
+
+	archive, err := c.Convert(ctx, "notes.zip", bytes.NewReader(doc), apiclient.ConvertOptions{Format: "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := zipEntries(t, archive); strings.Join(names, ",") != "page_0.png,page_1.png" {
+		t.Errorf("got entries %v, want page_0.png and page_1.png", names)
+	}
+
+	pdf, err := c.Convert(ctx, "notes.zip", bytes.NewReader(doc), apiclient.ConvertOptions{Page: 2, Format: "pdf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+		t.Errorf("format pdf returned %q...", pdf[:min(len(pdf), 8)])
+	}
+
+	_, err = invalidRequests(c).Convert(ctx, "notes.zip", bytes.NewReader(doc), apiclient.ConvertOptions{Format: "bmp"})
+	if e := clientError(t, err); e.StatusCode != http.StatusBadRequest {
+		t.Errorf("format bmp: got %d %s, want 400", e.StatusCode, e.Code)
+	}
+}
+
+func TestContractThumbnails(t *testing.T) {
+	c := newContractClient(t)
+	ctx := context.Background()
+	doc := testDocument(t, 3)
+
+	thumbnails, err := c.Thumbnails(ctx, "notes.zip", bytes.NewReader(doc), apiclient.ThumbnailOptions{Width: 78, Height: 104})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := zipEntries(t, thumbnails); strings.Join(names, ",") != "thumbnail_0.png,thumbnail_1.png,thumbnail_2.png" {
+		t.Errorf("got entries %v, want a thumbnail per page", names)
+	}
+
+	sheet, err := c.Thumbnails(ctx, "notes.zip", bytes.NewReader(doc), apiclient.ThumbnailOptions{Sheet: true, Columns: 2, Theme: "dark"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := png.Decode(bytes.NewReader(sheet)); err != nil {
+		t.Errorf("contact sheet: %v", err)
+	}
+
+	_, err = invalidRequests(c).Thumbnails(ctx, "notes.zip", bytes.NewReader(doc), apiclient.ThumbnailOptions{Theme: "sepia"})
+	if e := clientError(t, err); e.StatusCode != http.StatusBadRequest || e.Code != codeInvalidRequest {
+		t.Errorf("theme sepia: got %d %s, want 400 %s", e.StatusCode, e.Code, codeInvalidRequest)
+	}
+
+	// 35 thumbnails of 1404x1404 are over the pixel budget
+	large := apiclient.ThumbnailOptions{Width: maxThumbnailSize, Height: maxThumbnailSize}
+	_, err = c.Thumbnails(ctx, "notes.zip", bytes.NewReader(testDocument(t, 35)), large)
+	if e := clientError(t, err); e.StatusCode != http.StatusRequestEntityTooLarge || e.Code != codeDocumentTooLarge {
+		t.Errorf("35 large thumbnails: got %d %s, want 413 %s", e.StatusCode, e.Code, codeDocumentTooLarge)
+	}
+	// 16 of them are within it, but not on one row of a contact sheet
+	large.Sheet, large.Columns = true, maxContactColumns
+	_, err = c.Thumbnails(ctx, "notes.zip", bytes.NewReader(testDocument(t, 16)), large)
+	if e := clientError(t, err); e.StatusCode != http.StatusRequestEntityTooLarge || e.Code != codeDocumentTooLarge {
+		t.Errorf("wide contact sheet: got %d %s, want 413 %s", e.StatusCode, e.Code, codeDocumentTooLarge)
+	}
+}
+
+func TestContractJobs(t *testing.T) {
+	c := newContractClient(t)
+	ctx := context.Background()
+
+	job, err := c.CreateJob(ctx, "notes.zip", bytes.NewReader(testDocument(t, 2)), apiclient.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID == "" || job.Type != jobHWR || job.Progress.Total != 2 {
+		t.Fatalf("got job %+v, want an hwr job of 2 pages", job)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !job.Finished() {
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s", job.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if job, err = c.GetJob(ctx, job.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.Status != jobDone {
+		t.Fatalf("job %s, want done", job.Status)
+	}
+
+	result, err := c.JobResult(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Text[0] != recognizedText || result.Text[1] != recognizedText {
+		t.Errorf("got text %v, want %q for both pages", result.Text, recognizedText)
+	}
+
+	if job, err = c.CancelJob(ctx, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != jobDone {
+		t.Errorf("canceling a finished job made it %s", job.Status)
+	}
+
+	_, err = c.GetJob(ctx, "unknown")
+	if e := clientError(t, err); e.StatusCode != http.StatusNotFound || e.Code != codeJobNotFound {
+		t.Errorf("unknown job: got %d %s, want 404 %s", e.StatusCode, e.Code, codeJobNotFound)
+	}
+}
+
+func TestContractUsage(t *testing.T) {
+	c := newContractClient(t)
+	if _, err := c.Usage(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestClientFormFields sends every option of the client and checks its form
+// fields against the spec, the transport failing on any field it lacks.
+func TestClientFormFields(t *testing.T) {
+	c := newContractClient(t)
+	ctx := context.Background()
+	doc := testDocument(t, 1)
+
+	opts := apiclient.Options{
+		Type:          "Text",
+		Lang:          "en_US",
+		Page:          1,
+		PageLang:      "1=en_US",
+		DetectLang:    []string{"en_US", "fr_FR"},
+		DiagramFormat: "svg",
+		Profile:       "notes",
+		ProfileFile:   []byte(`{"lang": "en_US"}`),
+		Lexicon:       []byte("rmapi\n"),
+		Grammar:       []byte("symbol = a\n"),
+		Concurrency:   1,
+	}
+	// recognition results are checked by the other tests, only the exchange matters here
+	c.Recognize(ctx, "notes.zip", bytes.NewReader(doc), opts)
+	c.RecognizeStream(ctx, "notes.zip", bytes.NewReader(doc), opts, func(apiclient.StreamEvent) error { return nil })
+	opts.CallbackURL = "https://example.com/hook"
+	c.CreateJob(ctx, "notes.zip", bytes.NewReader(doc), opts)
+	c.Convert(ctx, "notes.zip", bytes.NewReader(doc), apiclient.ConvertOptions{Page: apiclient.LastOpenedPage, Format: "svg", Background: true})
+	c.Thumbnails(ctx, "notes.zip", bytes.NewReader(doc), apiclient.ThumbnailOptions{Width: 10, Height: 10, Sheet: true, Columns: 1, Theme: "eink"})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error codes of the API, in the code field of an error.
+const (
+	codeInvalidRequest     = "invalid_request"     // Malformed form or invalid parameter
+	codeInvalidArchive     = "invalid_archive"     // The file is not a readable .rmdoc or .zip
+	codeUnsafeArchive      = "unsafe_archive"      // The archive looks like a zip bomb or has file names escaping it
+	codeDocumentTooLarge   = "document_too_large"  // The upload, its content, pages or points exceed the server limits
+	codePageOutOfRange     = "page_out_of_range"   // page is beyond the last page of the document
+	codeInvalidPage        = "invalid_page"        // The page has no stroke data
+	codeCredentialsMissing = "credentials_missing" // MyScript keys are not configured
+	codeRecognitionFailed  = "recognition_failed"  // MyScript failed or returned an unusable result
+	codeConversionFailed   = "conversion_failed"   // A page could not be rendered to an image
+	codeNoContent          = "no_content"          // No page had recognized content
+	codeUnauthorized       = "unauthorized"        // Missing or invalid API key
+	codeQuotaExceeded      = "quota_exceeded"      // A page quota of the API key is exceeded
+	codeJobNotFound        = "job_not_found"       // Unknown job, or job of another API key
+	codeJobNotFinished     = "job_not_finished"    // The job is still queued or running, or was canceled
+	codeMethodNotAllowed   = "method_not_allowed"  // Wrong HTTP method
+	codeNotFound           = "not_found"           // Unknown endpoint
+	codeInternal           = "internal_error"      // Server side failure
+)
+
+// apiError is the JSON error envelope of every error response, and the
+// value of the per page errors map.
+type apiError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// pageError is the failure of one page, with its error code.
+type pageError struct {
+	code string
+	err  error
+}
+
+func (e *pageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pageError) Unwrap() error {
+	return e.err
+}
+
+// newPageError returns the API error of a failed page, recognition_failed
+// unless err carries another code.
+func newPageError(err error) apiError {
+	code := codeRecognitionFailed
+	var pe *pageError
+	if errors.As(err, &pe) {
+		code = pe.code
+	}
+	return apiError{Error: err.Error(), Code: code}
+}
+
+// writeError sends an error response: {"error": message, "code": code}.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{
+		Error: message,
+		Code:  code,
+	})
+}
+
+// handleNotFound answers requests to unknown endpoints.
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("No endpoint %s %s", r.Method, r.URL.Path))
+}
+
+// writeRequestError sends the error of an invalid request.
+func writeRequestError(w http.ResponseWriter, err *requestError) {
+	writeError(w, err.status, err.code, err.message)
+}
+
+// noResultError returns the status and error of a request where no page had
+// a result: failedCode if pages failed, no_content if they were all empty.
+func noResultError(message, failedCode string, failedPages int) (int, apiError) {
+	if failedPages == 0 {
+		return http.StatusNotFound, apiError{Error: message, Code: codeNoContent}
+	}
+	return http.StatusBadGateway, apiError{
+		Error: fmt.Sprintf("%s, %d pages failed", message, failedPages),
+		Code:  failedCode,
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ddvk/rmapi-hwr/hwr"
+	"github.com/ddvk/rmapi-hwr/hwr/logging"
+	"github.com/juruen/rmapi/archive"
+)
+
+const (
+	defaultJobWorkers = 4         // Pages recognized concurrently across all jobs
+	jobRetention      = time.Hour // How long finished jobs are kept
+)
+
+// Job kinds
+const (
+	jobHWR     = "hwr"     // Handwriting recognition, as /api/hwr
+	jobConvert = "convert" // Image conversion, as /api/convert
+)
+
+// Job states
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+// Page states
+const (
+	pagePending = "pending"
+	pageRunning = "running"
+	pageDone    = "done"
+	pageEmpty   = "empty"
+	pageFailed  = "failed"
+)
+
+// Job is an asynchronous recognition of a document.
+type Job struct {
+	mu          sync.Mutex
+	id          string
+	kind        string
+	filename    string
+	docPages    int
+	zip         *archive.Zip
+	cfg         hwr.Config
+	status      string
+	pages       map[int]string // page (0-indexed) to page state
+	errors      map[int]apiError
+	result      map[int]string
+	langs       map[int]string
+	images      map[int][]byte // Images of converted pages, their PDF content for format pdf
+	format      string         // Image format of a conversion
+	background  bool           // Draw a conversion over the pages of the document
+	callbackURL string
+	deliveries  []webhookDelivery
+	owner       *apiClient
+	created     time.Time
+	updated     time.Time
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// pageTask is a page of a job waiting for a worker.
+type pageTask struct {
+	job  *Job
+	page int
+}
+
+// JobQueue holds the jobs and the worker pool recognizing their pages.
+// Pages of all jobs share the pool, in the order they were submitted.
+type JobQueue struct {
+	server *Server
+	tasks  chan pageTask
+	mu     sync.Mutex
+	jobs   map[string]*Job
+}
+
+// NewJobQueue starts a worker pool of the given size.
+func NewJobQueue(server *Server, workers int) *JobQueue {
+	if workers < 1 {
+		workers = defaultJobWorkers
+	}
+	q := &JobQueue{
+		server: server,
+		tasks:  make(chan pageTask),
+		jobs:   make(map[string]*Job),
+	}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	go q.expire()
+	return q
+}
+
+// Submit queues the pages (0-indexed) of a request and returns the new job.
+// The job outlives the request but its logs keep the request ID of ctx.
+func (q *JobQueue) Submit(ctx context.Context, kind string, req *hwrRequest, pages []int) *Job {
+	id := newJobID()
+	ctx, cancel := context.WithCancel(logging.With(context.WithoutCancel(ctx), "job_id", id))
+	now := time.Now()
+	job := &Job{
+		id:          id,
+		kind:        kind,
+		filename:    req.filename,
+		docPages:    len(req.zip.Pages),
+		zip:         req.zip,
+		cfg:         req.cfg,
+		status:      jobQueued,
+		pages:       make(map[int]string),
+		errors:      make(map[int]apiError),
+		result:      make(map[int]string),
+		langs:       make(map[int]string),
+		images:      make(map[int][]byte),
+		callbackURL: req.callbackURL,
+		owner:       req.client,
+		format:      req.format,
+		background:  req.background,
+		created:     now,
+		updated:     now,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	for _, p := range pages {
+		job.pages[p] = pagePending
+	}
+
+	q.mu.Lock()
+	q.jobs[job.id] = job
+	q.mu.Unlock()
+
+	// feed the pool without blocking the request
+	job.wg.Add(len(pages))
+	go func() {
+		for i, p := range pages {
+			select {
+			case q.tasks <- pageTask{job: job, page: p}:
+			case <-ctx.Done():
+				for range pages[i:] {
+					job.wg.Done()
+				}
+				return
+			}
+		}
+	}()
+	go func() {
+		job.wg.Wait()
+		job.finish()
+		cancel()
+		if job.callbackURL != "" {
+			q.server.deliverWebhook(job)
+		}
+	}()
+
+	slog.InfoContext(ctx, "Job queued", "type", kind, "pages", len(pages), "filename", job.filename)
+	return job
+}
+
+// Get returns the job with the given id.
+func (q *JobQueue) Get(id string) (*Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	return job, ok
+}
+
+func (q *JobQueue) worker() {
+	for task := range q.tasks {
+		job := task.job
+		if job.ctx.Err() == nil {
+			job.setPage(task.page, pageRunning)
+			if job.kind == jobConvert {
+				q.convert(job, task.page)
+			} else {
+				q.recognize(job, task.page)
+			}
+		}
+		job.wg.Done()
+	}
+}
+
+func (q *JobQueue) recognize(job *Job, page int) {
+	result := q.server.recognizePageLimited(job.ctx, job.zip, job.cfg, page)
+	text, lang, err := result.text, result.lang, result.err
+	switch {
+	case err != nil && job.ctx.Err() != nil:
+		// canceled while recognizing, the page is skipped
+		job.setPage(page, pagePending)
+	case err != nil:
+		slog.ErrorContext(job.ctx, "Error processing page", "page", page, "err", err)
+		job.setError(page, newPageError(err))
+	case text == "":
+		job.setPage(page, pageEmpty)
+	default:
+		job.setResult(page, text, lang)
+	}
+}
+
+func (q *JobQueue) convert(job *Job, page int) {
+	tempDir, err := os.MkdirTemp(q.server.outputDir, "convert-*")
+	if err != nil {
+		job.setError(page, apiError{Error: fmt.Sprintf("can't create temp dir: %v", err), Code: codeInternal})
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	data, err := q.server.convertPage(job.ctx, job.zip, page, tempDir, job.format, job.background)
+	switch {
+	case err != nil:
+		slog.ErrorContext(job.ctx, "Error visualizing page", "page", page, "err", err)
+		job.setError(page, apiError{Error: err.Error(), Code: codeConversionFailed})
+	case data == nil:
+		job.setPage(page, pageEmpty)
+	default:
+		job.setImage(page, data)
+	}
+}
+
+// expire removes finished jobs after jobRetention.
+func (q *JobQueue) expire() {
+	for range time.Tick(jobRetention / 10) {
+		q.mu.Lock()
+		for id, job := range q.jobs {
+			job.mu.Lock()
+			expired := job.finished() && time.Since(job.updated) > jobRetention
+			job.mu.Unlock()
+			if expired {
+				delete(q.jobs, id)
+			}
+		}
+		q.mu.Unlock()
+	}
+}
+
+func (job *Job) setPage(page int, state string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.status == jobQueued {
+		job.status = jobRunning
+	}
+	job.pages[page] = state
+	job.updated = time.Now()
+}
+
+func (job *Job) setError(page int, err apiError) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.pages[page] = pageFailed
+	job.errors[page] = err
+	job.updated = time.Now()
+}
+
+func (job *Job) setResult(page int, text, lang string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.pages[page] = pageDone
+	job.result[page] = text
+	job.langs[page] = lang
+	job.updated = time.Now()
+}
+
+func (job *Job) setImage(page int, data []byte) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.pages[page] = pageDone
+	job.images[page] = data
+	job.updated = time.Now()
+}
+
+// finish sets the final state once every page was processed or skipped.
+func (job *Job) finish() {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	switch {
+	case job.status == jobCanceled:
+	case len(job.result) == 0 && len(job.images) == 0:
+		job.status = jobFailed
+	default:
+		job.status = jobDone
+	}
+	if job.format != hwr.VisualizeFormatPDF {
+		// a PDF is written over the pages of the document when requested
+		job.zip = nil
+	}
+	job.updated = time.Now()
+	slog.InfoContext(job.ctx, "Job finished", "status", job.status)
+}
+
+// Cancel stops a job, aborting the pages being recognized.
+func (job *Job) Cancel() {
+	job.mu.Lock()
+	if !job.finished() {
+		job.status = jobCanceled
+		job.updated = time.Now()
+	}
+	job.mu.Unlock()
+	job.cancel()
+}
+
+// failure describes why a job failed, job.mu must be held.
+func (job *Job) failure() (int, apiError) {
+	if job.kind == jobConvert {
+		return noResultError("No pages converted", codeConversionFailed, len(job.errors))
+	}
+	return noResultError("No content found", codeRecognitionFailed, len(job.errors))
+}
+
+// finished reports whether the job reached a final state, job.mu must be held.
+func (job *Job) finished() bool {
+	return job.status == jobDone || job.status == jobFailed || job.status == jobCanceled
+}
+
+// statusJSON returns the job state and per page progress.
+func (job *Job) statusJSON() map[string]interface{} {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	counts := map[string]int{
+		pagePending: 0,
+		pageRunning: 0,
+		pageDone:    0,
+		pageEmpty:   0,
+		pageFailed:  0,
+	}
+	pages := make(map[int]string, len(job.pages))
+	for p, state := range job.pages {
+		counts[state]++
+		pages[p] = state
+	}
+	errors := make(map[int]apiError, len(job.errors))
+	for p, err := range job.errors {
+		errors[p] = err
+	}
+
+	status := map[string]interface{}{
+		"id":       job.id,
+		"type":     job.kind,
+		"status":   job.status,
+		"filename": job.filename,
+		"progress": map[string]int{
+			"total":     len(job.pages),
+			"completed": counts[pageDone] + counts[pageEmpty] + counts[pageFailed],
+			"failed":    counts[pageFailed],
+		},
+		"page_status": pages,
+		"errors":      errors,
+		"created":     job.created.Format(time.RFC3339),
+		"updated":     job.updated.Format(time.RFC3339),
+	}
+	if job.callbackURL != "" {
+		status["callback"] = map[string]interface{}{
+			"url":        job.callbackURL,
+			"deliveries": append([]webhookDelivery{}, job.deliveries...),
+		}
+	}
+	return status
+}
+
+// requestJob returns the job of the request path, if it belongs to the client.
+func (s *Server) requestJob(r *http.Request) (*Job, bool) {
+	job, ok := s.jobs.Get(r.PathValue("id"))
+	if !ok || job.owner != s.requestClient(r) {
+		return nil, false
+	}
+	return job, true
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *Server) handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	req, reqErr := s.readHWRRequest(w, r)
+	if reqErr != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+
+	start, end := pageRange(req.zip, req.cfg.Page)
+	if !s.chargeRequest(w, r, pageCost(req.cfg, start, end)) {
+		return
+	}
+	writeJobAccepted(w, s.jobs.Submit(r.Context(), jobHWR, req, pageList(start, end)))
+}
+
+// writeJobAccepted answers a request that started a job.
+func writeJobAccepted(w http.ResponseWriter, job *Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+job.id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.statusJSON())
+}
+
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.requestJob(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeJobNotFound, "Job not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.statusJSON())
+}
+
+func (s *Server) handleJobResult(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.requestJob(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeJobNotFound, "Job not found")
+		return
+	}
+
+	// the result is rendered and written without holding the job, the
+	// fields of a finished job don't change
+	job.mu.Lock()
+	status, kind := job.status, job.kind
+	filename, zip, images, format, background := job.filename, job.zip, job.images, job.format, job.background
+	var failureStatus int
+	var failure apiError
+	var result []byte
+	switch {
+	case status == jobFailed:
+		failureStatus, failure = job.failure()
+	case status == jobDone && kind != jobConvert:
+		// same shape as the /api/hwr response
+		result, _ = json.Marshal(map[string]interface{}{
+			"filename": job.filename,
+			"pages":    job.docPages,
+			"text":     job.result,
+			"langs":    job.langs,
+			"errors":   job.errors,
+		})
+	}
+	job.mu.Unlock()
+
+	switch status {
+	case jobDone:
+	case jobFailed:
+		writeError(w, failureStatus, failure.Code, failure.Error)
+		return
+	default:
+		writeError(w, http.StatusConflict, codeJobNotFinished, fmt.Sprintf("Job is %s", status))
+		return
+	}
+
+	if kind == jobConvert {
+		// same as the /api/convert response
+		writeConvertResult(r.Context(), w, filename, zip, images, format, background)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(result, '\n'))
+}
+
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.requestJob(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeJobNotFound, "Job not found")
+		return
+	}
+
+	job.Cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.statusJSON())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/ddvk/rmapi-hwr/hwr/logging"
+)
+
+// validRequestID accepts the X-Request-ID of a client or proxy.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// setupLogging configures the logs from LOG_LEVEL and LOG_FORMAT.
+func setupLogging() {
+	level := slog.LevelInfo
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		var err error
+		level, err = logging.ParseLevel(value)
+		if err != nil {
+			log.Fatalf("Invalid LOG_LEVEL: %v", err)
+		}
+	}
+	if err := logging.Setup(os.Stderr, level, os.Getenv("LOG_FORMAT")); err != nil {
+		log.Fatalf("Invalid LOG_FORMAT: %v", err)
+	}
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush keeps streamed responses working.
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logRequests tags every request with an ID, the X-Request-ID sent by the
+// client or a new one, echoed in the response and carried by the logs of the
+// request and its jobs. Each request is logged once it is answered.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = logging.NewID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := logging.With(r.Context(), "request_id", id)
+
+		started := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		switch {
+		case r.URL.Path == "/health" || r.URL.Path == "/metrics":
+			level = slog.LevelDebug
+		case sw.status >= 500:
+			level = slog.LevelError
+		}
+		slog.Log(ctx, level, "Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"duration", time.Since(started),
+			"remote", r.RemoteAddr)
+	})
+}
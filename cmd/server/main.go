@@ -3,14 +3,18 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image/png"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,11 +24,16 @@ import (
 	"github.com/ddvk/rmapi-hwr/hwr/models"
 	"github.com/juruen/rmapi/archive"
 	"github.com/juruen/rmapi/encoding/rm"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
-	defaultPort = "8082"
-	maxFileSize = 100 * 1024 * 1024 // 100MB
+	defaultPort               = "8082"
+	maxFormMemory             = 32 * 1024 * 1024 // Form data kept in memory, the rest goes to temp files
+	maxFormOverhead           = 10 * 1024 * 1024 // Form fields and files besides the document
+	defaultConcurrency        = 8                // Pages recognized at once by the server
+	defaultRequestConcurrency = 3                // Pages recognized at once by a request
 )
 
 type Server struct {
@@ -32,6 +41,15 @@ type Server struct {
 	outputDir      string
 	applicationKey string
 	hmacKey        string
+	profile        *models.Configuration
+	jobs           *JobQueue
+	webhookSecret  string
+	webhookHosts   map[string]bool // WEBHOOK_ALLOWED_HOSTS, any public host if empty
+	webhookClient  *http.Client
+	auth           *Auth
+	pageSem        *semaphore.Weighted // Pages recognized at once by the server
+	requestLimit   int                 // Pages recognized at once by a request
+	limits         hwr.Limits          // Documents accepted by the server
 }
 
 func NewServer() *Server {
@@ -48,295 +66,608 @@ func NewServer() *Server {
 	applicationKey := os.Getenv("RMAPI_HWR_APPLICATIONKEY")
 	hmacKey := os.Getenv("RMAPI_HWR_HMAC")
 
-	return &Server{
+	var profile *models.Configuration
+	if profileName := os.Getenv("HWR_PROFILE"); profileName != "" {
+		var err error
+		profile, err = hwr.LoadProfile(profileName)
+		if err != nil {
+			log.Fatalf("Can't load HWR_PROFILE: %v", err)
+		}
+		slog.Info("Using recognition profile", "profile", profileName)
+	}
+
+	auth, err := LoadAuth(os.Getenv("API_KEYS_FILE"))
+	if err != nil {
+		log.Fatalf("Can't load API_KEYS_FILE: %v", err)
+	}
+	if !auth.Enabled() {
+		slog.Warn("API_KEYS_FILE not set, the API is open to anyone reaching the port")
+	}
+
+	workers := envInt("HWR_WORKERS", defaultJobWorkers)
+	concurrency := envInt("HWR_CONCURRENCY", defaultConcurrency)
+	requestLimit := envInt("HWR_REQUEST_CONCURRENCY", defaultRequestConcurrency)
+
+	limits := hwr.DefaultLimits()
+	limits.MaxUploadSize = int64(envInt("MAX_UPLOAD_MB", int(limits.MaxUploadSize>>20))) << 20
+	limits.MaxUncompressed = int64(envInt("MAX_UNCOMPRESSED_MB", int(limits.MaxUncompressed>>20))) << 20
+	limits.MaxEntries = envInt("MAX_ZIP_ENTRIES", limits.MaxEntries)
+	limits.MaxCompression = float64(envInt("MAX_COMPRESSION_RATIO", int(limits.MaxCompression)))
+	limits.MaxPages = envInt("MAX_PAGES", limits.MaxPages)
+	limits.MaxPointsPerPage = envInt("MAX_POINTS_PER_PAGE", limits.MaxPointsPerPage)
+
+	webhookHosts := parseWebhookHosts(os.Getenv("WEBHOOK_ALLOWED_HOSTS"))
+	server := &Server{
 		port:           port,
 		outputDir:      outputDir,
 		applicationKey: applicationKey,
 		hmacKey:        hmacKey,
+		profile:        profile,
+		webhookSecret:  os.Getenv("WEBHOOK_SECRET"),
+		webhookHosts:   webhookHosts,
+		webhookClient:  newWebhookClient(webhookHosts),
+		auth:           auth,
+		pageSem:        semaphore.NewWeighted(int64(concurrency)),
+		requestLimit:   requestLimit,
+		limits:         limits,
 	}
+	server.jobs = NewJobQueue(server, workers)
+	return server
 }
 
-func (s *Server) loadRmZip(file io.ReaderAt, size int64) (*archive.Zip, error) {
-	zipArchive := archive.NewZip()
-	err := zipArchive.Read(file, size)
-	if err == nil {
-		numPages := len(zipArchive.Pages)
-		log.Printf("Standard rmapi Read() succeeded: found %d pages", numPages)
-		if numPages > 0 {
-			// Check if pages have data
-			pagesWithData := 0
-			for i, page := range zipArchive.Pages {
-				if page.Data != nil {
-					layers := len(page.Data.Layers)
-					totalLines := 0
-					for _, layer := range page.Data.Layers {
-						totalLines += len(layer.Lines)
-					}
-					log.Printf("Page %d: %d layers, %d lines", i, layers, totalLines)
-					if layers > 0 && totalLines > 0 {
-						pagesWithData++
-					}
-				}
-			}
-			log.Printf("Pages with data: %d/%d", pagesWithData, numPages)
-			if pagesWithData > 0 {
-				return zipArchive, nil
-			} else {
-				log.Printf("Standard parser found pages but no data, trying new format parser")
-			}
-		} else {
-			log.Printf("Standard parser found 0 pages, trying new format parser")
-		}
-	} else {
-		log.Printf("Standard rmapi Read() failed: %v, trying new format parser", err)
+// envInt returns the positive integer of an environment variable, or def if it is not set.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Fatalf("Invalid %s: %s", name, value)
 	}
+	return n
+}
 
-	// Try new format parser
-	reader, err := zip.NewReader(file, size)
+func (s *Server) handleHWR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	req, reqErr := s.readHWRRequest(w, r)
+	if reqErr != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+	stream, err := streamFormat(r)
 	if err != nil {
-		return nil, fmt.Errorf("can't open as zip: %w", err)
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if stream != "" && req.callbackURL != "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "stream and callback_url can't be combined")
+		return
+	}
+	start, end := pageRange(req.zip, req.cfg.Page)
+	if !s.chargeRequest(w, r, pageCost(req.cfg, start, end)) {
+		return
+	}
+	if req.callbackURL != "" {
+		writeJobAccepted(w, s.jobs.Submit(r.Context(), jobHWR, req, pageList(start, end)))
+		return
+	}
+
+	// Set environment variables for HWR
+	os.Setenv("RMAPI_HWR_APPLICATIONKEY", s.applicationKey)
+	os.Setenv("RMAPI_HWR_HMAC", s.hmacKey)
+
+	if stream != "" {
+		s.streamHWR(w, r, req, stream)
+		return
 	}
 
-	return s.loadRmZipNewFormat(reader)
+	// Process HWR
+	result, langs, pageErrors := s.processHWR(r.Context(), req.zip, req.cfg)
+	if len(result) == 0 {
+		status, failure := noResultError("No content found", codeRecognitionFailed, len(pageErrors))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  failure.Error,
+			"code":   failure.Code,
+			"errors": pageErrors,
+		})
+		return
+	}
+
+	// Return result as JSON
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"filename": req.filename,
+		"pages":    len(req.zip.Pages),
+		"text":     result,
+		"langs":    langs,
+		"errors":   pageErrors,
+	})
 }
 
-func (s *Server) loadRmZipNewFormat(reader *zip.Reader) (*archive.Zip, error) {
-	zipArchive := archive.NewZip()
+// hwrRequest is a parsed recognition request.
+type hwrRequest struct {
+	filename    string
+	zip         *archive.Zip
+	cfg         hwr.Config
+	callbackURL string     // Webhook notified when the job finishes, empty for none
+	client      *apiClient // Client that sent the request
+	format      string     // Image format of a conversion
+	background  bool       // Draw a conversion over the pages of the document
+}
 
-	// Find the .content file to get page list
-	var contentFile *zip.File
-	var docUUID string
-	for _, f := range reader.File {
-		if strings.HasSuffix(f.Name, ".content") {
-			contentFile = f
-			baseName := filepath.Base(f.Name)
-			docUUID = strings.TrimSuffix(baseName, ".content")
-			break
+// requestError is a request failure with its HTTP status and error code.
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+// readUpload parses the multipart form of a request and returns the name and
+// content of its file field, refusing uploads larger than the limit.
+func (s *Server) readUpload(w http.ResponseWriter, r *http.Request) (string, []byte, *requestError) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.limits.MaxUploadSize+maxFormOverhead)
+	err := r.ParseMultipartForm(maxFormMemory)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return "", nil, s.uploadTooLarge()
 		}
+		return "", nil, &requestError{http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Error parsing form: %v", err)}
 	}
 
-	if contentFile == nil {
-		return nil, fmt.Errorf("no .content file found in archive")
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return "", nil, &requestError{http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Error getting file: %v", err)}
+	}
+	defer file.Close()
+	if header.Size > s.limits.MaxUploadSize {
+		return "", nil, s.uploadTooLarge()
 	}
 
-	// Read and parse content file
-	contentReader, err := contentFile.Open()
+	// Read file into memory
+	fileData, err := io.ReadAll(file)
 	if err != nil {
-		return nil, fmt.Errorf("can't open content file: %w", err)
+		return "", nil, &requestError{http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error reading file: %v", err)}
+	}
+	uploadBytes.WithLabelValues(r.URL.Path).Observe(float64(len(fileData)))
+	return header.Filename, fileData, nil
+}
+
+func (s *Server) uploadTooLarge() *requestError {
+	return &requestError{http.StatusRequestEntityTooLarge, codeDocumentTooLarge,
+		fmt.Sprintf("File larger than %d MB", s.limits.MaxUploadSize>>20)}
+}
+
+// loadDocument loads an uploaded .rmdoc or .zip within the server limits.
+func (s *Server) loadDocument(ctx context.Context, data []byte) (*archive.Zip, *requestError) {
+	zipArchive, err := hwr.LoadZip(ctx, bytes.NewReader(data), int64(len(data)), s.limits)
+	switch {
+	case errors.Is(err, hwr.ErrTooLarge):
+		return nil, &requestError{http.StatusRequestEntityTooLarge, codeDocumentTooLarge, err.Error()}
+	case errors.Is(err, hwr.ErrUnsafeArchive):
+		slog.WarnContext(ctx, "Rejected archive", "err", err)
+		return nil, &requestError{http.StatusBadRequest, codeUnsafeArchive, err.Error()}
+	case err != nil:
+		return nil, &requestError{http.StatusBadRequest, codeInvalidArchive, fmt.Sprintf("Error loading rmdoc: %v", err)}
+	}
+	return zipArchive, nil
+}
+
+// readHWRRequest parses the form of a recognition request, shared by
+// /api/hwr and /api/jobs, and loads the uploaded document.
+func (s *Server) readHWRRequest(w http.ResponseWriter, r *http.Request) (*hwrRequest, *requestError) {
+	filename, fileData, reqErr := s.readUpload(w, r)
+	if reqErr != nil {
+		return nil, reqErr
 	}
-	defer contentReader.Close()
 
-	contentData, err := io.ReadAll(contentReader)
+	// Get optional parameters
+	inputType := r.FormValue("type")
+	if inputType == "" {
+		inputType = "Text"
+	}
+	profile, err := s.readProfile(r)
 	if err != nil {
-		return nil, fmt.Errorf("can't read content file: %w", err)
+		return nil, &requestError{http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Error reading profile: %v", err)}
+	}
+	lang := r.FormValue("lang")
+	if lang == "" && profile != nil {
+		lang = profile.Lang
+	}
+	if lang == "" {
+		lang = "en_US"
+	}
+	page, reqErr := readPage(r)
+	if reqErr != nil {
+		return nil, reqErr
 	}
 
-	var content struct {
-		CPages struct {
-			Pages []struct {
-				ID string `json:"id"`
-			} `json:"pages"`
-			LastOpened struct {
-				Value string `json:"value"`
-			} `json:"lastOpened"`
-		} `json:"cPages"`
+	pageLangs, err := hwr.ParsePageLangs(r.FormValue("page_lang"))
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Error parsing page_lang: %v", err)}
+	}
+	detectLangs := hwr.ParseLangList(r.FormValue("detect_lang"))
+	concurrency := s.requestLimit
+	if value := r.FormValue("concurrency"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, &requestError{http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid concurrency %q", value)}
+		}
+		// requests can only lower the server limit
+		concurrency = min(n, s.requestLimit)
+	}
+	diagramFormat := r.FormValue("diagram_format")
+	if diagramFormat == "" {
+		diagramFormat = hwr.DiagramFormatSVG
+	}
+	if !hwr.IsDiagramFormat(diagramFormat) {
+		return nil, &requestError{http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Unsupported diagram_format %q, expected one of %v", diagramFormat, hwr.DiagramFormats())}
 	}
 
-	err = json.Unmarshal(contentData, &content)
+	resources, err := s.readResources(r)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Error reading resources: %v", err)}
+	}
+	callbackURL, err := s.readCallbackURL(r)
 	if err != nil {
-		return nil, fmt.Errorf("can't parse content file: %w", err)
+		return nil, &requestError{http.StatusBadRequest, codeInvalidRequest, err.Error()}
 	}
 
-	// Set UUID
-	zipArchive.UUID = docUUID
+	zipArchive, reqErr := s.loadDocument(r.Context(), fileData)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	if reqErr := checkPage(zipArchive, page); reqErr != nil {
+		return nil, reqErr
+	}
 
-	// Set Content metadata if available
-	if len(content.CPages.Pages) > 0 {
-		// Find last opened page index
-		lastOpenedID := content.CPages.LastOpened.Value
-		for i, page := range content.CPages.Pages {
-			if page.ID == lastOpenedID {
-				zipArchive.Content.LastOpenedPage = i
-				break
-			}
-		}
+	// Check if HWR credentials are available
+	if s.applicationKey == "" || s.hmacKey == "" {
+		return nil, &requestError{http.StatusInternalServerError, codeCredentialsMissing, "HWR credentials not configured"}
 	}
 
-	// Read each page .rm file
-	for _, pageInfo := range content.CPages.Pages {
-		pageID := pageInfo.ID
-		pagePath := fmt.Sprintf("%s/%s.rm", docUUID, pageID)
+	// Configure HWR
+	cfg := hwr.Config{
+		Page:          page,
+		Lang:          lang,
+		InputType:     inputType,
+		AddPages:      true,
+		BatchSize:     int64(concurrency),
+		Resources:     resources,
+		Profile:       profile,
+		PageLangs:     pageLangs,
+		DetectLangs:   detectLangs,
+		DiagramFormat: diagramFormat,
+	}
 
-		var pageFile *zip.File
-		for _, f := range reader.File {
-			if f.Name == pagePath {
-				pageFile = f
-				break
-			}
-		}
+	return &hwrRequest{
+		filename:    filename,
+		zip:         zipArchive,
+		cfg:         cfg,
+		callbackURL: callbackURL,
+		client:      s.requestClient(r),
+	}, nil
+}
 
-		if pageFile == nil {
-			log.Printf("Warning: page file not found: %s", pagePath)
-			continue
-		}
+// readProfile returns the recognition profile of a request: an uploaded
+// profile_file, a built-in profile named by profile, or the server default.
+func (s *Server) readProfile(r *http.Request) (*models.Configuration, error) {
+	data, err := readOptionalFormFile(r, "profile_file")
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		return hwr.ParseProfile(data)
+	}
 
-		pageReader, err := pageFile.Open()
-		if err != nil {
-			log.Printf("Warning: can't open page file %s: %v", pagePath, err)
-			continue
+	if name := r.FormValue("profile"); name != "" {
+		profile, ok := hwr.BuiltinProfile(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q, available: %v", name, hwr.ProfileNames())
 		}
+		return profile, nil
+	}
+
+	return s.profile, nil
+}
 
-		pageData, err := io.ReadAll(pageReader)
-		pageReader.Close()
+// readResources reads the optional lexicon and grammar files of a request.
+// As with the -lexicon and -grammar flags of rmhwr, a file named lang=name
+// only applies to lang, any other file to all languages.
+func (s *Server) readResources(r *http.Request) (hwr.ResourceSet, error) {
+	resources := make(hwr.ResourceSet)
+
+	lexicons, err := readResourceFiles(r, "lexicon")
+	if err != nil {
+		return nil, err
+	}
+	for _, lexicon := range lexicons {
+		words, err := hwr.ParseLexicon(lexicon.data)
 		if err != nil {
-			log.Printf("Warning: can't read page file %s: %v", pagePath, err)
-			continue
+			return nil, fmt.Errorf("lexicon %s: %w", lexicon.name, err)
 		}
+		resources.AddLexicon(lexicon.lang, words)
+	}
 
-		page := archive.Page{}
-		page.Data = rm.New()
-		err = page.Data.UnmarshalBinary(pageData)
+	grammars, err := readResourceFiles(r, "grammar")
+	if err != nil {
+		return nil, err
+	}
+	for _, grammar := range grammars {
+		content, err := hwr.ParseMathGrammar(grammar.data)
 		if err != nil {
-			log.Printf("Warning: can't parse page file %s: %v", pagePath, err)
-			continue
+			return nil, fmt.Errorf("grammar %s: %w", grammar.name, err)
 		}
-
-		zipArchive.Pages = append(zipArchive.Pages, page)
+		resources.SetMathGrammar(grammar.lang, content)
 	}
 
-	if len(zipArchive.Pages) == 0 {
-		return nil, fmt.Errorf("no pages found in archive")
-	}
+	return resources, nil
+}
 
-	return zipArchive, nil
+// resourceFile is a lexicon or grammar file of a request.
+type resourceFile struct {
+	lang string
+	name string
+	data []byte
 }
 
-func (s *Server) handleHWR(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// readResourceFiles returns the files of a repeatable form field, with the
+// language of their [lang=]name file name.
+func readResourceFiles(r *http.Request, field string) ([]resourceFile, error) {
+	if r.MultipartForm == nil {
+		return nil, nil
 	}
-
-	// Parse multipart form
-	err := r.ParseMultipartForm(maxFileSize)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error parsing form: %v", err), http.StatusBadRequest)
-		return
+	var files []resourceFile
+	for _, header := range r.MultipartForm.File[field] {
+		lang, name, found := strings.Cut(header.Filename, "=")
+		if !found {
+			lang, name = hwr.AllLanguages, header.Filename
+		}
+		file, err := header.Open()
+		if err != nil {
+			return nil, fmt.Errorf("can't get %s: %w", field, err)
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", field, err)
+		}
+		files = append(files, resourceFile{lang, name, data})
 	}
+	return files, nil
+}
 
-	file, header, err := r.FormFile("file")
+// readOptionalFormFile returns the content of a form file, or nil if it was not sent.
+func readOptionalFormFile(r *http.Request, field string) ([]byte, error) {
+	file, _, err := r.FormFile(field)
+	if err == http.ErrMissingFile {
+		return nil, nil
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting file: %v", err), http.StatusBadRequest)
-		return
+		return nil, fmt.Errorf("can't get %s: %w", field, err)
 	}
 	defer file.Close()
+	return io.ReadAll(file)
+}
 
-	// Read file into memory
-	fileData, err := io.ReadAll(file)
+// readPage returns the page option of a request: 1-indexed, 0 for the last
+// opened page, negative (the default) for all pages.
+func readPage(r *http.Request) (int, *requestError) {
+	pageStr := r.FormValue("page")
+	if pageStr == "" {
+		return -1, nil
+	}
+	page, err := strconv.Atoi(pageStr)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusInternalServerError)
-		return
+		return 0, &requestError{http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid page %q", pageStr)}
 	}
+	return page, nil
+}
 
-	// Get optional parameters
-	inputType := r.FormValue("type")
-	if inputType == "" {
-		inputType = "Text"
+// checkPage rejects a page option beyond the last page of the document.
+func checkPage(zipArchive *archive.Zip, page int) *requestError {
+	if page > len(zipArchive.Pages) {
+		return &requestError{http.StatusBadRequest, codePageOutOfRange, fmt.Sprintf("Page %d out of range, the document has %d pages", page, len(zipArchive.Pages))}
 	}
-	lang := r.FormValue("lang")
-	if lang == "" {
-		lang = "en_US"
+	return nil
+}
+
+// pageRange returns the first and last page (0-indexed) selected by a
+// page option: 0 for the last opened page, negative for all pages.
+func pageRange(zipArchive *archive.Zip, page int) (int, int) {
+	if page == 0 {
+		start := zipArchive.Content.LastOpenedPage
+		return start, start
 	}
-	pageStr := r.FormValue("page")
-	page := -1
-	if pageStr != "" {
-		if p, err := strconv.Atoi(pageStr); err == nil {
-			page = p
-		}
+	if page < 0 {
+		return 0, len(zipArchive.Pages) - 1
 	}
+	return page - 1, page - 1
+}
 
-	// Load the zip archive
-	reader := bytes.NewReader(fileData)
-	zipArchive, err := s.loadRmZip(reader, int64(len(fileData)))
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error loading rmdoc: %v", err), http.StatusBadRequest)
-		return
+// pageList returns the pages from start to end.
+func pageList(start, end int) []int {
+	pages := make([]int, 0, end-start+1)
+	for p := start; p <= end; p++ {
+		pages = append(pages, p)
 	}
+	return pages
+}
 
-	// Check if HWR credentials are available
-	if s.applicationKey == "" || s.hmacKey == "" {
-		http.Error(w, "HWR credentials not configured", http.StatusInternalServerError)
-		return
+// pageCost returns the pages charged for recognizing the pages from start to
+// end. A Text page with detect_lang and no page_lang entry costs one page per
+// candidate language, as it is recognized once per candidate.
+func pageCost(cfg hwr.Config, start, end int) int {
+	if len(cfg.DetectLangs) == 0 || !strings.EqualFold(cfg.InputType, "Text") {
+		return end - start + 1
+	}
+	cost := 0
+	for p := start; p <= end; p++ {
+		if _, explicit := cfg.PageLangs[p]; explicit {
+			cost++
+		} else {
+			cost += len(cfg.DetectLangs)
+		}
 	}
+	return cost
+}
 
-	// Set environment variables for HWR
-	os.Setenv("RMAPI_HWR_APPLICATIONKEY", s.applicationKey)
-	os.Setenv("RMAPI_HWR_HMAC", s.hmacKey)
+// processHWR recognizes the requested pages and returns the text and the
+// language used for each page, and the error of each failed page.
+func (s *Server) processHWR(ctx context.Context, zipArchive *archive.Zip, cfg hwr.Config) (map[int]string, map[int]string, map[int]apiError) {
+	start, end := pageRange(zipArchive, cfg.Page)
 
-	// Configure HWR
-	cfg := hwr.Config{
-		Page:      page,
-		Lang:      lang,
-		InputType: inputType,
-		AddPages:  true,
-		BatchSize: 3,
-	}
+	result := make(map[int]string)
+	langs := make(map[int]string)
+	pageErrors := make(map[int]apiError)
+	s.recognizePages(ctx, zipArchive, cfg, pageList(start, end), func(r pageResult) {
+		if r.err != nil {
+			slog.ErrorContext(ctx, "Error processing page", "page", r.page, "err", r.err)
+			pageErrors[r.page] = newPageError(r.err)
+			return
+		}
+		if r.text != "" {
+			result[r.page] = r.text
+			langs[r.page] = r.lang
+		}
+	})
 
-	// Process HWR
-	result := s.processHWR(zipArchive, cfg)
-	if len(result) == 0 {
-		http.Error(w, "No content found", http.StatusNotFound)
-		return
+	return result, langs, pageErrors
+}
+
+// pageResult is the recognition of one page.
+type pageResult struct {
+	page     int
+	text     string
+	lang     string
+	err      error
+	duration time.Duration
+}
+
+// recognizePages recognizes pages concurrently, at most cfg.BatchSize at a
+// time for the request and s.concurrency across the server, and calls emit
+// with each result as soon as its page is done, so the results arrive in
+// completion order. Pages not started when ctx is done fail with its error.
+func (s *Server) recognizePages(ctx context.Context, zipArchive *archive.Zip, cfg hwr.Config, pages []int, emit func(pageResult)) {
+	results := make(chan pageResult, len(pages))
+
+	limit := cfg.BatchSize
+	if limit < 1 {
+		limit = 1
 	}
+	requestSem := semaphore.NewWeighted(limit)
+	go func() {
+		for i, p := range pages {
+			if err := requestSem.Acquire(ctx, 1); err != nil {
+				for _, q := range pages[i:] {
+					results <- pageResult{page: q, err: err}
+				}
+				return
+			}
+			go func(p int) {
+				defer requestSem.Release(1)
+				results <- s.recognizePageLimited(ctx, zipArchive, cfg, p)
+			}(p)
+		}
+	}()
 
-	// Return result as JSON
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"filename": header.Filename,
-		"pages":    len(zipArchive.Pages),
-		"text":     result,
-	})
+	for range pages {
+		emit(<-results)
+	}
 }
 
-func (s *Server) processHWR(zipArchive *archive.Zip, cfg hwr.Config) map[int]string {
-	start := 0
-	var end int
+// recognizePageLimited recognizes a page within the server wide concurrency limit.
+func (s *Server) recognizePageLimited(ctx context.Context, zipArchive *archive.Zip, cfg hwr.Config, p int) pageResult {
+	result := pageResult{page: p}
+	if err := s.pageSem.Acquire(ctx, 1); err != nil {
+		result.err = err
+		return result
+	}
+	defer s.pageSem.Release(1)
 
-	if cfg.Page == 0 {
-		start = zipArchive.Content.LastOpenedPage
-		end = start
-	} else if cfg.Page < 0 {
-		end = len(zipArchive.Pages) - 1
-	} else {
-		start = cfg.Page - 1
-		end = start
+	started := time.Now()
+	result.text, result.lang, result.err = s.recognizePage(ctx, zipArchive, cfg, p)
+	result.duration = time.Since(started)
+	observePage(cfg.InputType, result)
+	return result
+}
+
+// recognizePage recognizes one page (0-indexed) and returns its text and the
+// language used. The text is empty if the page has no recognized content.
+func (s *Server) recognizePage(ctx context.Context, zipArchive *archive.Zip, cfg hwr.Config, p int) (string, string, error) {
+	isText := strings.EqualFold(cfg.InputType, "Text")
+	isRaw := hwr.IsRawContent(cfg.InputType)
+	diagramGraph := strings.EqualFold(cfg.InputType, "Diagram") && hwr.IsDiagramGraphFormat(cfg.DiagramFormat)
+	contentType := cfg.InputType
+	accept := "text/plain"
+	if isRaw {
+		contentType = hwr.RawContentType
+	}
+	if diagramGraph || isRaw {
+		accept = "application/vnd.myscript.jiix"
 	}
 
-	result := make(map[int]string)
+	lang := cfg.LangForPage(p)
+	var body []byte
+	if _, explicit := cfg.PageLangs[p]; !explicit && len(cfg.DetectLangs) > 0 && isText {
+		detected, probe, err := hwr.DetectLanguageContext(ctx, zipArchive, p, cfg.DetectLangs, cfg.Profile, cfg.Resources, s.applicationKey, s.hmacKey)
+		switch {
+		case errors.Is(err, hwr.ErrLanguageUndetected):
+			slog.InfoContext(ctx, "Using the page language", "page", p, "lang", lang)
+		case err != nil:
+			return "", "", &pageError{codeRecognitionFailed, fmt.Errorf("detecting language: %w", err)}
+		default:
+			slog.InfoContext(ctx, "Detected language", "page", p, "lang", detected)
+			lang = detected
+			body = probe
+		}
+	}
 
-	for p := start; p <= end; p++ {
-		js, err := s.buildBatchInput(zipArchive, cfg.InputType, cfg.Lang, p)
+	if body == nil {
+		conf := hwr.NewConfiguration(cfg.Profile, contentType, lang, cfg.Resources.For(lang))
+		if diagramGraph {
+			hwr.EnableDiagramConvert(conf)
+		}
+		js, err := s.buildBatchInput(zipArchive, contentType, conf, p)
 		if err != nil {
-			log.Printf("Error building batch input for page %d: %v", p, err)
-			continue
+			return "", "", &pageError{codeInvalidPage, fmt.Errorf("building batch input: %w", err)}
 		}
 
-		body, err := client.SendRequest(s.applicationKey, s.hmacKey, js, "text/plain")
+		body, err = client.SendRequestContext(ctx, s.applicationKey, s.hmacKey, js, accept)
 		if err != nil {
-			log.Printf("Error sending HWR request for page %d: %v", p, err)
-			continue
+			return "", "", &pageError{codeRecognitionFailed, fmt.Errorf("sending HWR request: %w", err)}
 		}
+	}
 
-		text := s.extractTextFromResponse(body)
-		if text != "" {
-			result[p] = text
+	if isRaw {
+		text, err := hwr.FormatRawContent(body)
+		if err != nil {
+			return "", "", &pageError{codeRecognitionFailed, fmt.Errorf("classifying raw content: %w", err)}
 		}
+		return text, lang, nil
 	}
-
-	return result
+	if diagramGraph {
+		graph, err := hwr.ParseDiagramJiix(body)
+		if err != nil {
+			return "", "", &pageError{codeRecognitionFailed, fmt.Errorf("converting diagram: %w", err)}
+		}
+		text, err := graph.Export(cfg.DiagramFormat)
+		if err != nil {
+			return "", "", &pageError{codeRecognitionFailed, fmt.Errorf("converting diagram: %w", err)}
+		}
+		return text, lang, nil
+	}
+	return s.extractTextFromResponse(body), lang, nil
 }
 
-func (s *Server) buildBatchInput(zipArchive *archive.Zip, contentType, lang string, pageNumber int) ([]byte, error) {
+func (s *Server) buildBatchInput(zipArchive *archive.Zip, contentType string, conf *models.Configuration, pageNumber int) ([]byte, error) {
 	if pageNumber < 0 || pageNumber >= len(zipArchive.Pages) {
 		return nil, fmt.Errorf("page %d outside range", pageNumber)
 	}
@@ -347,9 +678,7 @@ func (s *Server) buildBatchInput(zipArchive *archive.Zip, contentType, lang stri
 	}
 
 	batch := models.BatchInput{
-		Configuration: &models.Configuration{
-			Lang: lang,
-		},
+		Configuration: conf,
 		StrokeGroups: []*models.StrokeGroup{
 			{},
 		},
@@ -472,188 +801,247 @@ func (s *Server) extractTextFromJiix(jiix map[string]interface{}) string {
 
 func (s *Server) handleConvert(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	// Parse multipart form
-	err := r.ParseMultipartForm(maxFileSize)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error parsing form: %v", err), http.StatusBadRequest)
+	filename, fileData, reqErr := s.readUpload(w, r)
+	if reqErr != nil {
+		writeRequestError(w, reqErr)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting file: %v", err), http.StatusBadRequest)
+	// Get optional page parameter
+	page, reqErr := readPage(r)
+	if reqErr != nil {
+		writeRequestError(w, reqErr)
 		return
 	}
-	defer file.Close()
-
-	// Read file into memory
-	fileData, err := io.ReadAll(file)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusInternalServerError)
+	format := r.FormValue("format")
+	if format == "" {
+		format = hwr.VisualizeFormatPNG
+	}
+	if !hwr.IsVisualizeFormat(format) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Unsupported format %q, expected one of %v", format, hwr.VisualizeFormats()))
 		return
 	}
-
-	// Get optional page parameter
-	pageStr := r.FormValue("page")
-	page := -1
-	if pageStr != "" {
-		if p, err := strconv.Atoi(pageStr); err == nil {
-			page = p
+	background := false
+	if value := r.FormValue("background"); value != "" {
+		var err error
+		if background, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid background %q, expected true or false", value))
+			return
 		}
 	}
 
-	// Load the zip archive
-	reader := bytes.NewReader(fileData)
-	zipArchive, err := s.loadRmZip(reader, int64(len(fileData)))
+	zipArchive, reqErr := s.loadDocument(r.Context(), fileData)
+	if reqErr != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+	if reqErr := checkPage(zipArchive, page); reqErr != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+
+	callbackURL, err := s.readCallbackURL(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error loading rmdoc: %v", err), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if callbackURL != "" {
+		req := &hwrRequest{
+			filename:    filename,
+			zip:         zipArchive,
+			callbackURL: callbackURL,
+			client:      s.requestClient(r),
+			format:      format,
+			background:  background,
+		}
+		writeJobAccepted(w, s.jobs.Submit(r.Context(), jobConvert, req, convertPageList(zipArchive, page)))
 		return
 	}
 
-	// Create temporary directory for PNGs
+	// Create temporary directory for the images
 	tempDir, err := os.MkdirTemp(s.outputDir, "convert-*")
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error creating temp dir: %v", err), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error creating temp dir: %v", err))
 		return
 	}
 	defer os.RemoveAll(tempDir)
 
-	// Determine which pages to convert
-	pagesToConvert := []int{}
-	if page >= 0 {
-		pagesToConvert = []int{page - 1} // Convert to 0-based
-	} else {
-		for i := 0; i < len(zipArchive.Pages); i++ {
-			pagesToConvert = append(pagesToConvert, i)
-		}
-	}
-
-	// Convert pages to PNG
-	pngFiles := []string{}
-	for _, p := range pagesToConvert {
-		if p < 0 || p >= len(zipArchive.Pages) {
-			log.Printf("Skipping invalid page index %d (total pages: %d)", p, len(zipArchive.Pages))
+	// Convert pages to images
+	images := make(map[int][]byte)
+	failed := 0
+	for _, p := range convertPageList(zipArchive, page) {
+		data, err := s.convertPage(r.Context(), zipArchive, p, tempDir, format, background)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error visualizing page", "page", p, "err", err)
+			failed++
 			continue
 		}
-
-		// Check if page has data
-		page := zipArchive.Pages[p]
-		if page.Data == nil {
-			log.Printf("Page %d has no data, skipping", p)
-			continue
+		if data != nil {
+			images[p] = data
 		}
+	}
 
-		// Check if page has any strokes
-		hasStrokes := false
-		for _, layer := range page.Data.Layers {
-			if len(layer.Lines) > 0 {
-				hasStrokes = true
-				break
-			}
-		}
+	if len(images) == 0 {
+		status, failure := noResultError("No pages converted", codeConversionFailed, failed)
+		writeError(w, status, failure.Code, failure.Error)
+		return
+	}
 
-		if !hasStrokes {
-			log.Printf("Page %d has no strokes, skipping", p)
-			continue
-		}
+	writeConvertResult(r.Context(), w, filename, zipArchive, images, format, background)
+}
 
-		outputPNG := filepath.Join(tempDir, fmt.Sprintf("page_%d.png", p))
-		log.Printf("Converting page %d to PNG: %s", p, outputPNG)
-		err := hwr.VisualizePage(zipArchive, p, outputPNG)
-		if err != nil {
-			log.Printf("Error visualizing page %d: %v", p, err)
-			continue
-		}
+// convertPageList returns the pages (0-indexed) converted for a page option.
+func convertPageList(zipArchive *archive.Zip, page int) []int {
+	return pageList(pageRange(zipArchive, page))
+}
 
-		// Verify PNG was created and is not empty
-		// Add a small delay to ensure file is fully written
-		info, err := os.Stat(outputPNG)
-		if err != nil {
-			log.Printf("Warning: Cannot stat PNG file for page %d: %v", p, err)
-			continue
-		}
-		if info.Size() == 0 {
-			log.Printf("Warning: PNG file for page %d is empty", p)
-			continue
-		}
+// convertPage renders a page (0-indexed) to an image of the given format in
+// dir and returns the image, or its PDF content for format pdf. PNG images of
+// annotated PDFs and EPUBs are drawn over their document page with background.
+// Pages without strokes return nil.
+func (s *Server) convertPage(ctx context.Context, zipArchive *archive.Zip, p int, dir, format string, background bool) ([]byte, error) {
+	if p < 0 || p >= len(zipArchive.Pages) {
+		slog.WarnContext(ctx, "Skipping invalid page index", "page", p, "pages", len(zipArchive.Pages))
+		return nil, nil
+	}
 
-		// Verify it's a valid PNG by trying to decode it
-		pngFile, err := os.Open(outputPNG)
-		if err != nil {
-			log.Printf("Warning: Cannot open PNG file for page %d: %v", p, err)
-			continue
-		}
-		// Try to decode the PNG to verify it's valid
-		_, err = png.Decode(pngFile)
-		pngFile.Close()
-		if err != nil {
-			log.Printf("Warning: PNG file for page %d is not valid (decode error: %v)", p, err)
-			continue
+	// Check if page has data
+	page := zipArchive.Pages[p]
+	if page.Data == nil {
+		slog.DebugContext(ctx, "Page has no data, skipping", "page", p)
+		return nil, nil
+	}
+
+	// Check if page has any strokes
+	hasStrokes := false
+	for _, layer := range page.Data.Layers {
+		if len(layer.Lines) > 0 {
+			hasStrokes = true
+			break
 		}
+	}
 
-		pngFiles = append(pngFiles, outputPNG)
-		log.Printf("Successfully converted page %d: %d bytes (valid PNG)", p, info.Size())
+	if !hasStrokes {
+		slog.DebugContext(ctx, "Page has no strokes, skipping", "page", p)
+		return nil, nil
 	}
 
-	if len(pngFiles) == 0 {
-		http.Error(w, "No pages converted", http.StatusInternalServerError)
-		return
+	if format == hwr.VisualizeFormatPDF {
+		// the pages are written to a document once all are rendered
+		started := time.Now()
+		data := hwr.PDFContent(page.Data, hwr.DefaultVisualizationConfig())
+		renderDuration.WithLabelValues(format).Observe(time.Since(started).Seconds())
+		slog.InfoContext(ctx, "Converted page", "page", p, "bytes", len(data))
+		return data, nil
 	}
 
-	// Create a zip file with all PNGs
-	zipBuffer := new(bytes.Buffer)
-	zipWriter := zip.NewWriter(zipBuffer)
+	output := filepath.Join(dir, fmt.Sprintf("page_%d.%s", p, format))
+	slog.DebugContext(ctx, "Converting page", "page", p, "format", format, "file", output)
+	started := time.Now()
+	config := hwr.DefaultVisualizationConfig()
+	config.Background = background
+	err := hwr.VisualizePageFormat(ctx, zipArchive, p, output, format, config)
+	renderDuration.WithLabelValues(format).Observe(time.Since(started).Seconds())
+	if err != nil {
+		return nil, err
+	}
 
-	for _, pngFile := range pngFiles {
-		file, err := os.Open(pngFile)
-		if err != nil {
-			log.Printf("Error opening PNG file %s: %v", pngFile, err)
-			continue
-		}
+	// Verify the image was created and is not empty
+	data, err := os.ReadFile(output)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s file: %w", format, err)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%s file is empty", format)
+	}
 
-		// Get file info for logging
-		fileInfo, err := file.Stat()
-		if err != nil {
-			file.Close()
-			log.Printf("Error statting PNG file %s: %v", pngFile, err)
-			continue
+	// Try to decode the PNG to verify it's valid
+	if format == hwr.VisualizeFormatPNG {
+		if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("PNG file is not valid (decode error: %w)", err)
 		}
+	}
 
-		zipEntry, err := zipWriter.Create(filepath.Base(pngFile))
-		if err != nil {
-			file.Close()
-			log.Printf("Error creating zip entry for %s: %v", pngFile, err)
-			continue
-		}
+	slog.InfoContext(ctx, "Converted page", "page", p, "bytes", len(data))
+	return data, nil
+}
 
-		bytesWritten, err := io.Copy(zipEntry, file)
-		file.Close()
+// convertResult returns the result of a conversion and its content type: a
+// PDF document of the pages for format pdf, a zip of the page images
+// otherwise.
+func convertResult(ctx context.Context, zipArchive *archive.Zip, images map[int][]byte, format string, background bool) ([]byte, string, error) {
+	if format != hwr.VisualizeFormatPDF {
+		data, err := pageArchive(ctx, images, format)
 		if err != nil {
-			log.Printf("Error copying PNG file %s to zip: %v", pngFile, err)
-			continue
+			return nil, "", fmt.Errorf("can't create zip: %w", err)
 		}
+		return data, "application/zip", nil
+	}
 
-		if bytesWritten != fileInfo.Size() {
-			log.Printf("Warning: Size mismatch for %s: expected %d, wrote %d", pngFile, fileInfo.Size(), bytesWritten)
-		} else {
-			log.Printf("Added %s to zip: %d bytes", filepath.Base(pngFile), bytesWritten)
-		}
+	pages := make([]hwr.PDFPage, 0, len(images))
+	for p, content := range images {
+		pages = append(pages, hwr.PDFPage{Page: p, Content: content})
 	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Page < pages[j].Page })
+	config := hwr.DefaultVisualizationConfig()
+	config.Background = background
+	var buf bytes.Buffer
+	if err := hwr.WritePDF(ctx, &buf, zipArchive, pages, config); err != nil {
+		return nil, "", fmt.Errorf("can't create PDF: %w", err)
+	}
+	return buf.Bytes(), "application/pdf", nil
+}
 
-	err = zipWriter.Close()
+// writeConvertResult writes the result of a conversion as an attachment named
+// after the document.
+func writeConvertResult(ctx context.Context, w http.ResponseWriter, filename string, zipArchive *archive.Zip, images map[int][]byte, format string, background bool) {
+	data, contentType, err := convertResult(ctx, zipArchive, images, format, background)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error creating zip: %v", err), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
 		return
 	}
 
-	// Return zip file
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s_pages.zip", strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename))))
-	w.Write(zipBuffer.Bytes())
+	name := strings.TrimSuffix(filename, filepath.Ext(filename))
+	if format == hwr.VisualizeFormatPDF {
+		name += ".pdf"
+	} else {
+		name += "_pages.zip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", name))
+	w.Write(data)
+}
+
+// pageArchive zips the page images, named page_N.png or page_N.svg after format.
+func pageArchive(ctx context.Context, images map[int][]byte, format string) ([]byte, error) {
+	pages := make([]int, 0, len(images))
+	for p := range images {
+		pages = append(pages, p)
+	}
+	sort.Ints(pages)
+
+	zipBuffer := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(zipBuffer)
+	for _, p := range pages {
+		name := fmt.Sprintf("page_%d.%s", p, format)
+		zipEntry, err := zipWriter.Create(name)
+		if err != nil {
+			return nil, fmt.Errorf("can't create zip entry for %s: %w", name, err)
+		}
+		if _, err := zipEntry.Write(images[p]); err != nil {
+			return nil, fmt.Errorf("can't write %s to zip: %w", name, err)
+		}
+		slog.DebugContext(ctx, "Added page to zip", "file", name, "bytes", len(images[p]))
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return zipBuffer.Bytes(), nil
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -671,19 +1059,32 @@ func (s *Server) Start() error {
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
+	slog.Info("Server starting", "port", s.port)
+	return http.ListenAndServe("0.0.0.0:"+s.port, s.handler())
+}
+
+// handler returns the routes of the API, with request logging.
+func (s *Server) handler() http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/hwr", s.handleHWR)
-	mux.HandleFunc("/api/convert", s.handleConvert)
+	mux.HandleFunc("/api/hwr", instrument("/api/hwr", s.requireAPIKey(s.handleHWR)))
+	mux.HandleFunc("/api/convert", instrument("/api/convert", s.requireAPIKey(s.handleConvert)))
+	mux.HandleFunc("POST /api/thumbnails", instrument("/api/thumbnails", s.requireAPIKey(s.handleThumbnails)))
+	mux.HandleFunc("POST /api/jobs", instrument("/api/jobs", s.requireAPIKey(s.handleCreateJob)))
+	mux.HandleFunc("GET /api/jobs/{id}", instrument("/api/jobs/{id}", s.requireAPIKey(s.handleGetJob)))
+	mux.HandleFunc("GET /api/jobs/{id}/result", instrument("/api/jobs/{id}/result", s.requireAPIKey(s.handleJobResult)))
+	mux.HandleFunc("DELETE /api/jobs/{id}", instrument("/api/jobs/{id}", s.requireAPIKey(s.handleCancelJob)))
+	mux.HandleFunc("GET /api/usage", instrument("/api/usage", s.requireAPIKey(s.handleUsage)))
 	mux.HandleFunc("/health", s.handleHealth)
-
-	log.Printf("Server starting on port %s", s.port)
-	return http.ListenAndServe("0.0.0.0:"+s.port, mux)
+	mux.HandleFunc("GET /openapi.json", handleOpenAPI)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("/", handleNotFound)
+	return logRequests(mux)
 }
 
 func main() {
+	setupLogging()
 	server := NewServer()
 	if err := server.Start(); err != nil {
 		log.Fatal(err)
 	}
 }
-
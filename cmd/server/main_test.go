@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/ddvk/rmapi-hwr/hwr"
+)
+
+func TestPageCost(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  hwr.Config
+		want int
+	}{
+		{"one language", hwr.Config{InputType: "Text"}, 4},
+		{"detect_lang", hwr.Config{InputType: "Text", DetectLangs: []string{"en_US", "fr_FR", "de_DE"}}, 12},
+		{"page_lang", hwr.Config{InputType: "Text", DetectLangs: []string{"en_US", "fr_FR", "de_DE"}, PageLangs: map[int]string{1: "en_US"}}, 10},
+		{"not text", hwr.Config{InputType: "Math", DetectLangs: []string{"en_US", "fr_FR"}}, 4},
+	} {
+		if got := pageCost(tc.cfg, 0, 3); got != tc.want {
+			t.Errorf("%s: got %d pages, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestReadResourcesLanguages(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, f := range []struct{ field, name, content string }{
+		{"lexicon", "jargon.txt", "rmapi\n"},
+		{"lexicon", "fr_FR=jargon-fr.txt", "tablette\n"},
+		{"grammar", "fr_FR=fr.txt", "symbol = a\n"},
+	} {
+		part, _ := form.CreateFormFile(f.field, f.name)
+		part.Write([]byte(f.content))
+	}
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, "/api/hwr", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	resources, err := (&Server{}).readResources(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resources.For("en_US"); !slices.Equal(got.Lexicon, []string{"rmapi"}) || got.MathGrammar != "" {
+		t.Errorf("en_US resources are %+v", got)
+	}
+	if got := resources.For("fr_FR"); !slices.Equal(got.Lexicon, []string{"rmapi", "tablette"}) || got.MathGrammar != "symbol = a" {
+		t.Errorf("fr_FR resources are %+v", got)
+	}
+}
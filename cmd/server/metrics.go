@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddvk/rmapi-hwr/hwr"
+	"github.com/ddvk/rmapi-hwr/hwr/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, served on /metrics.
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hwr_http_requests_total",
+		Help: "HTTP requests by endpoint, method and status code.",
+	}, []string{"endpoint", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hwr_http_request_duration_seconds",
+		Help:    "Time to answer HTTP requests, by endpoint.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"endpoint"})
+
+	uploadBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hwr_upload_bytes",
+		Help:    "Size of the uploaded documents, by endpoint.",
+		Buckets: prometheus.ExponentialBuckets(16*1024, 4, 8), // 16KB to 256MB
+	}, []string{"endpoint"})
+
+	pagesRecognized = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hwr_pages_recognized_total",
+		Help: "Pages sent for recognition, by content type and result (recognized, empty or failed).",
+	}, []string{"type", "result"})
+
+	myscriptDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hwr_myscript_request_duration_seconds",
+		Help:    "Duration of MyScript requests, by HTTP status (error when no response was received).",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 16, 32},
+	}, []string{"status"})
+
+	renderDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hwr_render_duration_seconds",
+		Help:    "Time to render a page to an image, by format.",
+		Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	}, []string{"format"})
+)
+
+func init() {
+	client.Observe = observeMyScript
+}
+
+// observeMyScript records a request to MyScript.
+func observeMyScript(status int, duration time.Duration) {
+	label := "error"
+	if status != 0 {
+		label = strconv.Itoa(status)
+	}
+	myscriptDuration.WithLabelValues(label).Observe(duration.Seconds())
+}
+
+// observePage records the recognition of a page.
+func observePage(inputType string, r pageResult) {
+	result := "recognized"
+	switch {
+	case r.err != nil:
+		result = "failed"
+	case r.text == "":
+		result = "empty"
+	}
+	pagesRecognized.WithLabelValues(typeLabel(inputType), result).Inc()
+}
+
+// typeLabel returns the metric label of a content type, bounding the label
+// values to the supported types.
+func typeLabel(inputType string) string {
+	switch {
+	case hwr.IsRawContent(inputType):
+		return "raw"
+	case strings.EqualFold(inputType, "Text"), strings.EqualFold(inputType, "Math"), strings.EqualFold(inputType, "Diagram"):
+		return strings.ToLower(inputType)
+	}
+	return "other"
+}
+
+// instrument counts the requests of an endpoint and their duration.
+func instrument(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	labels := prometheus.Labels{"endpoint": endpoint}
+	handler := promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(httpDuration.MustCurryWith(labels), next))
+	return handler.ServeHTTP
+}
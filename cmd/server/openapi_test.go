@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openAPI checks requests and responses against the embedded spec. It knows
+// the subset of JSON schema the spec uses.
+type openAPI struct {
+	doc map[string]any
+}
+
+func loadOpenAPI(t *testing.T) *openAPI {
+	t.Helper()
+	var doc map[string]any
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	return &openAPI{doc: doc}
+}
+
+// operation returns the operation of a request, matching templated paths
+// such as /api/jobs/{id}.
+func (o *openAPI) operation(method, path string) (map[string]any, error) {
+	paths, _ := o.doc["paths"].(map[string]any)
+	for template, item := range paths {
+		if !matchPath(template, path) {
+			continue
+		}
+		if op, ok := item.(map[string]any)[strings.ToLower(method)].(map[string]any); ok {
+			return op, nil
+		}
+		return nil, fmt.Errorf("%s %s: method not in the spec", method, path)
+	}
+	return nil, fmt.Errorf("%s %s: path not in the spec", method, path)
+}
+
+func matchPath(template, path string) bool {
+	want, got := strings.Split(template, "/"), strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if want[i] != got[i] && !strings.HasPrefix(want[i], "{") {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve follows the $ref of an object of the spec.
+func (o *openAPI) resolve(v map[string]any) map[string]any {
+	for {
+		ref, ok := v["$ref"].(string)
+		if !ok {
+			return v
+		}
+		var node any = o.doc
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			node = node.(map[string]any)[part]
+		}
+		v = node.(map[string]any)
+	}
+}
+
+// checkRequest checks the form fields and files of a multipart request
+// against the request body of its operation.
+func (o *openAPI) checkRequest(op map[string]any, req *http.Request, body []byte) error {
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil
+	}
+	requestBody, ok := op["requestBody"].(map[string]any)
+	if !ok {
+		return fmt.Errorf("the spec has no request body")
+	}
+	content := o.resolve(requestBody)["content"].(map[string]any)
+	media, ok := content[mediaType].(map[string]any)
+	if !ok {
+		return fmt.Errorf("the spec has no %s request body", mediaType)
+	}
+	schema := o.resolve(media["schema"].(map[string]any))
+	properties := schema["properties"].(map[string]any)
+
+	sent := make(map[string]bool)
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := part.FormName()
+		sent[name] = true
+		property, ok := properties[name].(map[string]any)
+		if !ok {
+			return fmt.Errorf("form field %q is not in the spec", name)
+		}
+		property = o.resolve(property)
+		if property["type"] == "array" {
+			// a repeatable field, each part is an item
+			property = o.resolve(property["items"].(map[string]any))
+		}
+		if property["format"] == "binary" {
+			if part.FileName() == "" {
+				return fmt.Errorf("form field %q is a file in the spec", name)
+			}
+			continue
+		}
+		value, _ := io.ReadAll(part)
+		if err := o.checkFormValue(property, string(value)); err != nil {
+			return fmt.Errorf("form field %q: %w", name, err)
+		}
+	}
+	for _, name := range stringList(schema["required"]) {
+		if !sent[name] {
+			return fmt.Errorf("required form field %q is missing", name)
+		}
+	}
+	return nil
+}
+
+// checkFormValue checks a form value against the schema of its field.
+func (o *openAPI) checkFormValue(schema map[string]any, value string) error {
+	var v any = value
+	switch schema["type"] {
+	case "integer":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		if minimum, ok := schema["minimum"].(float64); ok && float64(n) < minimum {
+			return fmt.Errorf("%d is below %v", n, minimum)
+		}
+		v = float64(n)
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		v = b
+	}
+	return o.validate(schema, v, "")
+}
+
+// checkResponse checks the status, content type and JSON body of a response
+// against the responses of its operation.
+func (o *openAPI) checkResponse(op map[string]any, res *http.Response, body []byte) error {
+	responses := op["responses"].(map[string]any)
+	response, ok := responses[strconv.Itoa(res.StatusCode)].(map[string]any)
+	if !ok {
+		return fmt.Errorf("status %d is not in the spec", res.StatusCode)
+	}
+	content, ok := o.resolve(response)["content"].(map[string]any)
+	if !ok {
+		if len(body) > 0 {
+			return fmt.Errorf("status %d has no content in the spec", res.StatusCode)
+		}
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	media, ok := content[mediaType].(map[string]any)
+	if !ok {
+		return fmt.Errorf("status %d content type %q is not in the spec", res.StatusCode, mediaType)
+	}
+	schema, ok := media["schema"].(map[string]any)
+	if !ok || mediaType != "application/json" {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("status %d: %w", res.StatusCode, err)
+	}
+	return o.validate(schema, v, "body")
+}
+
+// validate checks a decoded JSON value against a schema.
+func (o *openAPI) validate(schema map[string]any, v any, where string) error {
+	schema = o.resolve(schema)
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", where, v, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: %T is not an object", where, v)
+		}
+		for _, name := range stringList(schema["required"]) {
+			if _, ok := object[name]; !ok {
+				return fmt.Errorf("%s: required property %q is missing", where, name)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := properties[name].(map[string]any)
+			if !ok {
+				property, ok = schema["additionalProperties"].(map[string]any)
+			}
+			if !ok {
+				if properties != nil {
+					return fmt.Errorf("%s: property %q is not in the spec", where, name)
+				}
+				continue
+			}
+			if err := o.validate(property, object[name], where+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s: %T is not an array", where, v)
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range array {
+				if err := o.validate(items, item, fmt.Sprintf("%s[%d]", where, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: %T is not a string", where, v)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", where, s)
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: %v is not an integer", where, v)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s: %T is not a number", where, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: %T is not a boolean", where, v)
+		}
+	}
+	return nil
+}
+
+func stringList(v any) []string {
+	list, _ := v.([]any)
+	strs := make([]string, 0, len(list))
+	for _, s := range list {
+		strs = append(strs, s.(string))
+	}
+	return strs
+}
+
+// contractTransport checks every request and response of a client against
+// the spec.
+type contractTransport struct {
+	t             *testing.T
+	spec          *openAPI
+	responsesOnly bool // don't check requests
+}
+
+func (c contractTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.t.Helper()
+	op, err := c.spec.operation(req.Method, req.URL.Path)
+	if err != nil {
+		c.t.Error(err)
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	if req.Body != nil && !c.responsesOnly {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if err := c.spec.checkRequest(op, req, body); err != nil {
+			c.t.Errorf("%s %s request: %v", req.Method, req.URL.Path, err)
+		}
+	}
+
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	if err := c.spec.checkResponse(op, res, body); err != nil {
+		c.t.Errorf("%s %s response: %v", req.Method, req.URL.Path, err)
+	}
+	return res, nil
+}
+
+func TestOpenAPISpecReferences(t *testing.T) {
+	spec := loadOpenAPI(t)
+	var walk func(v any, where string)
+	walk = func(v any, where string) {
+		switch v := v.(type) {
+		case map[string]any:
+			if ref, ok := v["$ref"].(string); ok {
+				func() {
+					defer func() {
+						if recover() != nil {
+							t.Errorf("%s: unresolved $ref %s", where, ref)
+						}
+					}()
+					spec.resolve(v)
+				}()
+			}
+			for k, child := range v {
+				walk(child, where+"/"+k)
+			}
+		case []any:
+			for i, child := range v {
+				walk(child, fmt.Sprintf("%s/%d", where, i))
+			}
+		}
+	}
+	walk(spec.doc, "#")
+}
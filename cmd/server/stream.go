@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Stream formats of /api/hwr
+const (
+	streamNDJSON = "ndjson" // One JSON object per line
+	streamSSE    = "sse"    // Server-sent events
+)
+
+// pageEvent is the streamed result of one page.
+type pageEvent struct {
+	Type       string `json:"type"` // page
+	Page       int    `json:"page"` // 0-indexed
+	Text       string `json:"text"`
+	Lang       string `json:"lang,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	Code       string `json:"code,omitempty"`
+}
+
+// doneEvent ends a stream.
+type doneEvent struct {
+	Type       string `json:"type"` // done
+	Filename   string `json:"filename"`
+	Pages      int    `json:"pages"`
+	Recognized int    `json:"recognized"`
+	Failed     int    `json:"failed"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// streamFormat returns the stream format requested with stream=1, ndjson or
+// sse, or "" when the response is not streamed. stream=1 sends server-sent
+// events if the client accepts text/event-stream.
+func streamFormat(r *http.Request) (string, error) {
+	switch strings.ToLower(r.FormValue("stream")) {
+	case "", "0", "false":
+		return "", nil
+	case "1", "true":
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			return streamSSE, nil
+		}
+		return streamNDJSON, nil
+	case streamNDJSON:
+		return streamNDJSON, nil
+	case streamSSE:
+		return streamSSE, nil
+	default:
+		return "", fmt.Errorf("Unsupported stream %q, expected 1, ndjson or sse", r.FormValue("stream"))
+	}
+}
+
+// streamHWR recognizes the pages of a request, writing each page as soon as
+// it is done, in completion order, then a done event.
+func (s *Server) streamHWR(w http.ResponseWriter, r *http.Request, req *hwrRequest, format string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Streaming not supported")
+		return
+	}
+
+	if format == streamSSE {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	// don't let proxies buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event string, v interface{}) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error encoding event", "event", event, "err", err)
+			return
+		}
+		if format == streamSSE {
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		} else {
+			fmt.Fprintf(w, "%s\n", data)
+		}
+		flusher.Flush()
+	}
+
+	started := time.Now()
+	done := doneEvent{
+		Type:     "done",
+		Filename: req.filename,
+		Pages:    len(req.zip.Pages),
+	}
+	start, end := pageRange(req.zip, req.cfg.Page)
+	s.recognizePages(r.Context(), req.zip, req.cfg, pageList(start, end), func(result pageResult) {
+		event := pageEvent{
+			Type:       "page",
+			Page:       result.page,
+			Text:       result.text,
+			Lang:       result.lang,
+			DurationMs: result.duration.Milliseconds(),
+		}
+		if result.err != nil {
+			slog.ErrorContext(r.Context(), "Error processing page", "page", result.page, "err", result.err)
+			pageErr := newPageError(result.err)
+			event.Error = pageErr.Error
+			event.Code = pageErr.Code
+			event.Lang = ""
+			done.Failed++
+		} else if result.text != "" {
+			done.Recognized++
+		}
+		send("page", event)
+	})
+	if r.Context().Err() != nil {
+		slog.WarnContext(r.Context(), "Client went away, stream stopped", "filename", req.filename)
+		return
+	}
+
+	done.DurationMs = time.Since(started).Milliseconds()
+	send("done", done)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ddvk/rmapi-hwr/hwr"
+	"github.com/juruen/rmapi/encoding/rm"
+)
+
+// Thumbnail limits of /api/thumbnails
+const (
+	maxThumbnailSize    = rm.Width // Largest width or height of a thumbnail
+	maxContactColumns   = 16       // Most thumbnails per row of a contact sheet
+	maxThumbnailPixels  = 64 << 20 // Pixels of all the thumbnails of a request, or of its contact sheet
+	maxContactSheetSide = 16384    // Largest width or height of a contact sheet
+)
+
+// handleThumbnails renders every page of a document to a thumbnail in one
+// pass and returns a zip of thumbnail_N.png images, or a contact sheet of
+// all pages with sheet=true.
+func (s *Server) handleThumbnails(w http.ResponseWriter, r *http.Request) {
+	filename, fileData, reqErr := s.readUpload(w, r)
+	if reqErr != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+
+	width, reqErr := readIntOption(r, "width", hwr.DefaultThumbnailWidth, 1, maxThumbnailSize)
+	if reqErr != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+	height, reqErr := readIntOption(r, "height", hwr.DefaultThumbnailHeight, 1, maxThumbnailSize)
+	if reqErr != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+	columns, reqErr := readIntOption(r, "columns", hwr.DefaultContactSheetColumns, 1, maxContactColumns)
+	if reqErr != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+	sheet := false
+	if value := r.FormValue("sheet"); value != "" {
+		var err error
+		if sheet, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid sheet %q, expected true or false", value))
+			return
+		}
+	}
+	theme := r.FormValue("theme")
+	if !hwr.IsTheme(theme) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Unsupported theme %q, expected one of %v", theme, hwr.Themes()))
+		return
+	}
+
+	zipArchive, reqErr := s.loadDocument(r.Context(), fileData)
+	if reqErr != nil {
+		writeRequestError(w, reqErr)
+		return
+	}
+
+	// Thumbnails are rendered one at a time, but the contact sheet is held
+	// whole, both are bounded
+	pages := len(zipArchive.Pages)
+	if pages == 0 {
+		writeError(w, http.StatusNotFound, codeNoContent, "Document has no pages")
+		return
+	}
+	if pixels := int64(pages) * int64(width) * int64(height); pixels > maxThumbnailPixels {
+		writeError(w, http.StatusRequestEntityTooLarge, codeDocumentTooLarge,
+			fmt.Sprintf("%d thumbnails of %dx%d are %d pixels, the limit is %d", pages, width, height, pixels, maxThumbnailPixels))
+		return
+	}
+	if sheet {
+		sheetWidth, sheetHeight := hwr.ContactSheetSize(pages, width, height, columns)
+		if sheetWidth > maxContactSheetSide || sheetHeight > maxContactSheetSide || int64(sheetWidth)*int64(sheetHeight) > maxThumbnailPixels {
+			writeError(w, http.StatusRequestEntityTooLarge, codeDocumentTooLarge,
+				fmt.Sprintf("The contact sheet would be %dx%d, the limit is %d pixels and %d per side", sheetWidth, sheetHeight, maxThumbnailPixels, maxContactSheetSide))
+			return
+		}
+	}
+
+	// Previews show the whole page with its template, as on the device
+	config := hwr.DefaultVisualizationConfig()
+	config.FullPage = true
+	config.Template = true
+	config.Theme = theme
+
+	name := strings.TrimSuffix(filename, filepath.Ext(filename))
+	if sheet {
+		contactSheet, err := hwr.ContactSheet(r.Context(), zipArchive, width, height, columns, config)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error rendering thumbnails: %v", err))
+			return
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, contactSheet); err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error encoding contact sheet: %v", err))
+			return
+		}
+		slog.InfoContext(r.Context(), "Rendered contact sheet", "pages", pages, "width", width, "height", height)
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s_sheet.png", name))
+		w.Write(buf.Bytes())
+		return
+	}
+
+	// each thumbnail is compressed into the zip as soon as it is rendered
+	zipBuffer := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(zipBuffer)
+	err := hwr.Thumbnails(r.Context(), zipArchive, width, height, config, func(p int, thumbnail *image.RGBA) error {
+		entry, err := zipWriter.Create(fmt.Sprintf("thumbnail_%d.png", p))
+		if err == nil {
+			err = png.Encode(entry, thumbnail)
+		}
+		if err != nil {
+			return fmt.Errorf("writing thumbnail %d: %w", p, err)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error rendering thumbnails: %v", err))
+		return
+	}
+	if err := zipWriter.Close(); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Error creating zip: %v", err))
+		return
+	}
+	slog.InfoContext(r.Context(), "Rendered thumbnails", "pages", pages, "width", width, "height", height)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s_thumbnails.zip", name))
+	w.Write(zipBuffer.Bytes())
+}
+
+// readIntOption returns an integer form option between lo and hi, or def if
+// it was not sent.
+func readIntOption(r *http.Request, field string, def, lo, hi int) (int, *requestError) {
+	value := r.FormValue(field)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < lo || n > hi {
+		return 0, &requestError{http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid %s %q, expected %d to %d", field, value, lo, hi)}
+	}
+	return n, nil
+}
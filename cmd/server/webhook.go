@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	webhookAttempts = 5                // Deliveries tried before giving up
+	webhookTimeout  = 10 * time.Second // Timeout of one delivery
+	webhookBackoff  = 2 * time.Second  // Wait after the first failure, doubled after each one
+)
+
+// webhookDelivery is one attempt to deliver a job webhook.
+type webhookDelivery struct {
+	Attempt    int    `json:"attempt"`
+	Time       string `json:"time"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// readCallbackURL returns the callback_url of a request, or "" if none was sent.
+// With WEBHOOK_ALLOWED_HOSTS its host must be one of them, otherwise it must
+// only resolve to public addresses, so that webhooks can't reach the network
+// of the server.
+func (s *Server) readCallbackURL(r *http.Request) (string, error) {
+	callbackURL := r.FormValue("callback_url")
+	if callbackURL == "" {
+		return "", nil
+	}
+	if s.webhookSecret == "" {
+		return "", fmt.Errorf("callback_url is not available, WEBHOOK_SECRET is not configured")
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("Invalid callback_url %q, expected an http(s) URL", callbackURL)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if len(s.webhookHosts) > 0 {
+		if !s.webhookHosts[host] {
+			return "", fmt.Errorf("callback_url host %q is not in WEBHOOK_ALLOWED_HOSTS", host)
+		}
+		return callbackURL, nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(r.Context(), "ip", host)
+	if err != nil {
+		return "", fmt.Errorf("Can't resolve callback_url host %q: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if !isPublicAddr(addr) {
+			return "", fmt.Errorf("callback_url host %q resolves to %s, which is not a public address", host, addr)
+		}
+	}
+	return callbackURL, nil
+}
+
+// parseWebhookHosts returns the hosts of WEBHOOK_ALLOWED_HOSTS, a comma
+// separated list of host names or IP addresses.
+func parseWebhookHosts(value string) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, host := range strings.Split(value, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+// isPublicAddr reports whether addr can be reached by webhooks: not a
+// loopback, private, link-local, multicast or unspecified address.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() && !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsUnspecified() &&
+		!addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() && !addr.IsInterfaceLocalMulticast() && !addr.IsMulticast()
+}
+
+// newWebhookClient returns the client delivering webhooks. Without allowed
+// hosts, it checks every address it connects to again, as the DNS may answer
+// differently than when the callback_url was accepted. Redirects are not
+// followed, they would lead anywhere.
+func newWebhookClient(allowedHosts map[string]bool) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if len(allowedHosts) == 0 {
+		dialer.Control = dialPublic
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// dialPublic refuses connections to addresses that are not public.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("webhook address %q: %w", address, err)
+	}
+	if !isPublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("webhook address %s is not a public address", addrPort.Addr())
+	}
+	return nil
+}
+
+// webhookPayload returns the payload sent when the job finished.
+func (job *Job) webhookPayload() map[string]interface{} {
+	job.mu.Lock()
+	payload := map[string]interface{}{
+		"event":     "job." + job.status,
+		"id":        job.id,
+		"type":      job.kind,
+		"status":    job.status,
+		"filename":  job.filename,
+		"pages":     job.docPages,
+		"errors":    job.errors,
+		"timestamp": time.Now().Format(time.RFC3339),
+	}
+
+	switch job.status {
+	case jobFailed:
+		_, failure := job.failure()
+		payload["error"] = failure.Error
+		payload["code"] = failure.Code
+	case jobCanceled:
+		payload["error"] = "Job canceled"
+		payload["code"] = codeJobNotFinished
+	}
+
+	if job.kind != jobConvert {
+		payload["text"] = job.result
+		payload["langs"] = job.langs
+	}
+	convert := job.kind == jobConvert && job.status == jobDone
+	zip, images, format, background := job.zip, job.images, job.format, job.background
+	job.mu.Unlock()
+
+	// rendered without holding the job, the fields of a finished job don't change
+	if convert {
+		// the job context is canceled once the job finished
+		data, _, err := convertResult(context.WithoutCancel(job.ctx), zip, images, format, background)
+		if err != nil {
+			payload["error"] = err.Error()
+			payload["code"] = codeInternal
+		} else {
+			// the zip or PDF of /api/convert, base64 encoded
+			payload["archive"] = base64.StdEncoding.EncodeToString(data)
+		}
+	}
+	return payload
+}
+
+// signWebhook returns the HMAC-SHA256 of the timestamp, a dot and the body, as
+// sent in X-HWR-Signature-256. Signing the timestamp lets receivers reject
+// old deliveries replayed.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts the result of a finished job to its callback URL,
+// retrying with exponential backoff. Every attempt is recorded on the job.
+func (s *Server) deliverWebhook(job *Job) {
+	payload := job.webhookPayload()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.ErrorContext(job.ctx, "Can't encode webhook payload", "err", err)
+		return
+	}
+	event := payload["event"].(string)
+
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		start := time.Now()
+		timestamp := strconv.FormatInt(start.Unix(), 10)
+		signature := signWebhook(s.webhookSecret, timestamp, body)
+		statusCode, err := postWebhook(s.webhookClient, job.callbackURL, body, timestamp, signature, event, job.id)
+
+		delivery := webhookDelivery{
+			Attempt:    attempt,
+			Time:       start.Format(time.RFC3339),
+			StatusCode: statusCode,
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		job.mu.Lock()
+		job.deliveries = append(job.deliveries, delivery)
+		job.mu.Unlock()
+
+		if err == nil {
+			slog.InfoContext(job.ctx, "Webhook delivered", "url", job.callbackURL, "status", statusCode)
+			return
+		}
+		slog.WarnContext(job.ctx, "Webhook attempt failed", "attempt", attempt, "attempts", webhookAttempts, "url", job.callbackURL, "err", err)
+		if attempt < webhookAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	slog.ErrorContext(job.ctx, "Giving up webhook delivery", "url", job.callbackURL)
+}
+
+// postWebhook sends one delivery, any status but 2xx is a failure.
+func postWebhook(httpClient *http.Client, callbackURL string, body []byte, timestamp, signature, event, jobID string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "rmapi-hwr")
+	req.Header.Set("X-HWR-Event", event)
+	req.Header.Set("X-HWR-Job", jobID)
+	req.Header.Set("X-HWR-Timestamp", timestamp)
+	req.Header.Set("X-HWR-Signature-256", signature)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func callbackRequest(callbackURL string) *http.Request {
+	form := url.Values{"callback_url": {callbackURL}}
+	r := httptest.NewRequest(http.MethodPost, "/api/hwr", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestReadCallbackURLRejectsInternalHosts(t *testing.T) {
+	s := &Server{webhookSecret: "secret"}
+	for _, callbackURL := range []string{
+		"http://127.0.0.1/hook",
+		"http://localhost:8080/hook",
+		"http://[::1]/hook",
+		"http://10.0.0.8/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+	} {
+		if _, err := s.readCallbackURL(callbackRequest(callbackURL)); err == nil {
+			t.Errorf("%s: accepted, want an error", callbackURL)
+		}
+	}
+	if _, err := s.readCallbackURL(callbackRequest("https://8.8.8.8/hook")); err != nil {
+		t.Errorf("public address: %v", err)
+	}
+}
+
+func TestReadCallbackURLAllowedHosts(t *testing.T) {
+	s := &Server{webhookSecret: "secret", webhookHosts: parseWebhookHosts("hooks.internal, 127.0.0.1")}
+	for _, callbackURL := range []string{"http://127.0.0.1:9000/hook", "https://HOOKS.internal/hook"} {
+		if _, err := s.readCallbackURL(callbackRequest(callbackURL)); err != nil {
+			t.Errorf("%s: %v", callbackURL, err)
+		}
+	}
+	if _, err := s.readCallbackURL(callbackRequest("https://8.8.8.8/hook")); err == nil {
+		t.Error("host outside WEBHOOK_ALLOWED_HOSTS accepted")
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	var got *http.Request
+	var gotBody []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = io.ReadAll(r.Body)
+	}))
+	defer receiver.Close()
+	body := []byte(`{"event":"job.done"}`)
+	signature := signWebhook("secret", "1700000000", body)
+
+	// the receiver is on a loopback address, refused when connecting
+	if _, err := postWebhook(newWebhookClient(nil), receiver.URL, body, "1700000000", signature, "job.done", "job"); err == nil {
+		t.Fatal("delivered to a loopback address")
+	}
+
+	client := newWebhookClient(parseWebhookHosts("127.0.0.1"))
+	if _, err := postWebhook(client, receiver.URL, body, "1700000000", signature, "job.done", "job"); err != nil {
+		t.Fatal(err)
+	}
+	if got.Header.Get("X-HWR-Timestamp") != "1700000000" {
+		t.Errorf("X-HWR-Timestamp is %q", got.Header.Get("X-HWR-Timestamp"))
+	}
+	want := signWebhook("secret", got.Header.Get("X-HWR-Timestamp"), gotBody)
+	if got.Header.Get("X-HWR-Signature-256") != want {
+		t.Errorf("X-HWR-Signature-256 is %q, want %q", got.Header.Get("X-HWR-Signature-256"), want)
+	}
+	if signWebhook("secret", "1700000001", body) == want {
+		t.Error("the signature doesn't depend on the timestamp")
+	}
+}
+
+func TestConvertJobWebhookPDF(t *testing.T) {
+	payloads := make(chan map[string]any, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("webhook payload: %v", err)
+		}
+		payloads <- payload
+	}))
+	defer receiver.Close()
+	t.Setenv("WEBHOOK_SECRET", "secret")
+	t.Setenv("WEBHOOK_ALLOWED_HOSTS", "127.0.0.1")
+	c := newContractClient(t)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "notes.zip")
+	part.Write(testDocument(t, 2))
+	form.WriteField("format", "pdf")
+	form.WriteField("callback_url", receiver.URL+"/hook")
+	form.Close()
+	res, err := http.Post(c.BaseURL+"/api/convert", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %d, want 202", res.StatusCode)
+	}
+
+	select {
+	case payload := <-payloads:
+		if payload["status"] != jobDone || payload["error"] != nil {
+			t.Fatalf("webhook is %v %v", payload["status"], payload["error"])
+		}
+		archive, _ := payload["archive"].(string)
+		pdf, err := base64.StdEncoding.DecodeString(archive)
+		if err != nil || !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+			t.Errorf("archive is not a base64 PDF: %.20q, %v", archive, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no webhook delivered")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/ddvk/rmapi-hwr/hwr"
 	"github.com/ddvk/rmapi-hwr/hwr/models"
 	"github.com/juruen/rmapi/archive"
 	"github.com/juruen/rmapi/encoding/rm"
@@ -387,7 +388,7 @@ func loadRmZipNewFormat(file *os.File) (zipArchive *archive.Zip, err error) {
 }
 
 // generateJSON converts a Remarkable archive page to the JSON format sent to HWR service
-func generateJSON(zip *archive.Zip, contenttype string, lang string, pageNumber int) ([]byte, error) {
+func generateJSON(zip *archive.Zip, contenttype string, conf *models.Configuration, pageNumber int) ([]byte, error) {
 	numPages := len(zip.Pages)
 
 	if pageNumber >= numPages || pageNumber < 0 {
@@ -395,9 +396,7 @@ func generateJSON(zip *archive.Zip, contenttype string, lang string, pageNumber
 	}
 
 	batch := models.BatchInput{
-		Configuration: &models.Configuration{
-			Lang: lang,
-		},
+		Configuration: conf,
 		StrokeGroups: []*models.StrokeGroup{
 			&models.StrokeGroup{},
 		},
@@ -458,8 +457,28 @@ func main() {
 	var lang = flag.String("lang", "en_US", "language culture")
 	var page = flag.Int("page", -1, "page to convert (default all pages)")
 	var outputFile = flag.String("o", "", "output file (default stdout)")
+	var profileName = flag.String("profile", "", fmt.Sprintf("recognition profile: a YAML/JSON file or one of %v", hwr.ProfileNames()))
 	flag.Parse()
 
+	var profile *models.Configuration
+	if *profileName != "" {
+		var err error
+		profile, err = hwr.LoadProfile(*profileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		langSet := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "lang" {
+				langSet = true
+			}
+		})
+		if profile.Lang != "" && !langSet {
+			*lang = profile.Lang
+		}
+	}
+	conf := hwr.NewConfiguration(profile, *inputType, *lang, hwr.Resources{})
+
 	args := flag.Args()
 	if len(args) < 1 {
 		log.Fatal("no file specified")
@@ -514,7 +533,7 @@ func main() {
 
 	// Convert each page
 	for i, pageNum := range pagesToConvert {
-		jsonData, err := generateJSON(z, *inputType, *lang, pageNum)
+		jsonData, err := generateJSON(z, *inputType, conf, pageNum)
 		if err != nil {
 			log.Printf("Error converting page %d: %v", pageNum+1, err)
 			continue
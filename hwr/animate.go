@@ -0,0 +1,334 @@
+package hwr
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"time"
+
+	"github.com/juruen/rmapi/archive"
+	"github.com/juruen/rmapi/encoding/rm"
+)
+
+// Animation formats
+const (
+	AnimationFormatGIF  = "gif"  // Animated GIF, 256 colors and on/off transparency (default)
+	AnimationFormatAPNG = "apng" // Animated PNG, full color and transparency
+)
+
+// Animation modes
+const (
+	AnimateStrokes = "stroke" // Strokes appear one at a time (default)
+	AnimatePoints  = "point"  // Strokes are drawn point by point, as they were written
+)
+
+// Animation constants
+const (
+	defaultStrokeSpeed = 5               // Strokes per second
+	defaultPointSpeed  = 200             // Points per second
+	animationFrameRate = 25              // Most frames per second, faster speeds draw more per frame
+	animationHold      = 2 * time.Second // Time the finished page is shown before the animation loops
+	gifInkLevels       = 16              // GIF palette colors from the paper to each ink, for anti-aliasing
+)
+
+// AnimationConfig holds configuration for replaying the strokes of a page.
+type AnimationConfig struct {
+	// Format is the file format, one of AnimationFormats() (default: gif)
+	Format string
+	// Mode is how strokes appear, one of AnimationModes() (default: stroke)
+	Mode string
+	// Speed is the strokes, or points in point mode, drawn per second (default: 5 strokes, 200 points)
+	Speed float64
+}
+
+// AnimationFormats returns the supported animation formats.
+func AnimationFormats() []string {
+	return []string{AnimationFormatGIF, AnimationFormatAPNG}
+}
+
+// IsAnimationFormat reports whether format is a supported animation format.
+func IsAnimationFormat(format string) bool {
+	for _, f := range AnimationFormats() {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// AnimationModes returns the supported animation modes.
+func AnimationModes() []string {
+	return []string{AnimateStrokes, AnimatePoints}
+}
+
+// IsAnimationMode reports whether mode is a supported animation mode.
+func IsAnimationMode(mode string) bool {
+	for _, m := range AnimationModes() {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// animationEncoder encodes the frames of an animation. Each frame is the
+// part of the page that changed, drawn over the previous frames.
+type animationEncoder interface {
+	// frame adds a frame, shown for delay. img is only valid during the call.
+	frame(img *image.RGBA, delay time.Duration) error
+	// finish shows the last frame for hold more and writes the animation.
+	finish(w io.Writer, hold time.Duration) error
+}
+
+// AnimatePage replays the writing of a page to an animation file, see
+// WriteAnimation. The file is removed when the animation fails.
+func AnimatePage(ctx context.Context, zip *archive.Zip, pageNumber int, outputPath string, config VisualizationConfig, animation AnimationConfig) error {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	err = WriteAnimation(ctx, file, zip, pageNumber, config, animation)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return err
+	}
+	return nil
+}
+
+// WriteAnimation replays the writing of a page (0-indexed): its strokes
+// appear in the order they were written, layer by layer and highlighters
+// first, on the page laid out as RenderPage lays it out. The finished page is shown for a while before
+// the animation loops. Pages are drawn on their paper, without background or
+// supersampling.
+func WriteAnimation(ctx context.Context, w io.Writer, zip *archive.Zip, pageNumber int, config VisualizationConfig, animation AnimationConfig) error {
+	if pageNumber < 0 || pageNumber >= len(zip.Pages) {
+		return fmt.Errorf("page %d out of range, the document has %d pages", pageNumber+1, len(zip.Pages))
+	}
+	page := zip.Pages[pageNumber]
+	if page.Data == nil {
+		return fmt.Errorf("page %d has no data", pageNumber+1)
+	}
+	bbox := pageBoundingBox(page.Data, config)
+	if bbox == nil {
+		return fmt.Errorf("page %d has no strokes", pageNumber+1)
+	}
+
+	mode := animation.Mode
+	if mode == "" {
+		mode = AnimateStrokes
+	}
+	if !IsAnimationMode(mode) {
+		return fmt.Errorf("unsupported animation mode %q, expected one of %v", mode, AnimationModes())
+	}
+	speed := animation.Speed
+	if speed <= 0 {
+		speed = defaultStrokeSpeed
+		if mode == AnimatePoints {
+			speed = defaultPointSpeed
+		}
+	}
+	var enc animationEncoder
+	switch animation.Format {
+	case "", AnimationFormatGIF:
+		enc = &gifEncoder{palette: gifPalette(page, config)}
+	case AnimationFormatAPNG:
+		enc = &apngEncoder{}
+	default:
+		return fmt.Errorf("unsupported animation format %q, expected one of %v", animation.Format, AnimationFormats())
+	}
+
+	// The page as RenderPage lays it out, without its strokes
+	scaleX, scaleY, width, height := calculateImageDimensions(bbox, config)
+	height = max(height, minImageHeight)
+	canvas := newPaperImage(width, height, config)
+	if config.FullPage && config.Template {
+		drawTemplate(canvas, pageTemplate(page.Pagedata), config.inkColor(templateColor), bbox, scaleX, scaleY)
+	}
+	r := &strokeRasterizer{img: canvas, scale: 1}
+	transform := func(x, y float32) (float32, float32) {
+		return (x - bbox.minX + bbox.paddingX) * scaleX, (y - bbox.minY + bbox.paddingY) * scaleY
+	}
+
+	// Faster speeds draw several strokes or points per frame
+	perFrame := max(int(math.Ceil(speed/animationFrameRate)), 1)
+	var dirty image.Rectangle
+	var delay time.Duration
+	units, frames := 0, 1
+	emit := func() error {
+		delay += time.Duration(float64(units) / speed * float64(time.Second))
+		units = 0
+		if dirty.Empty() {
+			// nothing visible changed, the next frame comes later
+			return nil
+		}
+		frames++
+		err := enc.frame(canvas.SubImage(dirty).(*image.RGBA), delay)
+		dirty, delay = image.Rectangle{}, 0
+		return err
+	}
+
+	slog.DebugContext(ctx, "Animating page", "page", pageNumber, "mode", mode, "speed", speed, "width", width, "height", height)
+	if err := enc.frame(canvas, time.Duration(float64(perFrame)/speed*float64(time.Second))); err != nil {
+		return err
+	}
+	for _, line := range writingOrder(page.Data) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pen := NewPenRendererWithPalette(line.BrushType, uint32(line.BrushColor), line.BrushSize, config.Palette)
+
+		if mode == AnimateStrokes {
+			shapes, grain := lineShapes(line, transform, pen, config)
+			for _, shape := range shapes {
+				r.fill(shape, grain)
+				dirty = dirty.Union(r.bounds(shape))
+			}
+			if units++; units >= perFrame {
+				if err := emit(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// Redraw the stroke up to each frame over what it covers, a
+		// pen width around its final shape
+		var area image.Rectangle
+		shapes, _ := lineShapes(line, transform, pen, config)
+		for _, shape := range shapes {
+			area = area.Union(r.bounds(shape))
+		}
+		area = area.Inset(-config.MaxStrokeWidth - 1).Intersect(canvas.Bounds())
+		under := image.NewRGBA(area)
+		draw.Draw(under, area, canvas, area.Min, draw.Src)
+		for n := 1; n <= len(line.Points); n++ {
+			units++
+			if units < perFrame && n < len(line.Points) {
+				continue
+			}
+			partial := line
+			partial.Points = line.Points[:n]
+			draw.Draw(canvas, area, under, area.Min, draw.Src)
+			shapes, grain := lineShapes(partial, transform, pen, config)
+			for _, shape := range shapes {
+				r.fill(shape, grain)
+			}
+			dirty = dirty.Union(area)
+			if units >= perFrame {
+				if err := emit(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := emit(); err != nil {
+		return err
+	}
+
+	slog.DebugContext(ctx, "Animated page", "page", pageNumber, "frames", frames)
+	return enc.finish(w, animationHold)
+}
+
+// writingOrder returns the visible lines of a page in the order they were
+// written, layer by layer, highlighters first as drawStrokes draws them under
+// the other strokes.
+func writingOrder(pageData *rm.Rm) []rm.Line {
+	var highlighters, strokes []rm.Line
+	for _, layer := range pageData.Layers {
+		for _, line := range layer.Lines {
+			switch {
+			case line.BrushType == rm.EraseArea || len(line.Points) < 2:
+			case line.BrushType == rm.Highlighter || line.BrushType == rm.HighlighterV5:
+				highlighters = append(highlighters, line)
+			default:
+				strokes = append(strokes, line)
+			}
+		}
+	}
+	return append(highlighters, strokes...)
+}
+
+// gifEncoder encodes frames to an animated GIF of a palette.
+type gifEncoder struct {
+	palette color.Palette
+	anim    gif.GIF
+	elapsed time.Duration // Time of the frames so far
+	shown   int           // Delays of the frames so far, in 100ths of a second
+}
+
+func (e *gifEncoder) frame(img *image.RGBA, delay time.Duration) error {
+	bounds := img.Bounds()
+	frame := image.NewPaletted(bounds, e.palette)
+	draw.Draw(frame, bounds, img, bounds.Min, draw.Src)
+
+	// delays are rounded over the animation, so that they don't drift
+	e.elapsed += delay
+	centis := int(e.elapsed.Round(10*time.Millisecond)/(10*time.Millisecond)) - e.shown
+	e.shown += centis
+	e.anim.Image = append(e.anim.Image, frame)
+	e.anim.Delay = append(e.anim.Delay, centis)
+	e.anim.Disposal = append(e.anim.Disposal, gif.DisposalNone)
+	return nil
+}
+
+func (e *gifEncoder) finish(w io.Writer, hold time.Duration) error {
+	if n := len(e.anim.Delay); n > 0 {
+		e.anim.Delay[n-1] += int(hold / (10 * time.Millisecond))
+	}
+	return gif.EncodeAll(w, &e.anim)
+}
+
+// gifPalette returns the colors of the GIF of a page: its paper, template and
+// inks, each ink from the paper to its full color for anti-aliased edges and
+// translucent strokes. Transparent pages have on/off transparency.
+func gifPalette(page archive.Page, config VisualizationConfig) color.Palette {
+	paper, opaque := config.paperColor()
+	levels := gifInkLevels
+	palette := color.Palette{color.RGBA{paper[0], paper[1], paper[2], 255}}
+	if !opaque {
+		levels = 1
+		palette = color.Palette{color.Transparent}
+	}
+
+	inks := [][3]uint8{}
+	if config.FullPage && config.Template {
+		inks = append(inks, config.inkColor(templateColor))
+	}
+	for _, layer := range page.Data.Layers {
+		for _, line := range layer.Lines {
+			pen := NewPenRendererWithPalette(line.BrushType, uint32(line.BrushColor), line.BrushSize, config.Palette)
+			if line.BrushType == rm.Highlighter || line.BrushType == rm.HighlighterV5 {
+				inks = append(inks, config.highlightColor(lightenColor(pen.baseColor)))
+			} else {
+				inks = append(inks, config.inkColor(pen.baseColor))
+			}
+		}
+	}
+
+	seen := map[[3]uint8]bool{paper: opaque}
+	for _, ink := range inks {
+		if seen[ink] {
+			continue
+		}
+		seen[ink] = true
+		for l := 1; l <= levels && len(palette) < 256; l++ {
+			t := float32(l) / float32(levels)
+			var c [3]uint8
+			for i := range c {
+				c[i] = uint8(float32(paper[i])*(1-t) + float32(ink[i])*t + 0.5)
+			}
+			palette = append(palette, color.RGBA{c[0], c[1], c[2], 255})
+		}
+	}
+	return palette
+}
@@ -0,0 +1,35 @@
+package hwr
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juruen/rmapi/archive"
+	"github.com/juruen/rmapi/encoding/rm"
+)
+
+func TestAnimatePage(t *testing.T) {
+	zip := &archive.Zip{Pages: []archive.Page{{Data: goldenStroke(rm.BallPointV5)}}}
+	config := DefaultVisualizationConfig()
+	config.OutputWidth = 100
+	dir := t.TempDir()
+
+	output := filepath.Join(dir, "page.gif")
+	if err := AnimatePage(context.Background(), zip, 0, output, config, AnimationConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(output); err != nil || info.Size() == 0 {
+		t.Errorf("no animation written: %v", err)
+	}
+
+	// a failed animation leaves no partial file
+	output = filepath.Join(dir, "missing.gif")
+	if err := AnimatePage(context.Background(), zip, 1, output, config, AnimationConfig{}); err == nil {
+		t.Fatal("animated a page out of range")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("%s was left behind: %v", output, err)
+	}
+}
@@ -0,0 +1,484 @@
+// Package apiclient is a client of the rmapi-hwr server (cmd/server), written
+// against the OpenAPI document it serves on /openapi.json.
+package apiclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LastOpenedPage selects the last opened page in Options.Page.
+const LastOpenedPage = -1
+
+// Client calls a rmapi-hwr server.
+type Client struct {
+	BaseURL    string       // e.g. http://localhost:8082
+	APIKey     string       // Bearer token, empty when the server has no API_KEYS_FILE
+	HTTPClient *http.Client // http.DefaultClient if nil
+}
+
+// New returns a client of the server at baseURL.
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		APIKey:  apiKey,
+	}
+}
+
+// Options are the form parameters of a recognition. Zero values are not sent
+// and take the server defaults.
+type Options struct {
+	Type          string   // Text (default), Math, Diagram or Raw Content
+	Lang          string   // Recognition language, e.g. en_US
+	Page          int      // Page, 1-indexed, 0 for all pages or LastOpenedPage
+	PageLang      string   // Per page languages, e.g. 1=en_US,3-5=de_DE
+	DetectLang    []string // Candidate languages detected on Text pages
+	DiagramFormat string   // svg or a graph format
+	Profile       string   // Built-in recognition profile
+	ProfileFile   []byte   // Recognition profile, JSON
+	Lexicon       []byte   // Custom words, one per line
+	Grammar       []byte   // Math grammar
+	Concurrency   int      // Pages recognized at once, capped by the server
+	CallbackURL   string   // Webhook notified when the job finishes, CreateJob only
+}
+
+// PageError is the error of a failed page, and the error envelope of the API.
+type PageError struct {
+	Message string `json:"error"`
+	Code    string `json:"code"`
+}
+
+// Result is the recognition of a document. Maps are keyed by page, 0-indexed.
+type Result struct {
+	Filename string            `json:"filename"`
+	Pages    int               `json:"pages"` // Pages of the document
+	Text     map[int]string    `json:"text"`
+	Langs    map[int]string    `json:"langs"`
+	Errors   map[int]PageError `json:"errors"`
+}
+
+// StreamEvent is a page recognized by RecognizeStream, or the final done event.
+type StreamEvent struct {
+	Type       string `json:"type"` // page or done
+	Page       int    `json:"page"` // 0-indexed
+	Text       string `json:"text"`
+	Lang       string `json:"lang"`
+	Error      string `json:"error"`
+	Code       string `json:"code"`
+	DurationMs int64  `json:"duration_ms"`
+	Filename   string `json:"filename"`   // done
+	Pages      int    `json:"pages"`      // done
+	Recognized int    `json:"recognized"` // done
+	Failed     int    `json:"failed"`     // done
+}
+
+// Job is the status of an asynchronous recognition or conversion.
+type Job struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`   // hwr or convert
+	Status   string `json:"status"` // queued, running, done, failed or canceled
+	Filename string `json:"filename"`
+	Progress struct {
+		Total     int `json:"total"`
+		Completed int `json:"completed"`
+		Failed    int `json:"failed"`
+	} `json:"progress"`
+	PageStatus map[int]string    `json:"page_status"` // pending, running, done, empty or failed
+	Errors     map[int]PageError `json:"errors"`
+	Created    time.Time         `json:"created"`
+	Updated    time.Time         `json:"updated"`
+	Callback   *struct {
+		URL        string `json:"url"`
+		Deliveries []struct {
+			Attempt    int       `json:"attempt"`
+			Time       time.Time `json:"time"`
+			StatusCode int       `json:"status_code"`
+			Error      string    `json:"error"`
+			DurationMs int64     `json:"duration_ms"`
+		} `json:"deliveries"`
+	} `json:"callback"`
+}
+
+// Finished reports whether the job reached a final state.
+func (j *Job) Finished() bool {
+	return j.Status == "done" || j.Status == "failed" || j.Status == "canceled"
+}
+
+// Usage is the usage and quotas of the API key. A zero limit is unlimited.
+type Usage struct {
+	Key string `json:"key"`
+	Day struct {
+		Date  string `json:"date"`
+		Pages int    `json:"pages"`
+		Limit int    `json:"limit"`
+	} `json:"day"`
+	Month struct {
+		Month string `json:"month"`
+		Pages int    `json:"pages"`
+		Limit int    `json:"limit"`
+	} `json:"month"`
+	TotalPages int `json:"total_pages"`
+	Requests   int `json:"requests"`
+}
+
+// Health is the answer of /health.
+type Health struct {
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+// Error is an error response of the server.
+type Error struct {
+	StatusCode int
+	Code       string // Error code, e.g. page_out_of_range
+	Message    string
+	Errors     map[int]PageError // Failed pages, when recognition failed
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Health checks that the server is up.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	var health Health
+	if err := c.getJSON(ctx, "/health", &health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// Recognize recognizes the handwriting of a .rmdoc or .zip document.
+func (c *Client) Recognize(ctx context.Context, filename string, document io.Reader, opts Options) (*Result, error) {
+	if opts.CallbackURL != "" {
+		return nil, fmt.Errorf("CallbackURL starts a job, use CreateJob")
+	}
+	res, err := c.postForm(ctx, "/api/hwr", filename, document, opts.fields(), opts.files())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var result Result
+	if err := decodeJSON(res, http.StatusOK, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// RecognizeStream recognizes a document page by page, calling fn for each page
+// in page order as soon as it is recognized, then for the done event. An error
+// of fn stops the recognition.
+func (c *Client) RecognizeStream(ctx context.Context, filename string, document io.Reader, opts Options, fn func(StreamEvent) error) error {
+	if opts.CallbackURL != "" {
+		return fmt.Errorf("CallbackURL starts a job, use CreateJob")
+	}
+	fields := opts.fields()
+	fields["stream"] = "ndjson"
+	res, err := c.postForm(ctx, "/api/hwr", filename, document, fields, opts.files())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readError(res)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var event StreamEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("can't decode stream event: %w", err)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+		if event.Type == "done" {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream ended without a done event")
+}
+
+// ConvertOptions are the form parameters of a conversion.
+type ConvertOptions struct {
+	Page       int    // As Options.Page
+	Format     string // png (default), svg or pdf
+	Background bool   // Draw png or pdf pages over the pages of the annotated PDF or EPUB
+}
+
+// Convert renders the pages of a document to images and returns their zip,
+// named page_N.png or page_N.svg with N 0-indexed, or a PDF document of the
+// pages with format pdf.
+func (c *Client) Convert(ctx context.Context, filename string, document io.Reader, opts ConvertOptions) ([]byte, error) {
+	fields := Options{Page: opts.Page}.fields()
+	if opts.Format != "" {
+		fields["format"] = opts.Format
+	}
+	if opts.Background {
+		fields["background"] = "true"
+	}
+	res, err := c.postForm(ctx, "/api/convert", filename, document, fields, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return readBody(res)
+}
+
+// ThumbnailOptions are the form parameters of thumbnails.
+type ThumbnailOptions struct {
+	Width   int    // Width of the thumbnails, 0 for the server default
+	Height  int    // Height of the thumbnails, 0 for the server default
+	Sheet   bool   // Return a contact sheet of all pages instead of a zip
+	Columns int    // Thumbnails per row of the contact sheet, 0 for the server default
+	Theme   string // light (default), dark, transparent or eink
+}
+
+// Thumbnails renders every page of a document to a thumbnail and returns
+// their zip, named thumbnail_N.png with N 0-indexed, or a contact sheet PNG
+// of all pages with Sheet.
+func (c *Client) Thumbnails(ctx context.Context, filename string, document io.Reader, opts ThumbnailOptions) ([]byte, error) {
+	fields := make(map[string]string)
+	if opts.Width > 0 {
+		fields["width"] = strconv.Itoa(opts.Width)
+	}
+	if opts.Height > 0 {
+		fields["height"] = strconv.Itoa(opts.Height)
+	}
+	if opts.Sheet {
+		fields["sheet"] = "true"
+	}
+	if opts.Columns > 0 {
+		fields["columns"] = strconv.Itoa(opts.Columns)
+	}
+	if opts.Theme != "" {
+		fields["theme"] = opts.Theme
+	}
+	res, err := c.postForm(ctx, "/api/thumbnails", filename, document, fields, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return readBody(res)
+}
+
+// CreateJob starts an asynchronous recognition, followed with GetJob.
+func (c *Client) CreateJob(ctx context.Context, filename string, document io.Reader, opts Options) (*Job, error) {
+	res, err := c.postForm(ctx, "/api/jobs", filename, document, opts.fields(), opts.files())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var job Job
+	if err := decodeJSON(res, http.StatusAccepted, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetJob returns the status of a job.
+func (c *Client) GetJob(ctx context.Context, id string) (*Job, error) {
+	var job Job
+	if err := c.getJSON(ctx, "/api/jobs/"+id, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// CancelJob cancels a job and returns its status.
+func (c *Client) CancelJob(ctx context.Context, id string) (*Job, error) {
+	res, err := c.do(ctx, http.MethodDelete, "/api/jobs/"+id, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var job Job
+	if err := decodeJSON(res, http.StatusOK, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// JobResult returns the recognition of a finished hwr job.
+func (c *Client) JobResult(ctx context.Context, id string) (*Result, error) {
+	var result Result
+	if err := c.getJSON(ctx, "/api/jobs/"+id+"/result", &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// JobArchive returns the result of a finished convert job, the Convert zip
+// or PDF.
+func (c *Client) JobArchive(ctx context.Context, id string) ([]byte, error) {
+	res, err := c.do(ctx, http.MethodGet, "/api/jobs/"+id+"/result", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return readBody(res)
+}
+
+// Usage returns the usage and quotas of the API key.
+func (c *Client) Usage(ctx context.Context) (*Usage, error) {
+	var usage Usage
+	if err := c.getJSON(ctx, "/api/usage", &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// fields returns the form fields of the options.
+func (o Options) fields() map[string]string {
+	fields := make(map[string]string)
+	set := func(name, value string) {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	set("type", o.Type)
+	set("lang", o.Lang)
+	switch {
+	case o.Page == LastOpenedPage:
+		fields["page"] = "0"
+	case o.Page > 0:
+		fields["page"] = strconv.Itoa(o.Page)
+	}
+	set("page_lang", o.PageLang)
+	set("detect_lang", strings.Join(o.DetectLang, ","))
+	set("diagram_format", o.DiagramFormat)
+	set("profile", o.Profile)
+	if o.Concurrency > 0 {
+		fields["concurrency"] = strconv.Itoa(o.Concurrency)
+	}
+	set("callback_url", o.CallbackURL)
+	return fields
+}
+
+// files returns the form files of the options besides the document.
+func (o Options) files() map[string][]byte {
+	files := make(map[string][]byte)
+	if o.ProfileFile != nil {
+		files["profile_file"] = o.ProfileFile
+	}
+	if o.Lexicon != nil {
+		files["lexicon"] = o.Lexicon
+	}
+	if o.Grammar != nil {
+		files["grammar"] = o.Grammar
+	}
+	return files
+}
+
+// postForm posts a multipart form with the document in its file field.
+func (c *Client) postForm(ctx context.Context, path, filename string, document io.Reader, fields map[string]string, files map[string][]byte) (*http.Response, error) {
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, document); err != nil {
+		return nil, fmt.Errorf("can't read document: %w", err)
+	}
+	for name, data := range files {
+		part, err := form.CreateFormFile(name, name)
+		if err != nil {
+			return nil, err
+		}
+		part.Write(data)
+	}
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+	return c.do(ctx, http.MethodPost, path, body, form.FormDataContentType())
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v any) error {
+	res, err := c.do(ctx, http.MethodGet, path, nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return decodeJSON(res, http.StatusOK, v)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(req)
+}
+
+// decodeJSON decodes a response with the expected status, or returns its error.
+func decodeJSON(res *http.Response, status int, v any) error {
+	if res.StatusCode != status {
+		return readError(res)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("can't decode response: %w", err)
+	}
+	return nil
+}
+
+// readBody returns the body of a successful response, or its error.
+func readBody(res *http.Response) ([]byte, error) {
+	if res.StatusCode != http.StatusOK {
+		return nil, readError(res)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// readError returns the *Error of an error response.
+func readError(res *http.Response) error {
+	var envelope struct {
+		Error  string            `json:"error"`
+		Code   string            `json:"code"`
+		Errors map[int]PageError `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 1024*1024))
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.Code == "" {
+		envelope.Error = strings.TrimSpace(string(data))
+		if envelope.Error == "" {
+			envelope.Error = http.StatusText(res.StatusCode)
+		}
+	}
+	return &Error{
+		StatusCode: res.StatusCode,
+		Code:       envelope.Code,
+		Message:    envelope.Error,
+		Errors:     envelope.Errors,
+	}
+}
@@ -0,0 +1,139 @@
+package hwr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"io"
+	"time"
+)
+
+// pngSignature starts every PNG file.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// APNG frame options
+const (
+	apngDisposeNone = 0 // The frame stays under the next one
+	apngBlendSource = 0 // The frame replaces the pixels under it
+)
+
+// apngEncoder encodes frames to an animated PNG, 8-bit RGBA. The image
+// package has no APNG encoder, frames are compressed as they come and the
+// chunks written by finish.
+type apngEncoder struct {
+	frames  []apngFrame
+	elapsed time.Duration // Time of the frames so far
+	shown   int           // Delays of the frames so far, in milliseconds
+}
+
+// apngFrame is a compressed frame and its position on the first one.
+type apngFrame struct {
+	bounds image.Rectangle
+	delay  int // Milliseconds
+	data   []byte
+}
+
+func (e *apngEncoder) frame(img *image.RGBA, delay time.Duration) error {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+
+	// Scanlines without filter, each after its filter type byte
+	var data bytes.Buffer
+	z := zlib.NewWriter(&data)
+	row := make([]byte, 1+bounds.Dx()*4)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		i := nrgba.PixOffset(bounds.Min.X, y)
+		copy(row[1:], nrgba.Pix[i:i+bounds.Dx()*4])
+		if _, err := z.Write(row); err != nil {
+			return err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return err
+	}
+
+	// delays are rounded over the animation, so that they don't drift
+	e.elapsed += delay
+	millis := int(e.elapsed.Milliseconds()) - e.shown
+	e.shown += millis
+	e.frames = append(e.frames, apngFrame{bounds: bounds, delay: millis, data: data.Bytes()})
+	return nil
+}
+
+func (e *apngEncoder) finish(w io.Writer, hold time.Duration) error {
+	if len(e.frames) == 0 {
+		return nil
+	}
+	e.frames[len(e.frames)-1].delay += int(hold.Milliseconds())
+
+	first := e.frames[0].bounds
+	out := &pngChunkWriter{w: w}
+	out.write(pngSignature)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(first.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(first.Dy()))
+	ihdr[8], ihdr[9] = 8, 6 // 8-bit RGBA
+	out.chunk("IHDR", ihdr)
+
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(e.frames)))
+	binary.BigEndian.PutUint32(actl[4:], 0) // loop forever
+	out.chunk("acTL", actl)
+
+	var sequence uint32
+	for i, f := range e.frames {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], sequence)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(f.bounds.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(f.bounds.Dy()))
+		binary.BigEndian.PutUint32(fctl[12:], uint32(f.bounds.Min.X-first.Min.X))
+		binary.BigEndian.PutUint32(fctl[16:], uint32(f.bounds.Min.Y-first.Min.Y))
+		binary.BigEndian.PutUint16(fctl[20:], uint16(min(f.delay, 0xffff)))
+		binary.BigEndian.PutUint16(fctl[22:], 1000)
+		fctl[24], fctl[25] = apngDisposeNone, apngBlendSource
+		out.chunk("fcTL", fctl)
+		sequence++
+
+		// The first frame is the image shown without animation support
+		if i == 0 {
+			out.chunk("IDAT", f.data)
+			continue
+		}
+		fdat := make([]byte, 4+len(f.data))
+		binary.BigEndian.PutUint32(fdat, sequence)
+		copy(fdat[4:], f.data)
+		out.chunk("fdAT", fdat)
+		sequence++
+	}
+	out.chunk("IEND", nil)
+	return out.err
+}
+
+// pngChunkWriter writes PNG chunks, keeping the first error.
+type pngChunkWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *pngChunkWriter) write(b []byte) {
+	if c.err == nil {
+		_, c.err = c.w.Write(b)
+	}
+}
+
+// chunk writes a chunk: its length, type, data and the CRC of type and data.
+func (c *pngChunkWriter) chunk(name string, data []byte) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	copy(header[4:], name)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	c.write(header)
+	c.write(data)
+	c.write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+}
@@ -0,0 +1,77 @@
+package hwr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+
+	"github.com/juruen/rmapi/archive"
+	"github.com/juruen/rmapi/encoding/rm"
+	"github.com/unidoc/unipdf/v3/model"
+	"github.com/unidoc/unipdf/v3/render"
+)
+
+// hasDocumentPDF reports whether the pages of a document are drawn over a
+// PDF, see LoadZip.
+func hasDocumentPDF(zip *archive.Zip) bool {
+	return bytes.HasPrefix(zip.Payload, []byte("%PDF"))
+}
+
+// drawnOverDocument reports whether a page is drawn over its page of the
+// document PDF with config.Background.
+func drawnOverDocument(zip *archive.Zip, page archive.Page, config VisualizationConfig) bool {
+	return config.Background && hasDocumentPDF(zip) && page.DocPage >= 0
+}
+
+// openDocumentPDF opens the PDF of an annotated document, decrypting it if it
+// only has an owner password.
+func openDocumentPDF(data []byte) (*model.PdfReader, error) {
+	reader, err := model.NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if encrypted, err := reader.IsEncrypted(); err != nil {
+		return nil, err
+	} else if encrypted {
+		if ok, err := reader.Decrypt(nil); err != nil || !ok {
+			return nil, fmt.Errorf("PDF is encrypted")
+		}
+	}
+	return reader, nil
+}
+
+// documentScale returns the size of a device pixel in units of a document
+// page, as the device fits the page to its screen.
+func documentScale(box model.PdfRectangle) float64 {
+	if box.Height()/box.Width() > float64(rm.Height)/float64(rm.Width) {
+		return box.Height() / float64(rm.Height)
+	}
+	return box.Width() / float64(rm.Width)
+}
+
+// rasterizeDocumentPage renders page (0-indexed) of a document PDF at the
+// given width, and returns it with the scale from device to image
+// coordinates.
+func rasterizeDocumentPage(reader *model.PdfReader, docPage, width int) (*image.RGBA, float32, error) {
+	page, err := reader.GetPage(docPage + 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	box, err := page.GetMediaBox()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	device := render.NewImageDevice()
+	device.OutputWidth = width
+	rendered, err := device.Render(page)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	img := image.NewRGBA(rendered.Bounds().Sub(rendered.Bounds().Min))
+	draw.Draw(img, img.Bounds(), rendered, rendered.Bounds().Min, draw.Src)
+	scale := documentScale(*box) * float64(img.Bounds().Dx()) / box.Width()
+	return img, float32(scale), nil
+}
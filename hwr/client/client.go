@@ -2,17 +2,30 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"time"
 )
 
-const url = "https://cloud.myscript.com/api/v4.0/iink/batch"
+// Endpoint is the MyScript batch API, requests are sent to it.
+var Endpoint = "https://cloud.myscript.com/api/v4.0/iink/batch"
+
+// Observe, if set, is called after every request with the HTTP status
+// (0 if no response was received) and the duration of the request.
+var Observe func(status int, duration time.Duration)
 
 func SendRequest(key, hmackey string, data []byte, mimeType string) (body []byte, err error) {
+	return SendRequestContext(context.Background(), key, hmackey, data, mimeType)
+}
+
+// SendRequestContext is SendRequest, aborted when ctx is done.
+func SendRequestContext(ctx context.Context, key, hmackey string, data []byte, mimeType string) (body []byte, err error) {
 	fullkey := key + hmackey
 	mac := hmac.New(sha512.New, []byte(fullkey))
 	mac.Write(data)
@@ -20,13 +33,24 @@ func SendRequest(key, hmackey string, data []byte, mimeType string) (body []byte
 
 	client := http.Client{}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	req, err := http.NewRequestWithContext(ctx, "POST", Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
 	req.Header.Set("Accept", mimeType+", application/json")
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("applicationKey", key)
 	req.Header.Set("hmac", result)
 
+	started := time.Now()
 	res, err := client.Do(req)
+	if Observe != nil {
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		defer func() { Observe(status, time.Since(started)) }()
+	}
 
 	if err != nil {
 		return
@@ -44,11 +68,8 @@ func SendRequest(key, hmackey string, data []byte, mimeType string) (body []byte
 		return
 	}
 	
-	// Log content type to see what format we actually got
-	contentType := res.Header.Get("Content-Type")
-	if contentType != "" {
-		fmt.Printf("Response Content-Type: %s\n", contentType)
-	}
+	slog.DebugContext(ctx, "MyScript response", "status", res.StatusCode,
+		"content_type", res.Header.Get("Content-Type"), "bytes", len(body), "duration", time.Since(started))
 
 	return body, nil
 }
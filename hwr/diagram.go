@@ -0,0 +1,622 @@
+package hwr
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ddvk/rmapi-hwr/hwr/models"
+)
+
+// Diagram output formats
+const (
+	DiagramFormatSVG     = "svg"     // SVG rendered by MyScript (default)
+	DiagramFormatMermaid = "mermaid" // Mermaid flowchart
+	DiagramFormatDOT     = "dot"     // Graphviz DOT
+	DiagramFormatDrawIO  = "drawio"  // draw.io (diagrams.net) XML
+	DiagramFormatJSON    = "json"    // DiagramGraph as JSON
+)
+
+// mmToPixels converts JIIX millimeters to 96 DPI pixels for draw.io and Graphviz.
+const mmToPixels = 96 / 25.4
+
+// edgeLabelDistance is how far in millimeters free text may be from an edge,
+// beyond half its own size, to be taken for the label of the edge.
+const edgeLabelDistance = 5.0
+
+// diagramExtensions maps the diagram formats to output file extensions.
+var diagramExtensions = map[string]string{
+	DiagramFormatSVG:     ".svg",
+	DiagramFormatMermaid: ".mmd",
+	DiagramFormatDOT:     ".dot",
+	DiagramFormatDrawIO:  ".drawio",
+	DiagramFormatJSON:    ".json",
+}
+
+// DiagramFormats returns the supported diagram output formats.
+func DiagramFormats() []string {
+	formats := make([]string, 0, len(diagramExtensions))
+	for format := range diagramExtensions {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// IsDiagramFormat reports whether format is a supported diagram output format.
+func IsDiagramFormat(format string) bool {
+	_, ok := diagramExtensions[format]
+	return ok
+}
+
+// IsDiagramGraphFormat reports whether format is built from the recognized
+// diagram graph rather than returned by MyScript as is.
+func IsDiagramGraphFormat(format string) bool {
+	_, ok := diagramExtensions[format]
+	return ok && format != DiagramFormatSVG
+}
+
+// DiagramExtension returns the output file extension of a diagram format.
+func DiagramExtension(format string) string {
+	if ext, ok := diagramExtensions[format]; ok {
+		return ext
+	}
+	return diagramExtensions[DiagramFormatSVG]
+}
+
+// EnableDiagramConvert asks MyScript to convert diagram nodes, edges and
+// text, so that the JIIX result describes the recognized graph.
+func EnableDiagramConvert(conf *models.Configuration) {
+	if conf.Diagram == nil {
+		conf.Diagram = &models.DiagramConfiguration{}
+	}
+	conf.Diagram.Convert = &models.DiagramConvertConfiguration{
+		Node: true,
+		Edge: true,
+		Text: true,
+	}
+}
+
+// BoundingBox is a JIIX bounding box, in millimeters.
+type BoundingBox struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+func (b BoundingBox) contains(x, y float64) bool {
+	return x >= b.X && x <= b.X+b.Width && y >= b.Y && y <= b.Y+b.Height
+}
+
+func (b BoundingBox) center() (float64, float64) {
+	return b.X + b.Width/2, b.Y + b.Height/2
+}
+
+// DiagramNode is a shape of a recognized diagram.
+type DiagramNode struct {
+	ID    string      `json:"id"`
+	Kind  string      `json:"kind"` // rectangle, ellipse, circle, rhombus, ..., text for free text
+	Label string      `json:"label,omitempty"`
+	Box   BoundingBox `json:"boundingBox"`
+}
+
+// DiagramEdge is a connector between two nodes of a recognized diagram.
+type DiagramEdge struct {
+	ID         string `json:"id"`
+	Kind       string `json:"kind"` // line, arc, polyedge
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Label      string `json:"label,omitempty"`
+	ArrowStart bool   `json:"arrowStart,omitempty"`
+	ArrowEnd   bool   `json:"arrowEnd,omitempty"`
+}
+
+// DiagramGraph is the graph model of a recognized diagram.
+type DiagramGraph struct {
+	Nodes []DiagramNode `json:"nodes"`
+	Edges []DiagramEdge `json:"edges"`
+}
+
+// jiixElement is the subset of a JIIX diagram element used to build the graph.
+type jiixElement struct {
+	Type         string            `json:"type"`
+	Kind         string            `json:"kind"`
+	ID           json.RawMessage   `json:"id"`
+	Parent       json.RawMessage   `json:"parent"`
+	Label        string            `json:"label"`
+	BoundingBox  *BoundingBox      `json:"bounding-box"`
+	X1           *float64          `json:"x1"`
+	Y1           *float64          `json:"y1"`
+	X2           *float64          `json:"x2"`
+	Y2           *float64          `json:"y2"`
+	CX           *float64          `json:"cx"`
+	CY           *float64          `json:"cy"`
+	RX           float64           `json:"rx"`
+	RY           float64           `json:"ry"`
+	StartAngle   float64           `json:"startAngle"`
+	SweepAngle   float64           `json:"sweepAngle"`
+	Connected    []json.RawMessage `json:"connected"`
+	P1Decoration string            `json:"p1Decoration"`
+	P2Decoration string            `json:"p2Decoration"`
+	Edges        []jiixElement     `json:"edges"`
+	Elements     []jiixElement     `json:"elements"`
+	Children     []jiixElement     `json:"children"`
+}
+
+// ParseDiagramJiix builds the graph of a JIIX diagram result. Text elements
+// become the label of their parent node or edge, of the node containing
+// them, or of the edge next to them; other text becomes a node of kind text.
+// Elements without a JIIX ID get one prefixed by n for nodes and e for edges.
+func ParseDiagramJiix(data []byte) (*DiagramGraph, error) {
+	var root jiixElement
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("can't parse JIIX: %w", err)
+	}
+	if root.Type != "" && !strings.EqualFold(root.Type, "Diagram") {
+		return nil, fmt.Errorf("not a diagram result: %s", root.Type)
+	}
+
+	// generated IDs skip the IDs of the JIIX
+	used := make(map[string]bool)
+	var collect func([]jiixElement)
+	collect = func(list []jiixElement) {
+		for _, e := range list {
+			if id := jiixID(e.ID); id != "" {
+				used[id] = true
+			}
+			collect(e.Children)
+			collect(e.Elements)
+		}
+	}
+	collect(root.Elements)
+	generateID := func(prefix string, index int) json.RawMessage {
+		for used[fmt.Sprintf("%s%d", prefix, index)] {
+			index++
+		}
+		id := fmt.Sprintf("%s%d", prefix, index)
+		used[id] = true
+		return json.RawMessage(strconv.Quote(id))
+	}
+
+	// nested elements are flattened, text nested in a node or an edge gets it
+	// as parent
+	var elements []jiixElement
+	nodes, edges := 0, 0
+	var flatten func([]jiixElement, json.RawMessage)
+	flatten = func(list []jiixElement, parent json.RawMessage) {
+		for _, e := range list {
+			if len(e.Parent) == 0 {
+				e.Parent = parent
+			}
+			var childParent json.RawMessage
+			switch {
+			case strings.EqualFold(e.Type, "Node"):
+				if jiixID(e.ID) == "" {
+					e.ID = generateID("n", nodes)
+				}
+				nodes++
+				childParent = e.ID
+			case strings.EqualFold(e.Type, "Edge"):
+				if jiixID(e.ID) == "" {
+					e.ID = generateID("e", edges)
+				}
+				edges++
+				childParent = e.ID
+			}
+			elements = append(elements, e)
+			flatten(e.Children, childParent)
+			flatten(e.Elements, childParent)
+		}
+	}
+	flatten(root.Elements, nil)
+
+	graph := &DiagramGraph{
+		Nodes: []DiagramNode{},
+		Edges: []DiagramEdge{},
+	}
+	nodeIndex := make(map[string]int)
+	for _, e := range elements {
+		if !strings.EqualFold(e.Type, "Node") {
+			continue
+		}
+		node := DiagramNode{
+			ID:   jiixID(e.ID),
+			Kind: e.Kind,
+		}
+		if e.BoundingBox != nil {
+			node.Box = *e.BoundingBox
+		}
+		nodeIndex[node.ID] = len(graph.Nodes)
+		graph.Nodes = append(graph.Nodes, node)
+	}
+	shapes := len(graph.Nodes)
+
+	edgeIndex := make(map[string]int)
+	var edgePaths [][][2]float64
+	for _, e := range elements {
+		if !strings.EqualFold(e.Type, "Edge") {
+			continue
+		}
+		edge := DiagramEdge{
+			ID:         jiixID(e.ID),
+			Kind:       e.Kind,
+			ArrowStart: isArrow(e.P1Decoration),
+			ArrowEnd:   isArrow(e.P2Decoration),
+		}
+		// polyedges carry the decorations on their first and last segments
+		if len(e.Edges) > 0 {
+			edge.ArrowStart = edge.ArrowStart || isArrow(e.Edges[0].P1Decoration)
+			edge.ArrowEnd = edge.ArrowEnd || isArrow(e.Edges[len(e.Edges)-1].P2Decoration)
+		}
+
+		ends := make([]string, 0, 2)
+		for _, raw := range e.Connected {
+			if id := jiixID(raw); id != "" {
+				if _, ok := nodeIndex[id]; ok {
+					ends = append(ends, id)
+				}
+			}
+		}
+		// dangling ends get a point node so that every edge has two ends
+		for len(ends) < 2 {
+			point := DiagramNode{
+				ID:   fmt.Sprintf("%s_end%d", edge.ID, len(ends)+1),
+				Kind: "point",
+			}
+			nodeIndex[point.ID] = len(graph.Nodes)
+			graph.Nodes = append(graph.Nodes, point)
+			ends = append(ends, point.ID)
+		}
+		edge.From, edge.To = ends[0], ends[len(ends)-1]
+		edgeIndex[edge.ID] = len(graph.Edges)
+		graph.Edges = append(graph.Edges, edge)
+		edgePaths = append(edgePaths, edgePath(e))
+	}
+
+	for _, e := range elements {
+		if !strings.EqualFold(e.Type, "Text") || strings.TrimSpace(e.Label) == "" {
+			continue
+		}
+		node, edge := -1, -1
+		if parent := jiixID(e.Parent); parent != "" {
+			if i, ok := nodeIndex[parent]; ok {
+				node = i
+			} else if i, ok := edgeIndex[parent]; ok {
+				edge = i
+			}
+		}
+		if node < 0 && edge < 0 && e.BoundingBox != nil {
+			x, y := e.BoundingBox.center()
+			node = smallestNodeContaining(graph.Nodes[:shapes], x, y)
+			if node < 0 {
+				edge = nearestEdge(edgePaths, *e.BoundingBox)
+			}
+		}
+		switch {
+		case node >= 0:
+			graph.Nodes[node].Label = joinLabel(graph.Nodes[node].Label, e.Label)
+		case edge >= 0:
+			graph.Edges[edge].Label = joinLabel(graph.Edges[edge].Label, e.Label)
+		default:
+			if jiixID(e.ID) == "" {
+				e.ID = generateID("n", len(graph.Nodes))
+			}
+			text := DiagramNode{
+				ID:    jiixID(e.ID),
+				Kind:  "text",
+				Label: e.Label,
+			}
+			if e.BoundingBox != nil {
+				text.Box = *e.BoundingBox
+			}
+			graph.Nodes = append(graph.Nodes, text)
+		}
+	}
+
+	return graph, nil
+}
+
+func joinLabel(label, text string) string {
+	return strings.TrimSpace(strings.Join([]string{label, text}, " "))
+}
+
+// edgePath returns the points of an edge: the ends of a line, the segments
+// of a polyedge, points along an arc, or the corners of its bounding box
+// when it has no geometry.
+func edgePath(e jiixElement) [][2]float64 {
+	switch {
+	case e.X1 != nil && e.Y1 != nil && e.X2 != nil && e.Y2 != nil:
+		return [][2]float64{{*e.X1, *e.Y1}, {*e.X2, *e.Y2}}
+	case len(e.Edges) > 0:
+		var path [][2]float64
+		for _, segment := range e.Edges {
+			path = append(path, edgePath(segment)...)
+		}
+		return path
+	case e.CX != nil && e.CY != nil:
+		const steps = 16
+		path := make([][2]float64, 0, steps+1)
+		for i := 0; i <= steps; i++ {
+			angle := e.StartAngle + e.SweepAngle*float64(i)/steps
+			path = append(path, [2]float64{*e.CX + e.RX*math.Cos(angle), *e.CY + e.RY*math.Sin(angle)})
+		}
+		return path
+	case e.BoundingBox != nil:
+		b := e.BoundingBox
+		return [][2]float64{{b.X, b.Y}, {b.X + b.Width, b.Y}, {b.X + b.Width, b.Y + b.Height}, {b.X, b.Y + b.Height}, {b.X, b.Y}}
+	}
+	return nil
+}
+
+// nearestEdge returns the index of the edge closest to the center of a text
+// box, within edgeLabelDistance of the box, or -1.
+func nearestEdge(paths [][][2]float64, box BoundingBox) int {
+	x, y := box.center()
+	best, bestDistance := -1, math.Hypot(box.Width, box.Height)/2+edgeLabelDistance
+	for i, path := range paths {
+		for j := range path {
+			a, b := path[j], path[min(j+1, len(path)-1)]
+			if d := segmentDistance(x, y, a, b); d <= bestDistance {
+				best, bestDistance = i, d
+			}
+		}
+	}
+	return best
+}
+
+// segmentDistance returns the distance from a point to the segment a-b.
+func segmentDistance(x, y float64, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t := 0.0
+	if length := dx*dx + dy*dy; length > 0 {
+		t = math.Max(0, math.Min(1, ((x-a[0])*dx+(y-a[1])*dy)/length))
+	}
+	return math.Hypot(x-(a[0]+t*dx), y-(a[1]+t*dy))
+}
+
+// Export renders the graph in one of the diagram graph formats.
+func (g *DiagramGraph) Export(format string) (string, error) {
+	switch format {
+	case DiagramFormatMermaid:
+		return g.Mermaid(), nil
+	case DiagramFormatDOT:
+		return g.DOT(), nil
+	case DiagramFormatDrawIO:
+		return g.DrawIO(), nil
+	case DiagramFormatJSON:
+		js, err := json.MarshalIndent(g, "", "  ")
+		return string(js), err
+	default:
+		return "", fmt.Errorf("unsupported diagram format: %s", format)
+	}
+}
+
+// Mermaid renders the graph as a Mermaid flowchart.
+func (g *DiagramGraph) Mermaid() string {
+	var sb strings.Builder
+	sb.WriteString("flowchart TD\n")
+	for _, n := range g.Nodes {
+		label := strings.NewReplacer(`"`, "#quot;", "\n", "<br/>").Replace(n.Label)
+		open, close := mermaidShape(n.Kind)
+		if n.Kind == "point" {
+			sb.WriteString(fmt.Sprintf("    %s(( ))\n", mermaidID(n.ID)))
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("    %s%s\"%s\"%s\n", mermaidID(n.ID), open, label, close))
+	}
+	for _, e := range g.Edges {
+		from, to := e.From, e.To
+		arrow := "---"
+		switch {
+		case e.ArrowStart && e.ArrowEnd:
+			arrow = "<-->"
+		case e.ArrowEnd:
+			arrow = "-->"
+		case e.ArrowStart:
+			// mermaid has no start-only arrow, reverse the edge
+			from, to = to, from
+			arrow = "-->"
+		}
+		if e.Label != "" {
+			arrow += fmt.Sprintf("|\"%s\"|", strings.NewReplacer(`"`, "#quot;", "\n", "<br/>").Replace(e.Label))
+		}
+		sb.WriteString(fmt.Sprintf("    %s %s %s\n", mermaidID(from), arrow, mermaidID(to)))
+	}
+	return sb.String()
+}
+
+// DOT renders the graph in Graphviz DOT, pinning nodes to their position on the page.
+func (g *DiagramGraph) DOT() string {
+	var sb strings.Builder
+	sb.WriteString("digraph diagram {\n")
+	sb.WriteString("    node [fontname=\"Helvetica\"];\n")
+	for _, n := range g.Nodes {
+		x, y := n.Box.center()
+		sb.WriteString(fmt.Sprintf("    %s [label=%s, shape=%s, pos=\"%.1f,%.1f!\"];\n",
+			strconv.Quote(n.ID), strconv.Quote(n.Label), dotShape(n.Kind), x*mmToPixels*0.75, -y*mmToPixels*0.75))
+	}
+	for _, e := range g.Edges {
+		dir := "none"
+		switch {
+		case e.ArrowStart && e.ArrowEnd:
+			dir = "both"
+		case e.ArrowEnd:
+			dir = "forward"
+		case e.ArrowStart:
+			dir = "back"
+		}
+		label := ""
+		if e.Label != "" {
+			label = ", label=" + strconv.Quote(e.Label)
+		}
+		sb.WriteString(fmt.Sprintf("    %s -> %s [dir=%s%s];\n", strconv.Quote(e.From), strconv.Quote(e.To), dir, label))
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// DrawIO renders the graph as an uncompressed draw.io (diagrams.net) file.
+func (g *DiagramGraph) DrawIO() string {
+	var sb strings.Builder
+	sb.WriteString(`<mxfile host="rmapi-hwr">` + "\n")
+	sb.WriteString(`  <diagram id="diagram" name="Page-1">` + "\n")
+	sb.WriteString(`    <mxGraphModel><root>` + "\n")
+	sb.WriteString(`      <mxCell id="0"/>` + "\n")
+	sb.WriteString(`      <mxCell id="1" parent="0"/>` + "\n")
+	for _, n := range g.Nodes {
+		width, height := n.Box.Width*mmToPixels, n.Box.Height*mmToPixels
+		if n.Kind == "point" {
+			width, height = 1, 1
+		}
+		sb.WriteString(fmt.Sprintf(`      <mxCell id="n%s" value="%s" style="%s" vertex="1" parent="1">`,
+			xmlEscape(n.ID), xmlEscape(n.Label), drawIOStyle(n.Kind)) + "\n")
+		sb.WriteString(fmt.Sprintf(`        <mxGeometry x="%.1f" y="%.1f" width="%.1f" height="%.1f" as="geometry"/>`,
+			n.Box.X*mmToPixels, n.Box.Y*mmToPixels, width, height) + "\n")
+		sb.WriteString("      </mxCell>\n")
+	}
+	for _, e := range g.Edges {
+		startArrow, endArrow := "none", "none"
+		if e.ArrowStart {
+			startArrow = "classic"
+		}
+		if e.ArrowEnd {
+			endArrow = "classic"
+		}
+		sb.WriteString(fmt.Sprintf(`      <mxCell id="e%s" value="%s" style="html=1;startArrow=%s;endArrow=%s;" edge="1" parent="1" source="n%s" target="n%s">`,
+			xmlEscape(e.ID), xmlEscape(e.Label), startArrow, endArrow, xmlEscape(e.From), xmlEscape(e.To)) + "\n")
+		sb.WriteString(`        <mxGeometry relative="1" as="geometry"/>` + "\n")
+		sb.WriteString("      </mxCell>\n")
+	}
+	sb.WriteString("    </root></mxGraphModel>\n")
+	sb.WriteString("  </diagram>\n")
+	sb.WriteString("</mxfile>\n")
+	return sb.String()
+}
+
+// formatDiagram converts a JIIX diagram result to a graph format.
+func formatDiagram(data []byte, format string) (string, error) {
+	graph, err := ParseDiagramJiix(data)
+	if err != nil {
+		return "", err
+	}
+	return graph.Export(format)
+}
+
+// jiixID returns a JIIX id (number or string) as a string, or "" when the
+// element has none.
+func jiixID(raw json.RawMessage) string {
+	id := strings.Trim(strings.TrimSpace(string(raw)), `"`)
+	if id == "null" {
+		return ""
+	}
+	return id
+}
+
+// jiixIDOr returns a JIIX id as jiixID, or prefix and index when the element
+// has none.
+func jiixIDOr(raw json.RawMessage, prefix string, index int) string {
+	if id := jiixID(raw); id != "" {
+		return id
+	}
+	return fmt.Sprintf("%s%d", prefix, index)
+}
+
+// smallestNodeContaining returns the index of the smallest node containing the point, or -1.
+func smallestNodeContaining(nodes []DiagramNode, x, y float64) int {
+	best := -1
+	for i, n := range nodes {
+		if !n.Box.contains(x, y) {
+			continue
+		}
+		if best < 0 || n.Box.Width*n.Box.Height < nodes[best].Box.Width*nodes[best].Box.Height {
+			best = i
+		}
+	}
+	return best
+}
+
+func isArrow(decoration string) bool {
+	return strings.Contains(strings.ToLower(decoration), "arrow")
+}
+
+func mermaidID(id string) string {
+	return "n" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, id)
+}
+
+func mermaidShape(kind string) (string, string) {
+	switch kind {
+	case "ellipse", "circle":
+		return "((", "))"
+	case "rhombus":
+		return "{", "}"
+	case "parallelogram":
+		return "[/", "/]"
+	case "rounded-rectangle":
+		return "(", ")"
+	default:
+		return "[", "]"
+	}
+}
+
+func dotShape(kind string) string {
+	switch kind {
+	case "ellipse":
+		return "ellipse"
+	case "circle":
+		return "circle"
+	case "rhombus":
+		return "diamond"
+	case "triangle":
+		return "triangle"
+	case "parallelogram":
+		return "parallelogram"
+	case "polygon":
+		return "polygon"
+	case "text":
+		return "plaintext"
+	case "point":
+		return "point"
+	default:
+		return "box"
+	}
+}
+
+func drawIOStyle(kind string) string {
+	switch kind {
+	case "ellipse", "circle":
+		return "ellipse;whiteSpace=wrap;html=1;"
+	case "rhombus":
+		return "rhombus;whiteSpace=wrap;html=1;"
+	case "triangle":
+		return "triangle;whiteSpace=wrap;html=1;"
+	case "parallelogram":
+		return "shape=parallelogram;whiteSpace=wrap;html=1;"
+	case "rounded-rectangle":
+		return "rounded=1;whiteSpace=wrap;html=1;"
+	case "text":
+		return "text;html=1;"
+	case "point":
+		return "point;html=1;"
+	default:
+		return "rounded=0;whiteSpace=wrap;html=1;"
+	}
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
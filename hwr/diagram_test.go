@@ -0,0 +1,59 @@
+package hwr
+
+import (
+	"strings"
+	"testing"
+)
+
+const testDiagramJiix = `{"type": "Diagram", "elements": [
+	{"id": 1, "type": "Node", "kind": "rectangle", "bounding-box": {"x": 10, "y": 10, "width": 40, "height": 20}},
+	{"id": 2, "type": "Node", "kind": "rhombus", "bounding-box": {"x": 10, "y": 60, "width": 40, "height": 20}},
+	{"id": 3, "type": "Edge", "kind": "line", "connected": [1, 2], "x1": 30, "y1": 30, "x2": 30, "y2": 60, "p2Decoration": "arrow-head"},
+	{"id": 4, "type": "Text", "label": "Start", "bounding-box": {"x": 15, "y": 15, "width": 20, "height": 8}},
+	{"id": 5, "type": "Text", "label": "yes", "bounding-box": {"x": 32, "y": 40, "width": 8, "height": 5}},
+	{"id": 6, "type": "Text", "label": "note", "bounding-box": {"x": 100, "y": 100, "width": 20, "height": 8}},
+	{"type": "Edge", "kind": "line", "x1": 100, "y1": 10, "x2": 150, "y2": 10, "elements": [
+		{"type": "Text", "label": "loop", "bounding-box": {"x": 300, "y": 300, "width": 10, "height": 5}}
+	]},
+	{"id": "n0", "type": "Node", "kind": "circle", "bounding-box": {"x": 200, "y": 10, "width": 10, "height": 10}},
+	{"type": "Node", "kind": "ellipse", "bounding-box": {"x": 200, "y": 60, "width": 10, "height": 10}}
+]}`
+
+func TestParseDiagramJiix(t *testing.T) {
+	graph, err := ParseDiagramJiix([]byte(testDiagramJiix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := make(map[string]string)
+	for _, n := range graph.Nodes {
+		if labels[n.ID] != "" {
+			t.Errorf("node ID %s is used twice", n.ID)
+		}
+		labels[n.ID] = n.Kind + ":" + n.Label
+	}
+	for _, e := range graph.Edges {
+		if labels[e.ID] != "" {
+			t.Errorf("edge ID %s is used by a node", e.ID)
+		}
+		labels[e.ID] = e.Kind + ":" + e.Label
+	}
+
+	for id, want := range map[string]string{
+		"1":  "rectangle:Start",
+		"3":  "line:yes",  // next to the edge
+		"e1": "line:loop", // nested in the edge
+		"6":  "text:note",
+		"n0": "circle:",
+		"n3": "ellipse:", // the fourth node
+	} {
+		if labels[id] != want {
+			t.Errorf("%s is %q, want %q", id, labels[id], want)
+		}
+	}
+
+	mermaid := graph.Mermaid()
+	if !strings.Contains(mermaid, `n1 -->|"yes"| n2`) {
+		t.Errorf("mermaid has no edge label:\n%s", mermaid)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"strings"
 
@@ -52,6 +53,11 @@ type RawExtractedPoint struct {
 // OutputRawExtractedData outputs the raw extracted data structure from rmapi
 // before it's converted to MyScript format
 func OutputRawExtractedData(zip *archive.Zip, pageNumber int, outputFile string) error {
+	return OutputRawExtractedDataContext(context.Background(), zip, pageNumber, outputFile)
+}
+
+// OutputRawExtractedDataContext is OutputRawExtractedData, logging with ctx.
+func OutputRawExtractedDataContext(ctx context.Context, zip *archive.Zip, pageNumber int, outputFile string) error {
 	numPages := len(zip.Pages)
 	
 	if pageNumber >= numPages || pageNumber < 0 {
@@ -118,19 +124,19 @@ func OutputRawExtractedData(zip *archive.Zip, pageNumber int, outputFile string)
 		return fmt.Errorf("can't write output file: %w", err)
 	}
 	
-	log.Printf("Page %d: Raw extracted data saved to %s", pageNumber, outputFile)
-	log.Printf("Page %d: Version=%d, Layers=%d, TotalLines=%d, TotalPoints=%d",
-		pageNumber,
-		rawData.Version,
-		len(rawData.Layers),
-		func() int {
+	slog.InfoContext(ctx, "Raw extracted data saved", "page", pageNumber, "file", outputFile)
+	slog.DebugContext(ctx, "Raw extracted data",
+		"page", pageNumber,
+		"version", rawData.Version,
+		"layers", len(rawData.Layers),
+		"lines", func() int {
 			total := 0
 			for _, layer := range rawData.Layers {
 				total += len(layer.Lines)
 			}
 			return total
 		}(),
-		func() int {
+		"points", func() int {
 			total := 0
 			for _, layer := range rawData.Layers {
 				for _, line := range layer.Lines {
@@ -155,9 +161,16 @@ type Config struct {
 	BatchSize      int64
 	DebugRawData   bool // Output raw extracted data before conversion
 	SplitPages     bool // Output each page to a separate file
+	Resources      ResourceSet // Custom lexicons and math grammars, per language
+	Profile        *models.Configuration // Base recognition configuration, nil for MyScript defaults
+	PageLangs      map[int]string // Language per page (0-indexed), overrides Lang
+	DetectLangs    []string // Candidate languages probed for pages without a PageLangs entry
+	DiagramFormat  string // Diagram output: svg (default), mermaid, dot, drawio or json
+	DebugOverlay   bool // Draw the recognized words over each page (saves to <filename>_page_<N>_overlay.png)
+	Overlay        VisualizationConfig // Rendering of the DebugOverlay images, DefaultVisualizationConfig() if zero
 }
 
-func getJson(zip *archive.Zip, contenttype string, lang string, pageNumber int) (r []byte, err error) {
+func getJson(ctx context.Context, zip *archive.Zip, contenttype string, conf *models.Configuration, pageNumber int) (r []byte, err error) {
 	numPages := len(zip.Pages)
 
 	if pageNumber >= numPages || pageNumber < 0 {
@@ -166,9 +179,7 @@ func getJson(zip *archive.Zip, contenttype string, lang string, pageNumber int)
 	}
 
 	batch := models.BatchInput{
-		Configuration: &models.Configuration{
-			Lang: lang,
-		},
+		Configuration: conf,
 		StrokeGroups: []*models.StrokeGroup{
 			&models.StrokeGroup{},
 		},
@@ -187,7 +198,7 @@ func getJson(zip *archive.Zip, contenttype string, lang string, pageNumber int)
 		return nil, NoContent
 	}
 
-	log.Printf("Page %d: Found %d layers", pageNumber, len(page.Data.Layers))
+	slog.DebugContext(ctx, "Building batch input", "page", pageNumber, "layers", len(page.Data.Layers))
 	totalLines := 0
 	totalPoints := 0
 	
@@ -254,8 +265,8 @@ func getJson(zip *archive.Zip, contenttype string, lang string, pageNumber int)
 		}
 	}
 	
-	log.Printf("Page %d: Processed %d lines with %d total points, created %d strokes", 
-		pageNumber, totalLines, totalPoints, len(sg.Strokes))
+	slog.DebugContext(ctx, "Processed lines", "page", pageNumber,
+		"lines", totalLines, "points", totalPoints, "strokes", len(sg.Strokes))
 
 	// Debug: Log coordinate ranges
 	if len(sg.Strokes) > 0 {
@@ -273,8 +284,9 @@ func getJson(zip *archive.Zip, contenttype string, lang string, pageNumber int)
 				}
 			}
 		}
-		log.Printf("Page %d: Coordinate ranges - X: [%.2f, %.2f], Y: [%.2f, %.2f], Canvas: [%d, %d]", 
-			pageNumber, minX, maxX, minY, maxY, batch.Width, batch.Height)
+		slog.DebugContext(ctx, "Coordinate ranges", "page", pageNumber,
+			"min_x", minX, "max_x", maxX, "min_y", minY, "max_y", maxY,
+			"canvas_width", batch.Width, "canvas_height", batch.Height)
 	}
 
 	r, err = batch.MarshalBinary()
@@ -286,7 +298,7 @@ func getJson(zip *archive.Zip, contenttype string, lang string, pageNumber int)
 	if pageNumber == 0 {
 		debugFile := fmt.Sprintf("/tmp/hwr_debug_page_%d.json", pageNumber)
 		if err := os.WriteFile(debugFile, r, 0644); err == nil {
-			log.Printf("Page %d: Saved request JSON to %s for debugging", pageNumber, debugFile)
+			slog.DebugContext(ctx, "Saved request JSON for debugging", "page", pageNumber, "file", debugFile)
 		}
 	}
 	
@@ -294,6 +306,11 @@ func getJson(zip *archive.Zip, contenttype string, lang string, pageNumber int)
 }
 
 func Hwr(zip *archive.Zip, cfg Config) {
+	HwrContext(context.Background(), zip, cfg)
+}
+
+// HwrContext is Hwr, logging with ctx and aborting the requests when ctx is done.
+func HwrContext(ctx context.Context, zip *archive.Zip, cfg Config) {
 	// If debug mode is enabled, output raw extracted data before conversion
 	if cfg.DebugRawData {
 		capacity := 1
@@ -313,8 +330,8 @@ func Hwr(zip *archive.Zip, cfg Config) {
 
 		for p := start; p <= end; p++ {
 			outputFile := fmt.Sprintf("%s_raw_page_%d.json", cfg.OutputFile, p)
-			if err := OutputRawExtractedData(zip, p, outputFile); err != nil {
-				log.Printf("Warning: Failed to output raw data for page %d: %v", p, err)
+			if err := OutputRawExtractedDataContext(ctx, zip, p, outputFile); err != nil {
+				slog.WarnContext(ctx, "Failed to output raw data", "page", p, "err", err)
 			}
 		}
 		return
@@ -345,18 +362,61 @@ func Hwr(zip *archive.Zip, cfg Config) {
 	result := make([][]byte, len(zip.Pages))
 
 	contenttype, output := setContentType(cfg.InputType)
+	// graph formats are built from the JIIX result instead of MyScript's SVG
+	diagramGraph := contenttype == "Diagram" && IsDiagramGraphFormat(cfg.DiagramFormat)
+	if diagramGraph {
+		output = jiixMimeType
+	}
+	if len(cfg.DetectLangs) > 0 && contenttype != "Text" {
+		slog.WarnContext(ctx, "Language detection only applies to text", "lang", cfg.Lang)
+	}
+	// the overlay is drawn from the words of a JIIX result, still written as text
+	overlay := cfg.DebugOverlay
+	if overlay && contenttype != "Text" && contenttype != RawContentType {
+		slog.WarnContext(ctx, "Debug overlay only applies to text and raw content", "type", contenttype)
+		overlay = false
+	}
+	if overlay {
+		output = jiixMimeType
+	}
 
-	ctx := context.TODO()
 	sem := semaphore.NewWeighted(cfg.BatchSize)
 	for p := start; p <= end; p++ {
-		log.Println("Page: ", p)
+		slog.DebugContext(ctx, "Queuing page", "page", p)
 		if err := sem.Acquire(ctx, 1); err != nil {
-			log.Printf("Failed to acquire semaphore: %v", err)
+			slog.ErrorContext(ctx, "Failed to acquire semaphore", "err", err)
 			break
 		}
 		go func(p int) {
 			defer sem.Release(1)
-			js, err := getJson(zip, contenttype, cfg.Lang, p)
+			lang := cfg.LangForPage(p)
+			if _, explicit := cfg.PageLangs[p]; !explicit && len(cfg.DetectLangs) > 0 && contenttype == "Text" {
+				detected, probe, err := DetectLanguageContext(ctx, zip, p, cfg.DetectLangs, cfg.Profile, cfg.Resources, applicationKey, hmacKey)
+				switch {
+				case errors.Is(err, ErrLanguageUndetected):
+					slog.InfoContext(ctx, "Using the page language", "page", p, "lang", lang)
+				case err != nil:
+					log.Fatalf("Can't detect language of page: %d %v\n", p, err)
+				default:
+					slog.InfoContext(ctx, "Detected language", "page", p, "lang", detected)
+					lang = detected
+					// the probe already is a text recognition in that language
+					if !overlay && (output == "text/plain" || output == jiixMimeType) {
+						result[p] = probe
+						slog.InfoContext(ctx, "Converted page", "page", p)
+						return
+					}
+				}
+			}
+
+			conf := NewConfiguration(cfg.Profile, contenttype, lang, cfg.Resources.For(lang))
+			if diagramGraph {
+				EnableDiagramConvert(conf)
+			}
+			if overlay {
+				EnableOverlayExport(conf)
+			}
+			js, err := getJson(ctx, zip, contenttype, conf, p)
 			if err != nil {
 				log.Fatalf("Can't get page: %d %v\n", p, err)
 			}
@@ -378,19 +438,19 @@ func Hwr(zip *archive.Zip, cfg Config) {
 						}
 					}
 				}
-				log.Printf("Page %d: Prepared JSON with %d stroke groups, %d total strokes, max %d points per stroke", 
-					p, len(debugBatch.StrokeGroups), totalStrokes, totalPoints)
+				slog.DebugContext(ctx, "Prepared batch input", "page", p,
+					"stroke_groups", len(debugBatch.StrokeGroups), "strokes", totalStrokes, "max_points", totalPoints)
 				if totalStrokes == 0 {
-					log.Printf("WARNING: Page %d has no strokes! JSON size: %d bytes", p, len(js))
+					slog.WarnContext(ctx, "Page has no strokes", "page", p, "bytes", len(js))
 				}
 			}
 			
-			log.Println("sending request: ", p)
+			slog.DebugContext(ctx, "Sending request", "page", p)
 
-			body, err := client.SendRequest(applicationKey, hmacKey, js, output)
+			body, err := client.SendRequestContext(ctx, applicationKey, hmacKey, js, output)
 			if err != nil {
 				if body != nil {
-					log.Println(string(body))
+					slog.ErrorContext(ctx, "Recognition failed", "page", p, "response", string(body))
 				}
 				log.Fatal(err)
 			}
@@ -398,61 +458,109 @@ func Hwr(zip *archive.Zip, cfg Config) {
 			// Debug: Log response info
 			if len(body) > 0 {
 				previewLen := min(200, len(body))
-				log.Printf("Page %d: Received response (%d bytes), first %d chars: %q", 
-					p, len(body), previewLen, string(body[:previewLen]))
+				slog.DebugContext(ctx, "Received response", "page", p,
+					"bytes", len(body), "preview", string(body[:previewLen]))
 				if len(body) > 0 && body[0] == '{' {
-					log.Printf("Page %d: Response appears to be JSON (Jiix format)", p)
+					slog.DebugContext(ctx, "Response appears to be JSON (Jiix format)", "page", p)
 					// Try to pretty print first part of JSON
 					var jsonPreview map[string]interface{}
 					if err := json.Unmarshal(body, &jsonPreview); err == nil {
 						keys := getMapKeys(jsonPreview)
-						log.Printf("Page %d: JSON keys: %v", p, keys)
+						slog.DebugContext(ctx, "Response JSON keys", "page", p, "keys", keys)
 					}
 				} else {
-					log.Printf("Page %d: Response appears to be plain text (content: %q)", p, string(body))
+					slog.DebugContext(ctx, "Response appears to be plain text", "page", p)
 				}
 			} else {
-				log.Printf("Page %d: Received empty response!", p)
+				slog.WarnContext(ctx, "Received empty response", "page", p)
 			}
 			
 			result[p] = body
-			log.Println("converted page ", p)
+			slog.InfoContext(ctx, "Converted page", "page", p)
 		}(p)
 	}
-	log.Println("wating for all to finish")
+	slog.DebugContext(ctx, "Waiting for all pages to finish")
 	if err := sem.Acquire(ctx, cfg.BatchSize); err != nil {
-		log.Printf("Failed to acquire semaphore: %v", err)
+		slog.ErrorContext(ctx, "Failed to acquire semaphore", "err", err)
+	}
+
+	if overlay {
+		overlayConfig := cfg.Overlay
+		if overlayConfig.OutputWidth == 0 {
+			overlayConfig = DefaultVisualizationConfig()
+		}
+		for pageNum, c := range result {
+			if len(c) == 0 {
+				continue
+			}
+			outputFile := fmt.Sprintf("%s_page_%d_overlay.png", cfg.OutputFile, pageNum)
+			if err := VisualizeOverlay(ctx, zip, pageNum, c, outputFile, overlayConfig); err != nil {
+				slog.ErrorContext(ctx, "Can't draw the recognition overlay", "page", pageNum, "err", err)
+				continue
+			}
+			slog.InfoContext(ctx, "Saved recognition overlay", "page", pageNum, "file", outputFile)
+		}
+	}
+
+	formatPage := func(c []byte) string {
+		if contenttype == RawContentType {
+			text, err := FormatRawContent(c)
+			if err == nil {
+				return text
+			}
+			slog.WarnContext(ctx, "Can't classify raw content", "err", err)
+		}
+		if diagramGraph {
+			text, err := formatDiagram(c, cfg.DiagramFormat)
+			if err == nil {
+				return text
+			}
+			slog.WarnContext(ctx, "Can't convert diagram", "format", cfg.DiagramFormat, "err", err)
+		}
+		return extractTextFromResponse(ctx, c, output)
+	}
+
+	// diagrams and raw content are standalone documents, always written one file per page
+	perPage := false
+	ext := ".txt"
+	switch contenttype {
+	case "Diagram":
+		perPage = true
+		ext = DiagramExtension(cfg.DiagramFormat)
+	case RawContentType:
+		perPage = true
+		ext = ".json"
 	}
 
 	if cfg.OutputFile == "-" {
-		dump(result, cfg.AddPages)
-	} else if cfg.SplitPages {
+		dump(result, cfg.AddPages, formatPage)
+	} else if cfg.SplitPages || perPage {
 		// Create separate file for each page
-		log.Printf("Split mode: Processing %d pages from result array (size: %d)", len(result), len(result))
+		slog.DebugContext(ctx, "Writing one file per page", "pages", len(result))
 		filesCreated := 0
 		for pageNum, c := range result {
 			if c == nil || len(c) == 0 {
-				log.Printf("Skipping page %d: nil or empty content", pageNum)
+				slog.DebugContext(ctx, "Skipping page without content", "page", pageNum)
 				continue
 			}
-			outputFile := fmt.Sprintf("%s_page_%d.txt", cfg.OutputFile, pageNum)
+			outputFile := fmt.Sprintf("%s_page_%d%s", cfg.OutputFile, pageNum, ext)
 			f, err := os.Create(outputFile)
 			if err != nil {
-				log.Printf("Error creating file %s: %v", outputFile, err)
+				slog.ErrorContext(ctx, "Can't create file", "file", outputFile, "err", err)
 				continue
 			}
-			text := extractTextFromResponse(c, output)
+			text := formatPage(c)
 			f.WriteString(text)
 			f.Close()
 			filesCreated++
-			log.Printf("Page %d: Saved to %s (%d bytes)", pageNum, outputFile, len(text))
+			slog.InfoContext(ctx, "Saved page", "page", pageNum, "file", outputFile, "bytes", len(text))
 		}
-		log.Printf("Split mode: Created %d separate files", filesCreated)
+		slog.InfoContext(ctx, "Created page files", "files", filesCreated)
 	} else {
 		// Single text file with all pages
 		f, err := os.Create(cfg.OutputFile + ".txt")
 		if err != nil {
-			dump(result, cfg.AddPages)
+			dump(result, cfg.AddPages, formatPage)
 			log.Fatal(err)
 		}
 
@@ -463,30 +571,30 @@ func Hwr(zip *archive.Zip, cfg Config) {
 			if cfg.AddPages {
 				f.WriteString(fmt.Sprintf("=== Page %d ===\n", pageNum))
 			}
-			text := extractTextFromResponse(c, output)
+			text := formatPage(c)
 			f.WriteString(text)
 			f.Write([]byte("\n"))
 		}
 		f.Close()
-		log.Printf("All pages saved to %s.txt", cfg.OutputFile)
+		slog.InfoContext(ctx, "Saved all pages", "file", cfg.OutputFile+".txt")
 	}
 }
 
-func dump(result [][]byte, addPages bool) {
+func dump(result [][]byte, addPages bool, formatPage func([]byte) string) {
 	for p, c := range result {
 		if addPages {
 			fmt.Printf("=== Page %d ===\n", p)
 
 		}
-		// Try to extract text from response (might be Jiix JSON)
-		text := extractTextFromResponse(c, "text/plain")
+		// Extract text from response (might be Jiix JSON) or convert the diagram
+		text := formatPage(c)
 		fmt.Println(text)
 	}
 }
 
 // extractTextFromResponse extracts text from HWR API response
 // The response might be plain text or Jiix JSON format
-func extractTextFromResponse(data []byte, expectedMimeType string) string {
+func extractTextFromResponse(ctx context.Context, data []byte, expectedMimeType string) string {
 	if len(data) == 0 {
 		return ""
 	}
@@ -496,13 +604,13 @@ func extractTextFromResponse(data []byte, expectedMimeType string) string {
 	
 	// Check if response is JSON (Jiix format) - look for JSON start
 	if len(data) > 0 && (data[0] == '{' || data[0] == '[') {
-		text := extractTextFromJiix(data)
+		text := extractTextFromJiix(ctx, data)
 		if text != string(data) {
 			// Successfully extracted text from JSON
 			return text
 		}
 		// If extraction failed, try to parse as JSON anyway
-		log.Printf("Warning: Failed to extract text from JSON, trying direct parse")
+		slog.WarnContext(ctx, "Failed to extract text from JSON, trying direct parse")
 	}
 
 	// If it's supposed to be plain text, return as-is
@@ -522,11 +630,11 @@ func min(a, b int) int {
 }
 
 // extractTextFromJiix extracts text from Jiix JSON format
-func extractTextFromJiix(data []byte) string {
+func extractTextFromJiix(ctx context.Context, data []byte) string {
 	// Try to parse as JSON object first
 	var jiix map[string]interface{}
 	if err := json.Unmarshal(data, &jiix); err == nil {
-		return extractTextFromJiixObject(jiix)
+		return extractTextFromJiixObject(ctx, jiix)
 	}
 	
 	// Try to parse as JSON array
@@ -535,7 +643,7 @@ func extractTextFromJiix(data []byte) string {
 		var textParts []string
 		for _, item := range jiixArray {
 			if itemMap, ok := item.(map[string]interface{}); ok {
-				text := extractTextFromJiixObject(itemMap)
+				text := extractTextFromJiixObject(ctx, itemMap)
 				if text != "" {
 					textParts = append(textParts, text)
 				}
@@ -547,11 +655,11 @@ func extractTextFromJiix(data []byte) string {
 	}
 	
 	// Not valid JSON, return as string
-	log.Printf("Warning: Response is not valid JSON, first 100 bytes: %s", string(data[:min(100, len(data))]))
+	slog.WarnContext(ctx, "Response is not valid JSON", "preview", string(data[:min(100, len(data))]))
 	return string(data)
 }
 
-func extractTextFromJiixObject(jiix map[string]interface{}) string {
+func extractTextFromJiixObject(ctx context.Context, jiix map[string]interface{}) string {
 	var textParts []string
 
 	// Try to extract from "text" field (direct text output)
@@ -622,7 +730,7 @@ func extractTextFromJiixObject(jiix map[string]interface{}) string {
 	// Try to extract from "result" field (some APIs wrap the response)
 	if result, ok := jiix["result"]; ok {
 		if resultMap, ok := result.(map[string]interface{}); ok {
-			text := extractTextFromJiixObject(resultMap)
+			text := extractTextFromJiixObject(ctx, resultMap)
 			if text != "" {
 				return text
 			}
@@ -630,7 +738,7 @@ func extractTextFromJiixObject(jiix map[string]interface{}) string {
 	}
 
 	// If we can't parse it, return empty string (will fall back to raw data)
-	log.Printf("Warning: Could not extract text from Jiix format, available keys: %v", getMapKeys(jiix))
+	slog.WarnContext(ctx, "Could not extract text from Jiix format", "keys", getMapKeys(jiix))
 	return ""
 }
 
@@ -654,7 +762,10 @@ func setContentType(requested string) (contenttype string, output string) {
 		output = "image/svg+xml"
 	case "jiix":
 		contenttype = "Text"
-		output = "application/vnd.myscript.jiix"
+		output = jiixMimeType
+	case "raw", "raw content":
+		contenttype = RawContentType
+		output = jiixMimeType
 	default:
 		log.Fatal("unsupported content type: " + contenttype)
 	}
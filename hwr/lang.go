@@ -0,0 +1,181 @@
+package hwr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/ddvk/rmapi-hwr/hwr/client"
+	"github.com/ddvk/rmapi-hwr/hwr/models"
+	"github.com/juruen/rmapi/archive"
+)
+
+const jiixMimeType = "application/vnd.myscript.jiix"
+
+// ErrLanguageUndetected is returned by DetectLanguage when MyScript reports
+// no word confidence in any candidate language, the page is then recognized
+// in its configured language.
+var ErrLanguageUndetected = errors.New("language not detected")
+
+// ParsePageLangs parses a page to language map such as "1=fr_FR,2-4=en_US".
+// Pages are 1-indexed as on the command line; the returned map is 0-indexed.
+func ParsePageLangs(spec string) (map[int]string, error) {
+	langs := make(map[int]string)
+	if strings.TrimSpace(spec) == "" {
+		return langs, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		pages, lang, found := strings.Cut(strings.TrimSpace(entry), "=")
+		lang = strings.TrimSpace(lang)
+		if !found || lang == "" {
+			return nil, fmt.Errorf("invalid page language %q, expected page=lang", entry)
+		}
+
+		first, last, isRange := strings.Cut(pages, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil || from < 1 {
+			return nil, fmt.Errorf("invalid page %q", pages)
+		}
+		to := from
+		if isRange {
+			to, err = strconv.Atoi(strings.TrimSpace(last))
+			if err != nil || to < from {
+				return nil, fmt.Errorf("invalid page range %q", pages)
+			}
+		}
+
+		for p := from; p <= to; p++ {
+			langs[p-1] = lang
+		}
+	}
+	return langs, nil
+}
+
+// ParseLangList parses a comma separated list of languages.
+func ParseLangList(spec string) []string {
+	var langs []string
+	for _, lang := range strings.Split(spec, ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			langs = append(langs, lang)
+		}
+	}
+	return langs
+}
+
+// LangForPage returns the language configured for a page (0-indexed),
+// falling back to the document language.
+func (cfg Config) LangForPage(pageNumber int) string {
+	if lang, ok := cfg.PageLangs[pageNumber]; ok {
+		return lang
+	}
+	return cfg.Lang
+}
+
+// DetectLanguage recognizes a page once per candidate language as text and
+// returns the language whose JIIX result has the highest confidence,
+// together with that result. When no result has any confidence, it returns
+// ErrLanguageUndetected.
+func DetectLanguage(zip *archive.Zip, pageNumber int, candidates []string, profile *models.Configuration, resources ResourceSet, applicationKey, hmacKey string) (lang string, body []byte, err error) {
+	return DetectLanguageContext(context.Background(), zip, pageNumber, candidates, profile, resources, applicationKey, hmacKey)
+}
+
+// DetectLanguageContext is DetectLanguage, logging with ctx and aborting the
+// probes when ctx is done.
+func DetectLanguageContext(ctx context.Context, zip *archive.Zip, pageNumber int, candidates []string, profile *models.Configuration, resources ResourceSet, applicationKey, hmacKey string) (lang string, body []byte, err error) {
+	if len(candidates) == 0 {
+		return "", nil, fmt.Errorf("no candidate languages")
+	}
+
+	bestScore := -1.0
+	for _, candidate := range candidates {
+		conf := NewConfiguration(profile, "Text", candidate, resources.For(candidate))
+		EnableWordExport(conf)
+		js, err := getJson(ctx, zip, "Text", conf, pageNumber)
+		if err != nil {
+			return "", nil, err
+		}
+
+		result, err := client.SendRequestContext(ctx, applicationKey, hmacKey, js, jiixMimeType)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", nil, ctx.Err()
+			}
+			slog.WarnContext(ctx, "Language probe failed", "page", pageNumber, "lang", candidate, "err", err)
+			continue
+		}
+
+		score := jiixConfidence(result)
+		slog.DebugContext(ctx, "Language probe", "page", pageNumber, "lang", candidate, "score", score)
+		if score > bestScore {
+			bestScore = score
+			lang = candidate
+			body = result
+		}
+	}
+
+	if body == nil {
+		return "", nil, fmt.Errorf("all language probes failed for page %d", pageNumber)
+	}
+	if bestScore <= 0 {
+		slog.WarnContext(ctx, "No word confidence in any language probe, can't tell the languages apart", "page", pageNumber, "candidates", candidates)
+		return "", nil, fmt.Errorf("%w: no word confidence on page %d", ErrLanguageUndetected, pageNumber)
+	}
+	return lang, body, nil
+}
+
+// EnableWordExport asks MyScript for the words of a JIIX text result, with
+// their candidates and confidence, as scored by DetectLanguage.
+func EnableWordExport(conf *models.Configuration) {
+	if conf.Export == nil {
+		conf.Export = &models.ExportConfiguration{}
+	}
+	if conf.Export.Jiix == nil {
+		conf.Export.Jiix = &models.JiixConfiguration{}
+	}
+	if conf.Export.Jiix.Text == nil {
+		conf.Export.Jiix.Text = &models.JiixTextConfiguration{}
+	}
+	conf.Export.Jiix.Text.Words = true
+}
+
+// jiixConfidence returns the mean word confidence of a JIIX text result,
+// weighted by word length. Whitespace words are ignored.
+func jiixConfidence(data []byte) float64 {
+	var jiix struct {
+		Words []struct {
+			Label      string   `json:"label"`
+			Confidence *float64 `json:"confidence"`
+			Score      *float64 `json:"score"`
+		} `json:"words"`
+	}
+	if err := json.Unmarshal(data, &jiix); err != nil {
+		return 0
+	}
+
+	var total, weight float64
+	for _, word := range jiix.Words {
+		label := strings.TrimSpace(word.Label)
+		if label == "" {
+			continue
+		}
+		confidence := word.Confidence
+		if confidence == nil {
+			confidence = word.Score
+		}
+		if confidence == nil {
+			continue
+		}
+		w := float64(len([]rune(label)))
+		total += *confidence * w
+		weight += w
+	}
+	if weight == 0 {
+		return 0
+	}
+	return total / weight
+}
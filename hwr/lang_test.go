@@ -0,0 +1,83 @@
+package hwr
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ddvk/rmapi-hwr/hwr/client"
+	"github.com/juruen/rmapi/archive"
+	"github.com/juruen/rmapi/encoding/rm"
+)
+
+// fakeMyScript answers the text recognition of each language with its JIIX,
+// failing the test when the request doesn't export words.
+func fakeMyScript(t *testing.T, jiix map[string]string) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var req struct {
+			Configuration struct {
+				Lang   string `json:"lang"`
+				Export struct {
+					Jiix struct {
+						Text struct {
+							Words bool `json:"words"`
+						} `json:"text"`
+					} `json:"jiix"`
+				} `json:"export"`
+			} `json:"configuration"`
+		}
+		if err := json.Unmarshal(data, &req); err != nil {
+			t.Errorf("request: %v", err)
+		}
+		if !req.Configuration.Export.Jiix.Text.Words {
+			t.Errorf("%s probe doesn't export the words of the JIIX", req.Configuration.Lang)
+		}
+		w.Write([]byte(jiix[req.Configuration.Lang]))
+	}))
+	t.Cleanup(server.Close)
+	endpoint := client.Endpoint
+	client.Endpoint = server.URL
+	t.Cleanup(func() { client.Endpoint = endpoint })
+}
+
+// probePage is a page with one short stroke, recognized by the fake MyScript.
+func probePage() *archive.Zip {
+	line := rm.Line{BrushType: rm.BallPointV5, BrushColor: rm.Black, BrushSize: rm.Medium}
+	for i := 0; i < 10; i++ {
+		line.Points = append(line.Points, rm.Point{X: float32(300 + 10*i), Y: 500, Width: 2, Pressure: 0.5})
+	}
+	page := &rm.Rm{Version: rm.V5, Layers: []rm.Layer{{Lines: []rm.Line{line}}}}
+	return &archive.Zip{Pages: []archive.Page{{Data: page}}}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	fakeMyScript(t, map[string]string{
+		"en_US": `{"words": [{"label": "hello", "confidence": 0.4}]}`,
+		"fr_FR": `{"words": [{"label": "allo", "confidence": 0.9}, {"label": " "}]}`,
+	})
+	zip := probePage()
+	lang, body, err := DetectLanguage(zip, 0, []string{"en_US", "fr_FR"}, nil, ResourceSet{}, "key", "hmac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lang != "fr_FR" || len(body) == 0 {
+		t.Errorf("detected %q, want fr_FR", lang)
+	}
+}
+
+func TestDetectLanguageWithoutConfidence(t *testing.T) {
+	fakeMyScript(t, map[string]string{
+		"en_US": `{"words": [{"label": "hello"}]}`,
+		"fr_FR": `{"words": [{"label": "allo"}]}`,
+	})
+	zip := probePage()
+	lang, _, err := DetectLanguage(zip, 0, []string{"en_US", "fr_FR"}, nil, ResourceSet{}, "key", "hmac")
+	if !errors.Is(err, ErrLanguageUndetected) {
+		t.Errorf("detected %q, %v, want %v", lang, err, ErrLanguageUndetected)
+	}
+}
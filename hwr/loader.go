@@ -0,0 +1,387 @@
+package hwr
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/juruen/rmapi/archive"
+	"github.com/juruen/rmapi/encoding/rm"
+)
+
+// Errors of LoadZip when a document is rejected by its Limits.
+var (
+	ErrTooLarge      = errors.New("document too large")
+	ErrUnsafeArchive = errors.New("unsafe archive")
+)
+
+// Limits bounds the documents accepted by LoadZip. A zero limit is not checked.
+type Limits struct {
+	MaxUploadSize    int64   // Size of the archive in bytes
+	MaxEntries       int     // Files in the archive
+	MaxUncompressed  int64   // Total uncompressed size of the files in bytes
+	MaxCompression   float64 // Compression ratio of a file, above it the archive is taken for a zip bomb
+	MaxPages         int     // Pages of the document
+	MaxPointsPerPage int     // Stroke points of a page
+}
+
+// compressionCheckSize is the uncompressed size from which MaxCompression
+// applies, small files legitimately compress well.
+const compressionCheckSize = 1024 * 1024
+
+// Sizes bounding the files of a document before they are parsed. A point of
+// a .rm file takes 24 bytes, and so does a line without its points.
+const (
+	rmPointSize    = 24
+	rmPageOverhead = 64 * 1024        // Header and layers of a .rm file, with room to spare
+	maxContentSize = 16 * 1024 * 1024 // A .content file, the page list and settings of the document
+)
+
+// DefaultLimits returns limits that accept any reasonable notebook.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxUploadSize:    100 * 1024 * 1024,
+		MaxEntries:       10000,
+		MaxUncompressed:  512 * 1024 * 1024,
+		MaxCompression:   100,
+		MaxPages:         2000,
+		MaxPointsPerPage: 1000000,
+	}
+}
+
+// LoadZip reads a document downloaded with rmapi or exported as .rmdoc. The
+// archive is checked against limits before anything is parsed, and the pages
+// once parsed. The Payload of annotated PDFs and EPUBs holds the PDF their
+// pages are drawn over.
+func LoadZip(ctx context.Context, file io.ReaderAt, size int64, limits Limits) (*archive.Zip, error) {
+	if limits.MaxUploadSize > 0 && size > limits.MaxUploadSize {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrTooLarge, size, limits.MaxUploadSize)
+	}
+	reader, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("can't open as zip: %w", err)
+	}
+	if err := CheckArchive(reader, limits); err != nil {
+		return nil, err
+	}
+
+	zipArchive, err := loadZip(ctx, file, size, reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := readBackground(reader, zipArchive); err != nil {
+		return nil, err
+	}
+	if err := CheckPages(zipArchive, limits); err != nil {
+		return nil, err
+	}
+	return zipArchive, nil
+}
+
+// loadZip tries the rmapi parser first and falls back to the .content page
+// list of newer archives when it finds no stroke data.
+func loadZip(ctx context.Context, file io.ReaderAt, size int64, reader *zip.Reader) (*archive.Zip, error) {
+	zipArchive := archive.NewZip()
+	err := zipArchive.Read(file, size)
+	if err == nil {
+		numPages := len(zipArchive.Pages)
+		slog.DebugContext(ctx, "Standard rmapi Read() succeeded", "pages", numPages)
+		if numPages > 0 {
+			// Check if pages have data
+			pagesWithData := 0
+			for i, page := range zipArchive.Pages {
+				if page.Data != nil {
+					layers := len(page.Data.Layers)
+					totalLines := 0
+					for _, layer := range page.Data.Layers {
+						totalLines += len(layer.Lines)
+					}
+					slog.DebugContext(ctx, "Page data", "page", i, "layers", layers, "lines", totalLines)
+					if layers > 0 && totalLines > 0 {
+						pagesWithData++
+					}
+				}
+			}
+			slog.DebugContext(ctx, "Pages with data", "pages_with_data", pagesWithData, "pages", numPages)
+			if pagesWithData > 0 {
+				return zipArchive, nil
+			}
+			slog.DebugContext(ctx, "Standard parser found pages but no data, trying new format parser")
+		} else {
+			slog.DebugContext(ctx, "Standard parser found 0 pages, trying new format parser")
+		}
+	} else {
+		slog.DebugContext(ctx, "Standard rmapi Read() failed, trying new format parser", "err", err)
+	}
+
+	return loadZipNewFormat(ctx, reader)
+}
+
+// contentFile is the page list of the .content file of newer archives.
+type contentFile struct {
+	FileType string `json:"fileType"`
+	CPages   struct {
+		Pages []struct {
+			ID    string `json:"id"`
+			Redir *struct {
+				Value int `json:"value"`
+			} `json:"redir"`
+			Template struct {
+				Value string `json:"value"`
+			} `json:"template"`
+		} `json:"pages"`
+		LastOpened struct {
+			Value string `json:"value"`
+		} `json:"lastOpened"`
+	} `json:"cPages"`
+}
+
+// loadZipNewFormat reads the pages listed in the .content file, stored as
+// UUID/pageID.rm. Pages added to a PDF or EPUB have no page of the document,
+// their DocPage is -1.
+func loadZipNewFormat(ctx context.Context, reader *zip.Reader) (*archive.Zip, error) {
+	zipArchive := archive.NewZip()
+
+	// Find the .content file to get page list
+	var contentEntry *zip.File
+	var docUUID string
+	for _, f := range reader.File {
+		if strings.HasSuffix(f.Name, ".content") {
+			contentEntry = f
+			docUUID = strings.TrimSuffix(path.Base(f.Name), ".content")
+			break
+		}
+	}
+	if contentEntry == nil {
+		return nil, fmt.Errorf("no .content file found in archive")
+	}
+
+	contentData, err := readEntry(contentEntry)
+	if err != nil {
+		return nil, fmt.Errorf("can't read content file: %w", err)
+	}
+	var content contentFile
+	if err := json.Unmarshal(contentData, &content); err != nil {
+		return nil, fmt.Errorf("can't parse content file: %w", err)
+	}
+
+	zipArchive.UUID = docUUID
+	zipArchive.Content.FileType = content.FileType
+	lastOpenedID := content.CPages.LastOpened.Value
+	for i, page := range content.CPages.Pages {
+		if page.ID == lastOpenedID {
+			zipArchive.Content.LastOpenedPage = i
+			break
+		}
+	}
+
+	entries := make(map[string]*zip.File, len(reader.File))
+	for _, f := range reader.File {
+		entries[f.Name] = f
+	}
+	for _, pageInfo := range content.CPages.Pages {
+		pagePath := fmt.Sprintf("%s/%s.rm", docUUID, pageInfo.ID)
+		pageEntry, ok := entries[pagePath]
+		if !ok {
+			slog.WarnContext(ctx, "Page file not found", "file", pagePath)
+			continue
+		}
+
+		pageData, err := readEntry(pageEntry)
+		if err != nil {
+			slog.WarnContext(ctx, "Can't read page file", "file", pagePath, "err", err)
+			continue
+		}
+
+		page := archive.Page{DocPage: -1, Pagedata: pageInfo.Template.Value}
+		if pageInfo.Redir != nil {
+			page.DocPage = pageInfo.Redir.Value
+		}
+		page.Data = rm.New()
+		if err := page.Data.UnmarshalBinary(pageData); err != nil {
+			slog.WarnContext(ctx, "Can't parse page file", "file", pagePath, "err", err)
+			continue
+		}
+		zipArchive.Pages = append(zipArchive.Pages, page)
+	}
+
+	if len(zipArchive.Pages) == 0 {
+		return nil, fmt.Errorf("no pages found in archive")
+	}
+	return zipArchive, nil
+}
+
+// readBackground reads into Payload the PDF that the pages of an annotated
+// document are drawn over: the document itself for PDFs, and the PDF the
+// device renders EPUBs to for EPUBs.
+func readBackground(reader *zip.Reader, zipArchive *archive.Zip) error {
+	if zipArchive.Content.FileType != "pdf" && zipArchive.Content.FileType != "epub" {
+		return nil
+	}
+	if zipArchive.Content.FileType == "pdf" && zipArchive.Payload != nil {
+		return nil
+	}
+	zipArchive.Payload = nil
+	for _, f := range reader.File {
+		if path.Base(f.Name) == zipArchive.UUID+".pdf" {
+			data, err := readEntry(f)
+			if err != nil {
+				return fmt.Errorf("can't read %s: %w", f.Name, err)
+			}
+			zipArchive.Payload = data
+			break
+		}
+	}
+	return nil
+}
+
+func readEntry(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// CheckArchive rejects archives with too many or too large files, files
+// compressed suspiciously well, file names escaping the archive, and too many
+// pages. Apart from the .content page list, only the zip directory is read,
+// archive/zip fails reading a file larger than its declared size.
+func CheckArchive(reader *zip.Reader, limits Limits) error {
+	if limits.MaxEntries > 0 && len(reader.File) > limits.MaxEntries {
+		return fmt.Errorf("%w: %d files, the limit is %d", ErrUnsafeArchive, len(reader.File), limits.MaxEntries)
+	}
+
+	var total uint64
+	for _, f := range reader.File {
+		if !safeEntryName(f.Name) {
+			return fmt.Errorf("%w: suspicious file name %q", ErrUnsafeArchive, f.Name)
+		}
+		total += f.UncompressedSize64
+		if limits.MaxUncompressed > 0 && total > uint64(limits.MaxUncompressed) {
+			return fmt.Errorf("%w: more than %d bytes uncompressed", ErrTooLarge, limits.MaxUncompressed)
+		}
+		if limits.MaxCompression > 0 && f.UncompressedSize64 >= compressionCheckSize {
+			ratio := float64(f.UncompressedSize64) / float64(max(f.CompressedSize64, 1))
+			if ratio > limits.MaxCompression {
+				return fmt.Errorf("%w: %s is compressed %.0f:1, the limit is %.0f:1", ErrUnsafeArchive, f.Name, ratio, limits.MaxCompression)
+			}
+		}
+		if err := checkEntrySize(f, limits); err != nil {
+			return err
+		}
+	}
+	return checkPageCount(reader, limits)
+}
+
+// checkEntrySize rejects .content files larger than any page list, and .rm
+// files larger than a page of MaxPointsPerPage points in single point lines.
+func checkEntrySize(f *zip.File, limits Limits) error {
+	var limit uint64
+	switch path.Ext(f.Name) {
+	case ".content":
+		limit = maxContentSize
+	case ".rm":
+		if limits.MaxPointsPerPage <= 0 {
+			return nil
+		}
+		limit = rmPageOverhead + 2*rmPointSize*uint64(limits.MaxPointsPerPage)
+	default:
+		return nil
+	}
+	if f.UncompressedSize64 > limit {
+		return fmt.Errorf("%w: %s is %d bytes, the limit is %d", ErrTooLarge, f.Name, f.UncompressedSize64, limit)
+	}
+	return nil
+}
+
+// checkPageCount rejects documents with more than MaxPages pages, counted
+// from the .rm files and the page lists of the .content files, before the
+// pages are allocated and parsed.
+func checkPageCount(reader *zip.Reader, limits Limits) error {
+	if limits.MaxPages <= 0 {
+		return nil
+	}
+	pages := 0
+	for _, f := range reader.File {
+		if path.Ext(f.Name) == ".rm" {
+			pages++
+		}
+	}
+	for _, f := range reader.File {
+		if path.Ext(f.Name) != ".content" {
+			continue
+		}
+		data, err := readEntry(f)
+		if err != nil {
+			return fmt.Errorf("can't read %s: %w", f.Name, err)
+		}
+		var content struct {
+			PageCount int               `json:"pageCount"`
+			Pages     []json.RawMessage `json:"pages"`
+			CPages    struct {
+				Pages []json.RawMessage `json:"pages"`
+			} `json:"cPages"`
+		}
+		// an invalid .content fails loading the document, with a better error
+		if json.Unmarshal(data, &content) != nil {
+			continue
+		}
+		pages = max(pages, content.PageCount, len(content.Pages), len(content.CPages.Pages))
+	}
+	if pages > limits.MaxPages {
+		return fmt.Errorf("%w: %d pages, the limit is %d", ErrTooLarge, pages, limits.MaxPages)
+	}
+	return nil
+}
+
+// safeEntryName reports whether a file name stays inside the archive: a
+// relative slash separated path without .. elements.
+func safeEntryName(name string) bool {
+	switch {
+	case name == "",
+		strings.ContainsAny(name, "\x00\\"),
+		strings.HasPrefix(name, "/"),
+		len(name) >= 2 && name[1] == ':': // Windows drive
+		return false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckPages rejects documents with too many pages or points on a page, once
+// parsed. CheckArchive rejects most of them before, from their files.
+func CheckPages(zipArchive *archive.Zip, limits Limits) error {
+	if limits.MaxPages > 0 && len(zipArchive.Pages) > limits.MaxPages {
+		return fmt.Errorf("%w: %d pages, the limit is %d", ErrTooLarge, len(zipArchive.Pages), limits.MaxPages)
+	}
+	if limits.MaxPointsPerPage <= 0 {
+		return nil
+	}
+	for i, page := range zipArchive.Pages {
+		if page.Data == nil {
+			continue
+		}
+		points := 0
+		for _, layer := range page.Data.Layers {
+			for _, line := range layer.Lines {
+				points += len(line.Points)
+			}
+		}
+		if points > limits.MaxPointsPerPage {
+			return fmt.Errorf("%w: page %d has %d points, the limit is %d", ErrTooLarge, i+1, points, limits.MaxPointsPerPage)
+		}
+	}
+	return nil
+}
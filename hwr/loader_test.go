@@ -0,0 +1,50 @@
+package hwr
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// testArchive returns a zip of files, by name.
+func testArchive(t *testing.T, files map[string][]byte) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestLoadZipChecksPagesBeforeParsing(t *testing.T) {
+	limits := DefaultLimits()
+	limits.MaxPages = 3
+	limits.MaxPointsPerPage = 100
+
+	for name, files := range map[string]map[string][]byte{
+		// archive.Read would allocate the pages of pageCount
+		"pageCount": {"doc.content": []byte(`{"fileType": "notebook", "pageCount": 1000000000}`), "doc.pagedata": nil},
+		"pages":     {"doc.content": []byte(`{"pages": ["a", "b", "c", "d"]}`)},
+		"cPages":    {"doc.content": []byte(`{"cPages": {"pages": [{"id": "a"}, {"id": "b"}, {"id": "c"}, {"id": "d"}]}}`)},
+		".rm files": {"doc.content": []byte(`{}`), "doc/0.rm": nil, "doc/1.rm": nil, "doc/2.rm": nil, "doc/3.rm": nil},
+		"page size": {"doc.content": []byte(`{"pageCount": 1}`), "doc/0.rm": make([]byte, rmPageOverhead+2*rmPointSize*100+1)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			archive := testArchive(t, files)
+			_, err := LoadZip(context.Background(), archive, archive.Size(), limits)
+			if !errors.Is(err, ErrTooLarge) {
+				t.Errorf("got %v, want %v", err, ErrTooLarge)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package hwr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"math"
+	"strings"
+
+	"github.com/ddvk/rmapi-hwr/hwr/models"
+	"github.com/juruen/rmapi/archive"
+	"github.com/juruen/rmapi/encoding/rm"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Debug overlay constants
+const (
+	pixelsPerMM        = deviceDPI / 25.4 // JIIX coordinates are in millimeters, strokes are sent in device pixels
+	overlayFade        = 0.6              // How much the rendered page fades to its paper under the overlay
+	overlayLinePadding = 4                // Space between the box of a line and the boxes of its words
+	overlayStrokeMatch = 0.5              // Largest distance, in device pixels, between a stroke and a JIIX stroke item
+)
+
+// overlayLineColor is the color of the boxes of text lines.
+var overlayLineColor = [3]uint8{128, 128, 128}
+
+// recognizedWord is a word of a JIIX result, in device pixels.
+type recognizedWord struct {
+	label  string
+	box    [4]float32   // minX, minY, maxX, maxY
+	starts [][2]float32 // First point of each of its strokes
+}
+
+// jiixOverlayElement is the subset of a JIIX result, or of one of its raw
+// content elements, drawn by the debug overlay.
+type jiixOverlayElement struct {
+	Words    []jiixOverlayWord    `json:"words"`
+	Elements []jiixOverlayElement `json:"elements"`
+	Children []jiixOverlayElement `json:"children"`
+}
+
+type jiixOverlayWord struct {
+	Label       string       `json:"label"`
+	BoundingBox *BoundingBox `json:"bounding-box"`
+	Items       []struct {
+		Type string    `json:"type"`
+		X    []float64 `json:"X"`
+		Y    []float64 `json:"Y"`
+	} `json:"items"`
+}
+
+// EnableOverlayExport asks MyScript for the bounding boxes and strokes of the
+// words of a JIIX result, as drawn by RenderOverlay.
+func EnableOverlayExport(conf *models.Configuration) {
+	if conf.Export == nil {
+		conf.Export = &models.ExportConfiguration{}
+	}
+	if conf.Export.Jiix == nil {
+		conf.Export.Jiix = &models.JiixConfiguration{}
+	}
+	conf.Export.Jiix.BoundingBox = true
+	conf.Export.Jiix.Strokes = true
+	EnableWordExport(conf)
+}
+
+// VisualizeOverlay renders the recognition overlay of a page to a PNG file,
+// see RenderOverlay.
+func VisualizeOverlay(ctx context.Context, zip *archive.Zip, pageNumber int, jiix []byte, outputPath string, config VisualizationConfig) error {
+	img, err := RenderOverlay(ctx, zip, pageNumber, jiix, config)
+	if err != nil {
+		return err
+	}
+	return savePNG(img, outputPath)
+}
+
+// RenderOverlay renders a page (0-indexed) as RenderPage does, faded, and
+// draws over it what MyScript recognized in its JIIX text or raw content
+// result: the strokes of each word in a color of their own, the box and
+// label of each word in that color and a gray box around each line. Strokes
+// left out of every word stay faded. Pages are drawn without their document
+// background, so that the boxes follow the layout of the strokes.
+func RenderOverlay(ctx context.Context, zip *archive.Zip, pageNumber int, jiix []byte, config VisualizationConfig) (*image.RGBA, error) {
+	if pageNumber < 0 || pageNumber >= len(zip.Pages) {
+		return nil, fmt.Errorf("page %d out of range, the document has %d pages", pageNumber+1, len(zip.Pages))
+	}
+	page := zip.Pages[pageNumber]
+	if page.Data == nil {
+		return nil, fmt.Errorf("page %d has no data", pageNumber+1)
+	}
+	words, lines, byStrokes, err := parseRecognizedWords(jiix)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Background = false
+	img := RenderPage(ctx, zip, pageNumber, config)
+	bbox := pageBoundingBox(page.Data, config)
+	if bbox == nil {
+		return img, nil
+	}
+	scaleX, scaleY, _, _ := calculateImageDimensions(bbox, config)
+	transform := func(x, y float32) (float32, float32) {
+		return (x - bbox.minX + bbox.paddingX) * scaleX, (y - bbox.minY + bbox.paddingY) * scaleY
+	}
+	toImage := func(box [4]float32) image.Rectangle {
+		x0, y0 := transform(box[0], box[1])
+		x1, y1 := transform(box[2], box[3])
+		return image.Rect(int(math.Floor(float64(x0))), int(math.Floor(float64(y0))), int(math.Ceil(float64(x1))), int(math.Ceil(float64(y1))))
+	}
+
+	// Fade the page to its paper, transparent pages to transparent
+	paper, opaque := config.paperColor()
+	if opaque {
+		fade := image.NewUniform(color.RGBA{paper[0], paper[1], paper[2], 255})
+		draw.DrawMask(img, img.Bounds(), fade, image.Point{}, image.NewUniform(color.Alpha{uint8(overlayFade * 255)}), image.Point{}, draw.Over)
+	} else {
+		draw.DrawMask(img, img.Bounds(), img, image.Point{}, image.NewUniform(color.Alpha{uint8((1 - overlayFade) * 255)}), image.Point{}, draw.Src)
+	}
+
+	// The strokes of each word in its color
+	colors := make([][3]uint8, len(words))
+	for i := range words {
+		colors[i] = overlayColor(i)
+	}
+	mapping := wordStrokes(page.Data, words, byStrokes)
+	r := &strokeRasterizer{img: img, scale: 1}
+	for l, layer := range page.Data.Layers {
+		for i, line := range layer.Lines {
+			w, ok := mapping[[2]int{l, i}]
+			if !ok || len(line.Points) < 2 {
+				continue
+			}
+			pen := NewPenRendererWithPalette(line.BrushType, uint32(line.BrushColor), line.BrushSize, config.Palette)
+			shapes, _ := lineShapes(line, transform, pen, config)
+			for _, shape := range shapes {
+				for p := range shape {
+					shape[p].color = colors[w]
+				}
+				r.fill(shape, false)
+			}
+		}
+	}
+
+	for _, line := range lines {
+		drawFrame(img, toImage(line).Inset(-overlayLinePadding), overlayLineColor)
+	}
+	label := &font.Drawer{Dst: img, Face: basicfont.Face7x13}
+	labelPaper := image.NewUniform(color.RGBA{paper[0], paper[1], paper[2], 255})
+	for i, word := range words {
+		box := toImage(word.box)
+		drawFrame(img, box, colors[i])
+
+		// the label above its word, or under it at the top of the page
+		text := strings.TrimSpace(word.label)
+		width := label.MeasureString(text).Round()
+		baseline := box.Min.Y - basicfont.Face7x13.Descent - 1
+		if baseline-basicfont.Face7x13.Ascent < 0 {
+			baseline = box.Max.Y + basicfont.Face7x13.Ascent + 1
+		}
+		if opaque {
+			background := image.Rect(box.Min.X, baseline-basicfont.Face7x13.Ascent, box.Min.X+width, baseline+basicfont.Face7x13.Descent)
+			draw.Draw(img, background, labelPaper, image.Point{}, draw.Src)
+		}
+		label.Src = image.NewUniform(color.RGBA{colors[i][0], colors[i][1], colors[i][2], 255})
+		label.Dot = fixed.P(box.Min.X, baseline)
+		label.DrawString(text)
+	}
+
+	slog.DebugContext(ctx, "Rendered recognition overlay", "page", pageNumber, "words", len(words), "lines", len(lines), "strokes", len(mapping), "by_strokes", byStrokes)
+	return img, nil
+}
+
+// parseRecognizedWords returns the words of a JIIX text or raw content
+// result that have a bounding box, and the boxes of their lines. Lines end at
+// newline words and at the end of each text element. byStrokes reports
+// whether the words list their strokes.
+func parseRecognizedWords(data []byte) (words []recognizedWord, lines [][4]float32, byStrokes bool, err error) {
+	var root jiixOverlayElement
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&root); err != nil {
+		return nil, nil, false, fmt.Errorf("can't parse JIIX: %w", err)
+	}
+
+	var walk func(jiixOverlayElement)
+	walk = func(e jiixOverlayElement) {
+		var line [4]float32
+		inLine := false
+		endLine := func() {
+			if inLine {
+				lines = append(lines, line)
+			}
+			inLine = false
+		}
+		for _, w := range e.Words {
+			if strings.Contains(w.Label, "\n") {
+				endLine()
+				continue
+			}
+			if w.BoundingBox == nil || strings.TrimSpace(w.Label) == "" {
+				continue
+			}
+			b := w.BoundingBox
+			word := recognizedWord{
+				label: w.Label,
+				box: [4]float32{
+					float32(b.X * pixelsPerMM), float32(b.Y * pixelsPerMM),
+					float32((b.X + b.Width) * pixelsPerMM), float32((b.Y + b.Height) * pixelsPerMM),
+				},
+			}
+			for _, item := range w.Items {
+				if item.Type == "stroke" && len(item.X) > 0 && len(item.Y) > 0 {
+					word.starts = append(word.starts, [2]float32{float32(item.X[0] * pixelsPerMM), float32(item.Y[0] * pixelsPerMM)})
+					byStrokes = true
+				}
+			}
+			words = append(words, word)
+
+			if !inLine {
+				line, inLine = word.box, true
+			} else {
+				line = unionBox(line, word.box)
+			}
+		}
+		endLine()
+		for _, child := range e.Elements {
+			walk(child)
+		}
+		for _, child := range e.Children {
+			walk(child)
+		}
+	}
+	walk(root)
+	return words, lines, byStrokes, nil
+}
+
+// wordStrokes maps the lines of a page, by layer and index, to the word they
+// were recognized in. With byStrokes, lines are matched to the strokes listed
+// by the words, as they were sent to MyScript; otherwise each line belongs to
+// the first word whose box holds its center.
+func wordStrokes(pageData *rm.Rm, words []recognizedWord, byStrokes bool) map[[2]int]int {
+	mapping := make(map[[2]int]int)
+	for l, layer := range pageData.Layers {
+		for i, line := range layer.Lines {
+			// the strokes getJson sends
+			if line.BrushType == rm.EraseArea || len(line.Points) == 0 {
+				continue
+			}
+			if byStrokes {
+				x, y := line.Points[0].X, line.Points[0].Y
+				best, bestDistance := -1, float32(overlayStrokeMatch)
+				for w, word := range words {
+					for _, start := range word.starts {
+						if d := float32(math.Hypot(float64(start[0]-x), float64(start[1]-y))); d <= bestDistance {
+							best, bestDistance = w, d
+						}
+					}
+				}
+				if best >= 0 {
+					mapping[[2]int{l, i}] = best
+				}
+				continue
+			}
+
+			box := [4]float32{line.Points[0].X, line.Points[0].Y, line.Points[0].X, line.Points[0].Y}
+			for _, p := range line.Points[1:] {
+				box = unionBox(box, [4]float32{p.X, p.Y, p.X, p.Y})
+			}
+			cx, cy := (box[0]+box[2])/2, (box[1]+box[3])/2
+			for w, word := range words {
+				if cx >= word.box[0] && cx <= word.box[2] && cy >= word.box[1] && cy <= word.box[3] {
+					mapping[[2]int{l, i}] = w
+					break
+				}
+			}
+		}
+	}
+	return mapping
+}
+
+// unionBox returns the smallest box holding boxes a and b.
+func unionBox(a, b [4]float32) [4]float32 {
+	if b[0] < a[0] {
+		a[0] = b[0]
+	}
+	if b[1] < a[1] {
+		a[1] = b[1]
+	}
+	return [4]float32{a[0], a[1], max(a[2], b[2]), max(a[3], b[3])}
+}
+
+// overlayColor returns the color of the i-th word, hues a golden angle apart
+// so that neighboring words differ, readable on light and dark paper.
+func overlayColor(i int) [3]uint8 {
+	hue := math.Mod(float64(i)*137.508, 360) / 60
+	const saturation, value = 0.8, 0.75
+	chroma := value * saturation
+	x := chroma * (1 - math.Abs(math.Mod(hue, 2)-1))
+	var r, g, b float64
+	switch int(hue) {
+	case 0:
+		r, g = chroma, x
+	case 1:
+		r, g = x, chroma
+	case 2:
+		g, b = chroma, x
+	case 3:
+		g, b = x, chroma
+	case 4:
+		r, b = x, chroma
+	default:
+		r, b = chroma, x
+	}
+	m := value - chroma
+	return [3]uint8{uint8((r+m)*255 + 0.5), uint8((g+m)*255 + 0.5), uint8((b+m)*255 + 0.5)}
+}
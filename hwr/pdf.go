@@ -0,0 +1,499 @@
+package hwr
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/juruen/rmapi/archive"
+	"github.com/juruen/rmapi/encoding/rm"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// PDF page geometry
+const (
+	deviceDPI = 226 // ReMarkable2 screen resolution
+
+	// bezierCircle places the control points of a cubic Bézier curve
+	// approximating a quarter circle.
+	bezierCircle = 0.5523
+)
+
+// PDFPage is a page of a document rendered with WritePDF.
+type PDFPage struct {
+	Page    int    // Page (0-indexed) of the document
+	Content []byte // Strokes of the page, as returned by PDFContent
+}
+
+// VisualizePDF renders the pages (0-indexed) of a document to a PDF file, a
+// PDF page per page of the document. Pages drawn over their document page
+// are drawn in the light theme.
+func VisualizePDF(ctx context.Context, zip *archive.Zip, pages []int, outputPath string, config VisualizationConfig) error {
+	pdfPages := make([]PDFPage, 0, len(pages))
+	for _, p := range pages {
+		if p < 0 || p >= len(zip.Pages) {
+			continue
+		}
+		pageConfig := config
+		if drawnOverDocument(zip, zip.Pages[p], config) {
+			pageConfig.Theme = ThemeLight
+		}
+		pdfPages = append(pdfPages, PDFPage{Page: p, Content: PDFContent(zip.Pages[p].Data, pageConfig)})
+	}
+
+	slog.DebugContext(ctx, "Rendering pages to PDF", "pages", len(pdfPages), "file", outputPath)
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	if err := WritePDF(ctx, file, zip, pdfPages, config); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// PDFContent returns the strokes of a page as a PDF content stream in device
+// coordinates, y pointing down. As in WriteSVG the highlighters of all layers
+// are drawn underneath the other strokes, and strokes are filled outlines
+// following the width, color and opacity of their pen.
+func PDFContent(pageData *rm.Rm, config VisualizationConfig) []byte {
+	var out bytes.Buffer
+	if pageData == nil {
+		return out.Bytes()
+	}
+	writePDFStrokes(&out, pageData, config, true)
+	writePDFStrokes(&out, pageData, config, false)
+	return out.Bytes()
+}
+
+func writePDFStrokes(out *bytes.Buffer, pageData *rm.Rm, config VisualizationConfig, highlighters bool) {
+	identity := func(x, y float32) (float32, float32) { return x, y }
+	for _, layer := range pageData.Layers {
+		for _, line := range layer.Lines {
+			if line.BrushType == rm.EraseArea || len(line.Points) < 2 {
+				continue
+			}
+			isHighlighter := line.BrushType == rm.Highlighter || line.BrushType == rm.HighlighterV5
+			if isHighlighter != highlighters {
+				continue
+			}
+
+			pen := NewPenRendererWithPalette(line.BrushType, uint32(line.BrushColor), line.BrushSize, config.Palette)
+			if isHighlighter {
+				writePDFHighlighter(out, line, pen, config)
+				continue
+			}
+			grain := config.Texture && pen.texture() == textureGrain
+			for _, run := range strokeRuns(line, pen, config, identity) {
+				writePDFOutline(out, run, grain)
+			}
+		}
+	}
+}
+
+// writePDFHighlighter strokes a highlighter as a thick, semi-transparent
+// polyline.
+func writePDFHighlighter(out *bytes.Buffer, line rm.Line, pen *PenRenderer, config VisualizationConfig) {
+	fmt.Fprintf(out, "%s RG %s %d w\n", pdfColor(config.highlightColor(lightenColor(pen.baseColor))), pdfOpacity(highlighterOpacity), calculateHighlighterWidth(config))
+	for i, p := range line.Points {
+		op := "l"
+		if i == 0 {
+			op = "m"
+		}
+		fmt.Fprintf(out, "%s %s %s\n", pdfNum(p.X), pdfNum(p.Y), op)
+	}
+	out.WriteString("S\n")
+}
+
+// writePDFOutline fills points of the same color and opacity as the outline
+// of a variable width line with round caps, as writeSVGOutline. With grain,
+// the outline is filled with the grain pattern of the page in that color.
+func writePDFOutline(out *bytes.Buffer, points []strokePoint, grain bool) {
+	first, last := points[0], points[len(points)-1]
+	if grain {
+		fmt.Fprintf(out, "/Grain cs %s /Grain scn %s\n", pdfColor(first.color), pdfOpacity(first.opacity))
+	} else {
+		fmt.Fprintf(out, "%s rg %s\n", pdfColor(first.color), pdfOpacity(first.opacity))
+	}
+	if len(points) == 1 {
+		writePDFCircle(out, first)
+		return
+	}
+
+	left, right := outlineSides(points)
+	fmt.Fprintf(out, "%s m\n", pdfPoint(left[0]))
+	for _, l := range left[1:] {
+		fmt.Fprintf(out, "%s l\n", pdfPoint(l))
+	}
+	writePDFCap(out, last, left[len(left)-1], right[len(right)-1])
+	for i := len(right) - 2; i >= 0; i-- {
+		fmt.Fprintf(out, "%s l\n", pdfPoint(right[i]))
+	}
+	writePDFCap(out, first, right[0], left[0])
+	out.WriteString("h f\n")
+}
+
+// writePDFCap draws the half circle around p from one side of the outline to
+// the opposite side, as two quarter circles. The apex of the cap is ahead of
+// the line on its left side, so behind it on its right side.
+func writePDFCap(out *bytes.Buffer, p strokePoint, from, to [2]float32) {
+	ux, uy := from[0]-p.x, from[1]-p.y
+	apex := [2]float32{p.x + uy, p.y - ux}
+	writePDFQuarter(out, p, from, apex)
+	writePDFQuarter(out, p, apex, to)
+}
+
+// writePDFQuarter draws a quarter circle around p from a to b.
+func writePDFQuarter(out *bytes.Buffer, p strokePoint, a, b [2]float32) {
+	c1 := [2]float32{a[0] + (b[0]-p.x)*bezierCircle, a[1] + (b[1]-p.y)*bezierCircle}
+	c2 := [2]float32{b[0] + (a[0]-p.x)*bezierCircle, b[1] + (a[1]-p.y)*bezierCircle}
+	fmt.Fprintf(out, "%s %s %s c\n", pdfPoint(c1), pdfPoint(c2), pdfPoint(b))
+}
+
+// writePDFCircle fills a single point stroke.
+func writePDFCircle(out *bytes.Buffer, p strokePoint) {
+	r := p.radius
+	top := [2]float32{p.x, p.y - r}
+	fmt.Fprintf(out, "%s m\n", pdfPoint(top))
+	writePDFQuarter(out, p, top, [2]float32{p.x + r, p.y})
+	writePDFQuarter(out, p, [2]float32{p.x + r, p.y}, [2]float32{p.x, p.y + r})
+	writePDFQuarter(out, p, [2]float32{p.x, p.y + r}, [2]float32{p.x - r, p.y})
+	writePDFQuarter(out, p, [2]float32{p.x - r, p.y}, top)
+	out.WriteString("h f\n")
+}
+
+// writePDFTemplate fills the rectangles of a page template.
+func writePDFTemplate(out *bytes.Buffer, rects []templateRect, c [3]uint8) {
+	if len(rects) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "%s rg %s\n", pdfColor(c), pdfOpacity(1))
+	for _, r := range rects {
+		fmt.Fprintf(out, "%s %s %s %s re\n", pdfNum(r.x), pdfNum(r.y), pdfNum(r.w), pdfNum(r.h))
+	}
+	out.WriteString("f\n")
+}
+
+// WritePDF writes the pages as a PDF document, the strokes of a page at its
+// true size. With config.Background, pages of annotated PDFs and EPUBs are
+// drawn over their page of the document (zip.Payload) and take its size,
+// other pages are drawn over their template with config.Template. With
+// config.Texture, pages hold the grain pattern of pencil strokes. Pages not
+// drawn over their document page are filled with the paper of config.Theme.
+func WritePDF(ctx context.Context, w io.Writer, zip *archive.Zip, pages []PDFPage, config VisualizationConfig) error {
+	var background *pdfBackground
+	if config.Background && hasDocumentPDF(zip) {
+		var err error
+		background, err = newPDFBackground(zip.Payload)
+		if err != nil {
+			slog.WarnContext(ctx, "Can't read the document PDF, rendering without background", "err", err)
+		}
+	}
+
+	pw := newPDFWriter(w)
+	pw.printf("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+	catalog, pageTree, opacities := pw.alloc(), pw.alloc(), pw.alloc()
+
+	var kids []int
+	for _, page := range pages {
+		obj := pw.alloc()
+		kids = append(kids, obj)
+
+		// a page of the size of the device screen, or of the document page
+		// fit to the screen as the device does
+		width, height := float64(rm.Width)*72/deviceDPI, float64(rm.Height)*72/deviceDPI
+		box := model.PdfRectangle{Urx: width, Ury: height}
+		var form int
+		overDocument := background != nil && page.Page < len(zip.Pages) && zip.Pages[page.Page].DocPage >= 0
+		if overDocument {
+			docForm, docBox, err := background.importPage(pw, zip.Pages[page.Page].DocPage)
+			if err != nil {
+				slog.WarnContext(ctx, "Can't import the document page, rendering without background", "page", page.Page, "err", err)
+			} else {
+				form, box = docForm, docBox
+			}
+		}
+		scale := documentScale(box)
+
+		var content bytes.Buffer
+		resources := fmt.Sprintf("/ExtGState %d 0 R", opacities)
+		if form != 0 {
+			fmt.Fprintf(&content, "q /Background Do Q\n")
+			resources += fmt.Sprintf(" /XObject << /Background %d 0 R >>", form)
+		}
+		if config.Texture {
+			// the pattern space is the default space of the page, not the device
+			grain := pw.alloc()
+			pw.stream(grain, fmt.Sprintf("/PatternType 1 /PaintType 2 /TilingType 1 /BBox [0 0 %d %d] /XStep %d /YStep %d /Resources << >> /Matrix [%s 0 0 %s %s %s]",
+				grainCell, grainCell, grainCell, grainCell, pdfFloat(scale), pdfFloat(-scale), pdfFloat(box.Llx), pdfFloat(box.Ury)), pdfGrainPattern())
+			resources += fmt.Sprintf(" /ColorSpace << /Grain [/Pattern /DeviceRGB] >> /Pattern << /Grain %d 0 R >>", grain)
+		}
+		if paper, ok := config.paperColor(); ok && paper != whitePaper && !overDocument {
+			fmt.Fprintf(&content, "%s rg %s %s %s %s re f\n", pdfColor(paper), pdfFloat(box.Llx), pdfFloat(box.Lly), pdfFloat(box.Width()), pdfFloat(box.Height()))
+		}
+		fmt.Fprintf(&content, "q %s 0 0 %s %s %s cm 1 J 1 j\n", pdfFloat(scale), pdfFloat(-scale), pdfFloat(box.Llx), pdfFloat(box.Ury))
+		if form == 0 && config.Template && page.Page < len(zip.Pages) {
+			writePDFTemplate(&content, pageTemplate(zip.Pages[page.Page].Pagedata), config.inkColor(templateColor))
+		}
+		content.Write(page.Content)
+		content.WriteString("Q\n")
+		contents := pw.alloc()
+		pw.stream(contents, "", content.Bytes())
+
+		pw.begin(obj)
+		pw.printf("<< /Type /Page /Parent %d 0 R /MediaBox [%s %s %s %s] /Resources << %s >> /Contents %d 0 R >>\n",
+			pageTree, pdfFloat(box.Llx), pdfFloat(box.Lly), pdfFloat(box.Urx), pdfFloat(box.Ury), resources, contents)
+		pw.end()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	// a graphics state per quantized opacity, named after pdfOpacity
+	pw.begin(opacities)
+	pw.printf("<<")
+	for i := 0; i <= opacitySteps; i++ {
+		pw.printf(" /O%d << /ca %s /CA %s >>", i, pdfFloat(float64(i)/opacitySteps), pdfFloat(float64(i)/opacitySteps))
+	}
+	pw.printf(" >>\n")
+	pw.end()
+
+	pw.begin(pageTree)
+	pw.printf("<< /Type /Pages /Count %d /Kids [", len(kids))
+	for _, kid := range kids {
+		pw.printf(" %d 0 R", kid)
+	}
+	pw.printf(" ] >>\n")
+	pw.end()
+
+	pw.begin(catalog)
+	pw.printf("<< /Type /Catalog /Pages %d 0 R >>\n", pageTree)
+	pw.end()
+	return pw.close(catalog)
+}
+
+// pdfWriter writes the objects of a PDF file and its cross-reference table.
+type pdfWriter struct {
+	w       *bufio.Writer
+	written int64
+	offsets []int64 // offsets of the objects, by object number - 1
+	err     error
+}
+
+func newPDFWriter(w io.Writer) *pdfWriter {
+	return &pdfWriter{w: bufio.NewWriter(w)}
+}
+
+func (pw *pdfWriter) printf(format string, args ...interface{}) {
+	pw.write([]byte(fmt.Sprintf(format, args...)))
+}
+
+func (pw *pdfWriter) write(data []byte) {
+	if pw.err != nil {
+		return
+	}
+	n, err := pw.w.Write(data)
+	pw.written += int64(n)
+	pw.err = err
+}
+
+// alloc reserves an object number.
+func (pw *pdfWriter) alloc() int {
+	pw.offsets = append(pw.offsets, 0)
+	return len(pw.offsets)
+}
+
+func (pw *pdfWriter) begin(obj int) {
+	pw.offsets[obj-1] = pw.written
+	pw.printf("%d 0 obj\n", obj)
+}
+
+func (pw *pdfWriter) end() {
+	pw.printf("endobj\n")
+}
+
+// stream writes a stream object compressing data, dict holds the entries of
+// the stream dictionary besides its length and filter.
+func (pw *pdfWriter) stream(obj int, dict string, data []byte) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(data)
+	zw.Close()
+	if dict != "" {
+		dict += " "
+	}
+	pw.begin(obj)
+	pw.printf("<< %s/Length %d /Filter /FlateDecode >>\nstream\n", dict, compressed.Len())
+	pw.write(compressed.Bytes())
+	pw.printf("\nendstream\n")
+	pw.end()
+}
+
+// close writes the cross-reference table and the trailer.
+func (pw *pdfWriter) close(root int) error {
+	xref := pw.written
+	pw.printf("xref\n0 %d\n0000000000 65535 f \n", len(pw.offsets)+1)
+	for _, offset := range pw.offsets {
+		pw.printf("%010d 00000 n \n", offset)
+	}
+	pw.printf("trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(pw.offsets)+1, root, xref)
+	if pw.err != nil {
+		return pw.err
+	}
+	return pw.w.Flush()
+}
+
+// pdfBackground imports pages of the document PDF as form XObjects. Objects
+// shared by pages, such as fonts, are written once.
+type pdfBackground struct {
+	reader   *model.PdfReader
+	imported map[core.PdfObject]int // source objects to their object number
+	pending  []core.PdfObject       // source objects imported but not written yet
+}
+
+func newPDFBackground(data []byte) (*pdfBackground, error) {
+	reader, err := openDocumentPDF(data)
+	if err != nil {
+		return nil, err
+	}
+	return &pdfBackground{reader: reader, imported: make(map[core.PdfObject]int)}, nil
+}
+
+// importPage writes page (0-indexed) of the document as a form XObject and
+// returns its object number and the page box.
+func (b *pdfBackground) importPage(pw *pdfWriter, docPage int) (int, model.PdfRectangle, error) {
+	page, err := b.reader.GetPage(docPage + 1)
+	if err != nil {
+		return 0, model.PdfRectangle{}, err
+	}
+	box, err := page.GetMediaBox()
+	if err != nil {
+		return 0, model.PdfRectangle{}, err
+	}
+	content, err := page.GetAllContentStreams()
+	if err != nil {
+		return 0, model.PdfRectangle{}, err
+	}
+
+	var dict bytes.Buffer
+	fmt.Fprintf(&dict, "/Type /XObject /Subtype /Form /BBox [%s %s %s %s]", pdfFloat(box.Llx), pdfFloat(box.Lly), pdfFloat(box.Urx), pdfFloat(box.Ury))
+	if page.Resources != nil {
+		dict.WriteString(" /Resources ")
+		b.writeObject(pw, &dict, page.Resources.ToPdfObject())
+	}
+	form := pw.alloc()
+	pw.stream(form, dict.String(), []byte(content))
+
+	for len(b.pending) > 0 {
+		obj := b.pending[0]
+		b.pending = b.pending[1:]
+		b.writeIndirect(pw, obj)
+	}
+	return form, *box, pw.err
+}
+
+// writeObject writes a source object in PDF syntax, replacing references by
+// references to the imported objects.
+func (b *pdfBackground) writeObject(pw *pdfWriter, out *bytes.Buffer, obj core.PdfObject) {
+	switch o := obj.(type) {
+	case *core.PdfObjectReference:
+		b.writeObject(pw, out, o.Resolve())
+	case *core.PdfIndirectObject, *core.PdfObjectStream:
+		num, ok := b.imported[o]
+		if !ok {
+			num = pw.alloc()
+			b.imported[o] = num
+			b.pending = append(b.pending, o)
+		}
+		fmt.Fprintf(out, "%d 0 R", num)
+	case *core.PdfObjectDictionary:
+		out.WriteString("<<")
+		for _, key := range o.Keys() {
+			if key == "Parent" {
+				// would import the whole page tree
+				continue
+			}
+			out.WriteString(" " + key.WriteString() + " ")
+			b.writeObject(pw, out, o.Get(key))
+		}
+		out.WriteString(" >>")
+	case *core.PdfObjectArray:
+		out.WriteString("[")
+		for _, elem := range o.Elements() {
+			out.WriteString(" ")
+			b.writeObject(pw, out, elem)
+		}
+		out.WriteString(" ]")
+	case nil:
+		out.WriteString("null")
+	default:
+		out.WriteString(obj.WriteString())
+	}
+}
+
+// writeIndirect writes an imported indirect object or stream.
+func (b *pdfBackground) writeIndirect(pw *pdfWriter, obj core.PdfObject) {
+	num := b.imported[obj]
+	var out bytes.Buffer
+	switch o := obj.(type) {
+	case *core.PdfIndirectObject:
+		b.writeObject(pw, &out, o.PdfObject)
+		pw.begin(num)
+		pw.write(out.Bytes())
+		pw.printf("\n")
+		pw.end()
+	case *core.PdfObjectStream:
+		out.WriteString("<<")
+		for _, key := range o.PdfObjectDictionary.Keys() {
+			if key == "Length" {
+				continue
+			}
+			out.WriteString(" " + key.WriteString() + " ")
+			b.writeObject(pw, &out, o.PdfObjectDictionary.Get(key))
+		}
+		fmt.Fprintf(&out, " /Length %d >>\nstream\n", len(o.Stream))
+		pw.begin(num)
+		pw.write(out.Bytes())
+		pw.write(o.Stream)
+		pw.printf("\nendstream\n")
+		pw.end()
+	}
+}
+
+// pdfOpacity selects the graphics state of a quantized opacity.
+func pdfOpacity(opacity float32) string {
+	return fmt.Sprintf("/O%d gs", int(math.Round(float64(opacity*opacitySteps))))
+}
+
+func pdfColor(c [3]uint8) string {
+	return pdfFloat(float64(c[0])/255) + " " + pdfFloat(float64(c[1])/255) + " " + pdfFloat(float64(c[2])/255)
+}
+
+func pdfPoint(p [2]float32) string {
+	return pdfNum(p[0]) + " " + pdfNum(p[1])
+}
+
+// pdfNum formats a coordinate as svgNum, PDF numbers have the same syntax.
+func pdfNum(v float32) string {
+	return svgNum(v)
+}
+
+func pdfFloat(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 4, 64)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
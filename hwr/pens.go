@@ -62,13 +62,21 @@ type PenRenderer struct {
 // NewPenRenderer creates a pen renderer for a given brush type, color, and size.
 // It configures pen-specific properties like base width and opacity.
 func NewPenRenderer(brushType rm.BrushType, colorID uint32, brushSize rm.BrushSize) *PenRenderer {
+	return NewPenRendererWithPalette(brushType, colorID, brushSize, nil)
+}
+
+// NewPenRendererWithPalette is NewPenRenderer taking colors from palette,
+// then from ColorPalette.
+func NewPenRendererWithPalette(brushType rm.BrushType, colorID uint32, brushSize rm.BrushSize, palette map[uint32][3]uint8) *PenRenderer {
 	pr := &PenRenderer{
 		penType:     brushType,
 		baseOpacity: opacityFull,
 	}
 
 	// Get color from palette, default to black if not found
-	if color, ok := ColorPalette[colorID]; ok {
+	if color, ok := palette[colorID]; ok {
+		pr.baseColor = color
+	} else if color, ok := ColorPalette[colorID]; ok {
 		pr.baseColor = color
 	} else {
 		pr.baseColor = ColorPalette[0] // Default to black
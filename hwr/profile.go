@@ -0,0 +1,165 @@
+package hwr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/go-openapi/strfmt"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ddvk/rmapi-hwr/hwr/models"
+)
+
+// builtinProfiles are the named recognition profiles usable instead of a profile file.
+var builtinProfiles = map[string]func() *models.Configuration{
+	// notes: handwritten notes on blank or lined pages
+	"notes": func() *models.Configuration {
+		return &models.Configuration{
+			Text: &models.TextConfiguration{
+				Configuration: &models.TextConfConfiguration{
+					AddLKText: true,
+				},
+			},
+			Export: &models.ExportConfiguration{
+				Jiix: &models.JiixConfiguration{
+					BoundingBox: true,
+					Text: &models.JiixTextConfiguration{
+						Words: true,
+					},
+				},
+			},
+		}
+	},
+	// math-homework: equations, with the solver computing results
+	"math-homework": func() *models.Configuration {
+		return &models.Configuration{
+			Math: &models.MathConfiguration{
+				Solver: &models.SolverConfiguration{
+					Enable:               true,
+					FractionMode:         "rational",
+					FractionalPartDigits: 3,
+					AngleUnit:            "deg",
+					RoundingMode:         "half up",
+				},
+				Margin: &models.MarginConfiguration{
+					Top:    20,
+					Bottom: 20,
+					Left:   20,
+					Right:  20,
+				},
+			},
+		}
+	},
+	// whiteboard: sketches mixing shapes, arrows and text
+	"whiteboard": func() *models.Configuration {
+		return &models.Configuration{
+			Diagram: &models.DiagramConfiguration{
+				EnableSubBlocks: true,
+				Convert: &models.DiagramConvertConfiguration{
+					Node: true,
+					Edge: true,
+					Text: true,
+				},
+			},
+			RawContent: &models.RawContentConfiguration{
+				Recognition: &models.Recognition{
+					Text:  true,
+					Shape: true,
+				},
+			},
+			Export: &models.ExportConfiguration{
+				Jiix: &models.JiixConfiguration{
+					BoundingBox: true,
+				},
+			},
+		}
+	},
+}
+
+// ProfileNames returns the names of the built-in profiles.
+func ProfileNames() []string {
+	names := make([]string, 0, len(builtinProfiles))
+	for name := range builtinProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BuiltinProfile returns a copy of the named built-in profile.
+func BuiltinProfile(name string) (*models.Configuration, bool) {
+	profile, ok := builtinProfiles[name]
+	if !ok {
+		return nil, false
+	}
+	return profile(), true
+}
+
+// LoadProfile returns the built-in profile called name, or reads the
+// YAML or JSON profile file at that path.
+func LoadProfile(name string) (*models.Configuration, error) {
+	if profile, ok := BuiltinProfile(name); ok {
+		return profile, nil
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't read profile (built-in profiles: %v): %w", ProfileNames(), err)
+	}
+	profile, err := ParseProfile(data)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+	return profile, nil
+}
+
+// ParseProfile parses a YAML or JSON profile into a validated configuration.
+// Keys are the ones of the MyScript configuration, e.g. raw-content or bounding-box.
+func ParseProfile(data []byte) (*models.Configuration, error) {
+	// JSON is valid YAML, so both go through the YAML decoder and are
+	// then converted to JSON to reuse the json tags of the models
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("can't parse: %w", err)
+	}
+	if raw == nil {
+		return nil, fmt.Errorf("empty profile")
+	}
+	js, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("can't convert to JSON: %w", err)
+	}
+
+	conf := &models.Configuration{}
+	decoder := json.NewDecoder(bytes.NewReader(js))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(conf); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := conf.Validate(strfmt.Default); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return conf, nil
+}
+
+// copyConfiguration returns a deep copy of conf, so that a profile shared
+// between pages is never modified.
+func copyConfiguration(conf *models.Configuration) *models.Configuration {
+	if conf == nil {
+		return &models.Configuration{}
+	}
+	copied := &models.Configuration{}
+	js, err := conf.MarshalBinary()
+	if err == nil {
+		err = copied.UnmarshalBinary(js)
+	}
+	if err != nil {
+		// the models always marshal, fall back to a shallow copy
+		shallow := *conf
+		return &shallow
+	}
+	return copied
+}
@@ -0,0 +1,147 @@
+package hwr
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"golang.org/x/image/vector"
+)
+
+// strokeRasterizer fills strokes onto an image with coverage anti-aliasing.
+// A stroke is the union of a disc per point and of the quadrilaterals joining
+// consecutive discs, which gives it round joins and caps.
+type strokeRasterizer struct {
+	img   *image.RGBA
+	scale float32 // Supersampling factor, applied to the radius of points
+	z     vector.Rasterizer
+}
+
+// fill fills points of the same color and opacity as one shape, so that
+// overlapping parts of the stroke are not blended twice. With grain, the
+// grain of the paper shows through.
+func (r *strokeRasterizer) fill(points []strokePoint, grain bool) {
+	if len(points) == 0 || points[0].opacity <= 0 {
+		return
+	}
+	bounds := r.bounds(points)
+	if bounds.Empty() {
+		return
+	}
+
+	// The rasterizer covers the bounds of the stroke only
+	ox, oy := float32(bounds.Min.X), float32(bounds.Min.Y)
+	r.z.Reset(bounds.Dx(), bounds.Dy())
+	r.z.DrawOp = draw.Over
+	for i, p := range points {
+		r.addDisc(p.x-ox, p.y-oy, p.radius*r.scale)
+		if i > 0 {
+			prev := points[i-1]
+			r.addJoin(prev.x-ox, prev.y-oy, prev.radius*r.scale, p.x-ox, p.y-oy, p.radius*r.scale)
+		}
+	}
+
+	c := points[0].color
+	fill := color.NRGBA{c[0], c[1], c[2], uint8(255*points[0].opacity + 0.5)}
+	var src image.Image = image.NewUniform(fill)
+	if grain {
+		src = &paperGrain{c: fill, cell: int(r.scale)}
+	}
+	r.z.Draw(r.img, bounds, src, bounds.Min)
+}
+
+// bounds returns the pixels of the image covered by points.
+func (r *strokeRasterizer) bounds(points []strokePoint) image.Rectangle {
+	if len(points) == 0 {
+		return image.Rectangle{}
+	}
+	minX, minY := float32(math.MaxFloat32), float32(math.MaxFloat32)
+	maxX, maxY := float32(-math.MaxFloat32), float32(-math.MaxFloat32)
+	for _, p := range points {
+		radius := p.radius * r.scale
+		if p.x-radius < minX {
+			minX = p.x - radius
+		}
+		if p.y-radius < minY {
+			minY = p.y - radius
+		}
+		maxX, maxY = max(maxX, p.x+radius), max(maxY, p.y+radius)
+	}
+	return image.Rect(int(math.Floor(float64(minX))), int(math.Floor(float64(minY))),
+		int(math.Ceil(float64(maxX))), int(math.Ceil(float64(maxY)))).Intersect(r.img.Bounds())
+}
+
+// addDisc adds a circle of four cubic Bézier curves, clockwise on the image
+// like the quadrilaterals of addJoin. Shapes of the same winding add up to
+// their union.
+func (r *strokeRasterizer) addDisc(cx, cy, radius float32) {
+	k := radius * bezierCircle
+	r.z.MoveTo(cx, cy-radius)
+	r.z.CubeTo(cx+k, cy-radius, cx+radius, cy-k, cx+radius, cy)
+	r.z.CubeTo(cx+radius, cy+k, cx+k, cy+radius, cx, cy+radius)
+	r.z.CubeTo(cx-k, cy+radius, cx-radius, cy+k, cx-radius, cy)
+	r.z.CubeTo(cx-radius, cy-k, cx-k, cy-radius, cx, cy-radius)
+	r.z.ClosePath()
+}
+
+// addJoin adds the quadrilateral between the discs of two consecutive points.
+func (r *strokeRasterizer) addJoin(x1, y1, r1, x2, y2, r2 float32) {
+	dx, dy := x2-x1, y2-y1
+	length := float32(math.Hypot(float64(dx), float64(dy)))
+	if length == 0 {
+		return
+	}
+	nx, ny := -dy/length, dx/length
+	quad := [4][2]float32{
+		{x1 + nx*r1, y1 + ny*r1},
+		{x2 + nx*r2, y2 + ny*r2},
+		{x2 - nx*r2, y2 - ny*r2},
+		{x1 - nx*r1, y1 - ny*r1},
+	}
+	// Keep the winding of the discs whatever the direction of the segment
+	var area float32
+	for i, a := range quad {
+		b := quad[(i+1)%len(quad)]
+		area += a[0]*b[1] - b[0]*a[1]
+	}
+	if area < 0 {
+		quad[1], quad[3] = quad[3], quad[1]
+	}
+	r.z.MoveTo(quad[0][0], quad[0][1])
+	for _, p := range quad[1:] {
+		r.z.LineTo(p[0], p[1])
+	}
+	r.z.ClosePath()
+}
+
+// downsample averages blocks of factor x factor pixels of a supersampled
+// layer and draws them over img.
+func downsample(img, layer *image.RGBA, factor int) {
+	bounds := img.Bounds()
+	n := uint32(factor * factor)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var sum [4]uint32
+			for sy := 0; sy < factor; sy++ {
+				i := layer.PixOffset(x*factor, y*factor+sy)
+				for sx := 0; sx < factor; sx++ {
+					for c := range sum {
+						sum[c] += uint32(layer.Pix[i+c])
+					}
+					i += 4
+				}
+			}
+			if sum[3] == 0 {
+				continue
+			}
+
+			// Premultiplied source over destination
+			alpha := sum[3] / n
+			i := img.PixOffset(x, y)
+			for c := range sum {
+				img.Pix[i+c] = uint8(sum[c]/n + uint32(img.Pix[i+c])*(255-alpha)/255)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package hwr
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juruen/rmapi/archive"
+	"github.com/juruen/rmapi/encoding/rm"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden images of testdata/golden")
+
+// goldenTolerance is how far a channel of a pixel may drift from its golden
+// image, for float rounding across platforms.
+const goldenTolerance = 2
+
+// goldenBrushes are the pens drawn to golden images.
+// Their StrokeWidthScale is thick enough that no pen is clamped to
+// MinStrokeWidth, and thin enough that the highlighter, 60 times the scale
+// in pixels, stays below highlighterMaxWidth and inside the image.
+var goldenBrushes = []struct {
+	name       string
+	brush      rm.BrushType
+	widthScale float32
+}{
+	{"ballpoint", rm.BallPointV5, 2},
+	{"fineliner", rm.FinelinerV5, 2},
+	{"marker", rm.MarkerV5, 2},
+	{"highlighter", rm.HighlighterV5, 0.5},
+	{"tilt_pencil", rm.TiltPencilV5, 2},
+	{"sharp_pencil", rm.SharpPencilV5, 2},
+	{"brush", rm.BrushV5, 2},
+	{"calligraphy", calligraphyPen, 2},
+}
+
+// goldenStroke is a wave with changing pressure, speed and tilt, so every
+// pen shows how its width and texture follow them.
+func goldenStroke(brush rm.BrushType) *rm.Rm {
+	line := rm.Line{BrushType: brush, BrushColor: rm.Black, BrushSize: rm.Medium}
+	for i := 0; i <= 60; i++ {
+		t := float64(i) / 60
+		line.Points = append(line.Points, rm.Point{
+			X:         float32(300 + 600*t),
+			Y:         float32(500 + 120*math.Sin(2*math.Pi*t)),
+			Speed:     float32(1 + 20*t),
+			Direction: float32(2 * math.Pi * t),
+			Width:     float32(8 + 16*math.Sin(math.Pi*t)),
+			Pressure:  float32(0.2 + 0.7*math.Sin(math.Pi*t)),
+		})
+	}
+	return &rm.Rm{Version: rm.V5, Layers: []rm.Layer{{Lines: []rm.Line{line}}}}
+}
+
+func TestRenderGolden(t *testing.T) {
+	for _, supersampling := range []int{defaultSupersampling, 4} {
+		for _, b := range goldenBrushes {
+			name := fmt.Sprintf("%s_x%d", b.name, supersampling)
+			t.Run(name, func(t *testing.T) {
+				config := DefaultVisualizationConfig()
+				config.OutputWidth = 320
+				config.Supersampling = supersampling
+				config.StrokeWidthScale = b.widthScale
+				config.Texture = true
+				zip := &archive.Zip{Pages: []archive.Page{{Data: goldenStroke(b.brush)}}}
+				img := RenderPage(context.Background(), zip, 0, config)
+				if img == nil {
+					t.Fatal("no image rendered")
+				}
+				checkGolden(t, filepath.Join("testdata", "golden", name+".png"), img)
+			})
+		}
+	}
+}
+
+// checkGolden compares img with the golden image at path, or rewrites it
+// with -update.
+func checkGolden(t *testing.T, path string, img *image.RGBA) {
+	t.Helper()
+	if *update {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("%v, run go test -update to write it", err)
+	}
+	defer file.Close()
+	golden, err := png.Decode(file)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	if golden.Bounds() != img.Bounds() {
+		t.Fatalf("rendered %v, golden image is %v", img.Bounds(), golden.Bounds())
+	}
+
+	differ := 0
+	var first [2]int
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			r1, g1, b1, a1 := img.At(x, y).RGBA()
+			r2, g2, b2, a2 := golden.At(x, y).RGBA()
+			if channelDiff(r1, r2) > goldenTolerance || channelDiff(g1, g2) > goldenTolerance ||
+				channelDiff(b1, b2) > goldenTolerance || channelDiff(a1, a2) > goldenTolerance {
+				if differ == 0 {
+					first = [2]int{x, y}
+				}
+				differ++
+			}
+		}
+	}
+	if differ > 0 {
+		t.Errorf("%d pixels differ from %s, first at %v", differ, path, first)
+	}
+}
+
+// channelDiff returns the difference of two 16-bit channels in 8 bits.
+func channelDiff(a, b uint32) int {
+	d := int(a>>8) - int(b>>8)
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,163 @@
+package hwr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ddvk/rmapi-hwr/hwr/models"
+)
+
+// RawContentType is the MyScript content type of free-form pages.
+const RawContentType = "Raw Content"
+
+// IsRawContent reports whether an input type (raw or Raw Content) selects raw content recognition.
+func IsRawContent(inputType string) bool {
+	return strings.EqualFold(inputType, "raw") || strings.EqualFold(inputType, RawContentType)
+}
+
+// RawTextBlock is a block of recognized text.
+type RawTextBlock struct {
+	ID    string      `json:"id"`
+	Label string      `json:"label"`
+	Box   BoundingBox `json:"boundingBox"`
+}
+
+// RawShape is a recognized shape.
+type RawShape struct {
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"` // line, arrow, circle, ellipse, rectangle, ...
+	Box        BoundingBox `json:"boundingBox"`
+	ArrowStart bool        `json:"arrowStart,omitempty"`
+	ArrowEnd   bool        `json:"arrowEnd,omitempty"`
+}
+
+// RawDrawing is ink that was neither recognized as text nor as a shape.
+type RawDrawing struct {
+	ID  string      `json:"id"`
+	Box BoundingBox `json:"boundingBox"`
+}
+
+// RawContentResult is the classified content of a free-form page.
+type RawContentResult struct {
+	Text     []RawTextBlock `json:"text"`
+	Shapes   []RawShape     `json:"shapes"`
+	Drawings []RawDrawing   `json:"drawings"`
+}
+
+// rawJiixElement is the subset of a JIIX raw content element used to classify it.
+type rawJiixElement struct {
+	Type         string          `json:"type"`
+	Kind         string          `json:"kind"`
+	ID           json.RawMessage `json:"id"`
+	Label        string          `json:"label"`
+	BoundingBox  *BoundingBox    `json:"bounding-box"`
+	P1Decoration string          `json:"p1Decoration"`
+	P2Decoration string          `json:"p2Decoration"`
+	Words        []struct {
+		Label string `json:"label"`
+	} `json:"words"`
+	Elements []rawJiixElement `json:"elements"`
+	Children []rawJiixElement `json:"children"`
+}
+
+// enableRawContentRecognition turns on text and shape recognition unless the
+// profile already configures it.
+func enableRawContentRecognition(conf *models.Configuration) {
+	if conf.RawContent == nil {
+		conf.RawContent = &models.RawContentConfiguration{}
+	}
+	if conf.RawContent.Recognition == nil {
+		conf.RawContent.Recognition = &models.Recognition{
+			Text:  true,
+			Shape: true,
+		}
+	}
+}
+
+// ParseRawContentJiix classifies the elements of a JIIX raw content result
+// into text blocks, shapes and unclassified drawings.
+func ParseRawContentJiix(data []byte) (*RawContentResult, error) {
+	var root rawJiixElement
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("can't parse JIIX: %w", err)
+	}
+	if root.Type != "" && !strings.EqualFold(root.Type, RawContentType) {
+		return nil, fmt.Errorf("not a raw content result: %s", root.Type)
+	}
+
+	result := &RawContentResult{
+		Text:     []RawTextBlock{},
+		Shapes:   []RawShape{},
+		Drawings: []RawDrawing{},
+	}
+	var classify func([]rawJiixElement)
+	classify = func(elements []rawJiixElement) {
+		for _, e := range elements {
+			// groups only hold other elements
+			if len(e.Elements) > 0 || len(e.Children) > 0 {
+				classify(e.Elements)
+				classify(e.Children)
+				continue
+			}
+
+			var box BoundingBox
+			if e.BoundingBox != nil {
+				box = *e.BoundingBox
+			}
+			switch strings.ToLower(e.Type) {
+			case "text":
+				label := e.Label
+				if label == "" {
+					words := make([]string, 0, len(e.Words))
+					for _, w := range e.Words {
+						words = append(words, w.Label)
+					}
+					label = strings.Join(words, "")
+				}
+				if strings.TrimSpace(label) == "" {
+					continue
+				}
+				result.Text = append(result.Text, RawTextBlock{
+					ID:    jiixIDOr(e.ID, "t", len(result.Text)),
+					Label: label,
+					Box:   box,
+				})
+			case "node", "edge", "shape":
+				shape := RawShape{
+					ID:         jiixIDOr(e.ID, "s", len(result.Shapes)),
+					Kind:       e.Kind,
+					Box:        box,
+					ArrowStart: isArrow(e.P1Decoration),
+					ArrowEnd:   isArrow(e.P2Decoration),
+				}
+				if shape.ArrowStart || shape.ArrowEnd {
+					shape.Kind = "arrow"
+				}
+				result.Shapes = append(result.Shapes, shape)
+			default:
+				result.Drawings = append(result.Drawings, RawDrawing{
+					ID:  jiixIDOr(e.ID, "d", len(result.Drawings)),
+					Box: box,
+				})
+			}
+		}
+	}
+	classify(root.Elements)
+
+	return result, nil
+}
+
+// FormatRawContent converts a JIIX raw content result to the indented
+// JSON of its RawContentResult.
+func FormatRawContent(data []byte) (string, error) {
+	result, err := ParseRawContentJiix(data)
+	if err != nil {
+		return "", err
+	}
+	js, err := json.MarshalIndent(result, "", "  ")
+	return string(js), err
+}
@@ -0,0 +1,226 @@
+package hwr
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ddvk/rmapi-hwr/hwr/models"
+)
+
+// Limits for custom recognition resources
+const (
+	maxLexiconWords     = 10000     // Maximum number of entries in a lexicon
+	maxLexiconWordLen   = 128       // Maximum length of a lexicon entry in bytes
+	maxMathGrammarBytes = 64 * 1024 // Maximum size of a math grammar
+)
+
+// AllLanguages is the ResourceSet key for resources that apply to every language.
+const AllLanguages = ""
+
+// Resources holds custom recognition resources sent along with a page.
+type Resources struct {
+	// Lexicon is a list of words or expressions added to the text vocabulary
+	Lexicon []string
+	// MathGrammar is the content of a custom math grammar
+	MathGrammar string
+}
+
+// ResourceSet maps a language (e.g. fr_FR) to its custom resources.
+// Resources stored under AllLanguages are used for every language.
+type ResourceSet map[string]Resources
+
+// For returns the resources to use for lang. Lexicons for all languages and
+// for lang are merged; a language specific grammar replaces the generic one.
+func (rs ResourceSet) For(lang string) Resources {
+	common := rs[AllLanguages]
+	res := Resources{
+		Lexicon:     common.Lexicon,
+		MathGrammar: common.MathGrammar,
+	}
+	if lang == AllLanguages {
+		return res
+	}
+
+	specific, ok := rs[lang]
+	if !ok {
+		return res
+	}
+	if len(specific.Lexicon) > 0 {
+		res.Lexicon = mergeLexicons(common.Lexicon, specific.Lexicon)
+	}
+	if specific.MathGrammar != "" {
+		res.MathGrammar = specific.MathGrammar
+	}
+	return res
+}
+
+// AddLexicon adds lexicon words for lang, merging them with any already set.
+func (rs ResourceSet) AddLexicon(lang string, words []string) {
+	res := rs[lang]
+	res.Lexicon = mergeLexicons(res.Lexicon, words)
+	rs[lang] = res
+}
+
+// SetMathGrammar sets the math grammar for lang.
+func (rs ResourceSet) SetMathGrammar(lang string, grammar string) {
+	res := rs[lang]
+	res.MathGrammar = grammar
+	rs[lang] = res
+}
+
+// LoadLexicon reads and validates a lexicon file.
+func LoadLexicon(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read lexicon: %w", err)
+	}
+	words, err := ParseLexicon(data)
+	if err != nil {
+		return nil, fmt.Errorf("lexicon %s: %w", path, err)
+	}
+	return words, nil
+}
+
+// ParseLexicon parses a lexicon: one word or expression per line.
+// Blank lines and lines starting with # are ignored, duplicates are dropped.
+func ParseLexicon(data []byte) ([]string, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("not valid UTF-8")
+	}
+
+	var words []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if len(word) > maxLexiconWordLen {
+			return nil, fmt.Errorf("line %d: entry longer than %d bytes", lineNumber, maxLexiconWordLen)
+		}
+		if strings.IndexFunc(word, unicode.IsControl) >= 0 {
+			return nil, fmt.Errorf("line %d: entry contains control characters", lineNumber)
+		}
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+		words = append(words, word)
+		if len(words) > maxLexiconWords {
+			return nil, fmt.Errorf("more than %d entries", maxLexiconWords)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("no entries")
+	}
+	return words, nil
+}
+
+// LoadMathGrammar reads and validates a math grammar file.
+func LoadMathGrammar(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("can't read math grammar: %w", err)
+	}
+	grammar, err := ParseMathGrammar(data)
+	if err != nil {
+		return "", fmt.Errorf("math grammar %s: %w", path, err)
+	}
+	return grammar, nil
+}
+
+// ParseMathGrammar validates the content of a math grammar.
+func ParseMathGrammar(data []byte) (string, error) {
+	if len(data) > maxMathGrammarBytes {
+		return "", fmt.Errorf("larger than %d bytes", maxMathGrammarBytes)
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("not valid UTF-8")
+	}
+	grammar := strings.TrimSpace(string(data))
+	if grammar == "" {
+		return "", fmt.Errorf("empty grammar")
+	}
+	return grammar, nil
+}
+
+// NewConfiguration builds the recognition configuration for a MyScript
+// content type (Text, Math, Diagram, Raw Content) and language, starting from profile
+// (which may be nil) and attaching the custom resources.
+func NewConfiguration(profile *models.Configuration, contenttype string, lang string, res Resources) *models.Configuration {
+	conf := copyConfiguration(profile)
+	if lang != "" {
+		conf.Lang = lang
+	}
+
+	switch strings.ToLower(contenttype) {
+	case "text":
+		if len(res.Lexicon) > 0 {
+			if conf.Text == nil {
+				conf.Text = &models.TextConfiguration{}
+			}
+			conf.Text.Configuration = withLexicon(conf.Text.Configuration, res.Lexicon)
+		}
+	case "diagram":
+		if len(res.Lexicon) > 0 {
+			if conf.Diagram == nil {
+				conf.Diagram = &models.DiagramConfiguration{}
+			}
+			conf.Diagram.Text = withLexicon(conf.Diagram.Text, res.Lexicon)
+		}
+	case "raw content":
+		enableRawContentRecognition(conf)
+		if len(res.Lexicon) > 0 {
+			conf.RawContent.Text = withLexicon(conf.RawContent.Text, res.Lexicon)
+		}
+	case "math":
+		if res.MathGrammar != "" {
+			if conf.Math == nil {
+				conf.Math = &models.MathConfiguration{}
+			}
+			conf.Math.CustomGrammarContent = res.MathGrammar
+			conf.Math.CustomGrammarID = ""
+		}
+	}
+
+	return conf
+}
+
+// withLexicon adds the lexicon words to a text configuration, creating it if needed.
+func withLexicon(text *models.TextConfConfiguration, lexicon []string) *models.TextConfConfiguration {
+	if text == nil {
+		text = &models.TextConfConfiguration{AddLKText: true}
+	}
+	text.CustomLexicon = mergeLexicons(text.CustomLexicon, lexicon)
+	if text.CustomResources == nil {
+		// the field is not omitempty, send an empty list rather than null
+		text.CustomResources = []string{}
+	}
+	return text
+}
+
+// mergeLexicons appends the words of b missing from a.
+func mergeLexicons(a, b []string) []string {
+	merged := make([]string, 0, len(a)+len(b))
+	seen := make(map[string]bool, len(a)+len(b))
+	for _, words := range [][]string{a, b} {
+		for _, word := range words {
+			if !seen[word] {
+				seen[word] = true
+				merged = append(merged, word)
+			}
+		}
+	}
+	return merged
+}
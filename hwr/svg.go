@@ -0,0 +1,304 @@
+package hwr
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/juruen/rmapi/archive"
+	"github.com/juruen/rmapi/encoding/rm"
+)
+
+// opacitySteps quantizes the opacity of stroke points, a stroke is split in
+// paths where its color or quantized opacity changes.
+const opacitySteps = 20
+
+// VisualizePageSVG renders a page's strokes to an SVG file, framed and scaled
+// as VisualizePageWithConfig renders them to PNG.
+func VisualizePageSVG(zip *archive.Zip, pageNumber int, outputPath string, config VisualizationConfig) error {
+	return VisualizePageSVGContext(context.Background(), zip, pageNumber, outputPath, config)
+}
+
+// VisualizePageSVGContext is VisualizePageSVG, logging with ctx.
+func VisualizePageSVGContext(ctx context.Context, zip *archive.Zip, pageNumber int, outputPath string, config VisualizationConfig) error {
+	if pageNumber < 0 || pageNumber >= len(zip.Pages) {
+		return nil
+	}
+
+	page := zip.Pages[pageNumber]
+	if page.Data == nil {
+		return nil
+	}
+
+	slog.DebugContext(ctx, "Rendering page to SVG", "page", pageNumber, "file", outputPath)
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	if err := writeSVG(file, page.Data, page.Pagedata, config); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// WriteSVG writes the strokes of a page as SVG. Each stroke is a filled
+// outline following the width, color and opacity of its pen at every point,
+// grouped by layer, with the highlighters of all layers underneath the other
+// strokes.
+func WriteSVG(w io.Writer, pageData *rm.Rm, config VisualizationConfig) error {
+	return writeSVG(w, pageData, "", config)
+}
+
+// writeSVG is WriteSVG, drawing the named page template of full pages with
+// config.Template.
+func writeSVG(w io.Writer, pageData *rm.Rm, template string, config VisualizationConfig) error {
+	width, height := config.OutputWidth, minImageHeight
+	bbox := pageBoundingBox(pageData, config)
+	var scale float32 = 1
+	if bbox != nil {
+		scale, _, width, height = calculateImageDimensions(bbox, config)
+		if height < minImageHeight {
+			height = minImageHeight
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(out, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", width, height, width, height)
+	if paper, ok := config.paperColor(); ok {
+		fmt.Fprintf(out, "<rect width=\"%d\" height=\"%d\" fill=\"%s\"/>\n", width, height, svgColor(paper))
+	}
+	if bbox != nil {
+		if config.FullPage && config.Template {
+			writeSVGTemplate(out, pageTemplate(template), config.inkColor(templateColor), bbox, scale)
+		}
+		writeSVGStrokes(out, pageData, bbox, scale, config, true)
+		writeSVGStrokes(out, pageData, bbox, scale, config, false)
+	}
+	fmt.Fprintf(out, "</svg>\n")
+	return out.Flush()
+}
+
+// writeSVGTemplate writes the rectangles of a page template as a path.
+func writeSVGTemplate(out *bufio.Writer, rects []templateRect, c [3]uint8, bbox *boundingBox, scale float32) {
+	if len(rects) == 0 {
+		return
+	}
+	var d strings.Builder
+	for _, r := range rects {
+		x, y := transformPointF(r.x, r.y, bbox, scale)
+		d.WriteString("M" + svgNum(x) + " " + svgNum(y) + "h" + svgNum(r.w*scale) + "v" + svgNum(r.h*scale) + "h" + svgNum(-r.w*scale) + "Z")
+	}
+	fmt.Fprintf(out, "<path id=\"template\" d=\"%s\" fill=\"%s\"/>\n", d.String(), svgColor(c))
+}
+
+// writeSVGStrokes writes the highlighters or the other strokes of every
+// layer, in a group per layer.
+func writeSVGStrokes(out *bufio.Writer, pageData *rm.Rm, bbox *boundingBox, scale float32, config VisualizationConfig, highlighters bool) {
+	group := "strokes"
+	if highlighters {
+		group = "highlighters"
+	}
+	fmt.Fprintf(out, "<g id=\"%s\">\n", group)
+	for i, layer := range pageData.Layers {
+		opened := false
+		for _, line := range layer.Lines {
+			if line.BrushType == rm.EraseArea || len(line.Points) < 2 {
+				continue
+			}
+			isHighlighter := line.BrushType == rm.Highlighter || line.BrushType == rm.HighlighterV5
+			if isHighlighter != highlighters {
+				continue
+			}
+
+			if !opened {
+				fmt.Fprintf(out, "<g id=\"%s-layer-%d\">\n", group, i+1)
+				opened = true
+			}
+			pen := NewPenRendererWithPalette(line.BrushType, uint32(line.BrushColor), line.BrushSize, config.Palette)
+			if isHighlighter {
+				writeSVGHighlighter(out, line, bbox, scale, pen, config)
+			} else {
+				writeSVGStroke(out, line, bbox, scale, pen, config)
+			}
+		}
+		if opened {
+			fmt.Fprintf(out, "</g>\n")
+		}
+	}
+	fmt.Fprintf(out, "</g>\n")
+}
+
+// writeSVGHighlighter writes a highlighter as a thick, semi-transparent
+// polyline, the shape of highlighterShapes.
+func writeSVGHighlighter(out *bufio.Writer, line rm.Line, bbox *boundingBox, scale float32, pen *PenRenderer, config VisualizationConfig) {
+	var d strings.Builder
+	for i, p := range line.Points {
+		x, y := transformPointF(p.X, p.Y, bbox, scale)
+		if i == 0 {
+			d.WriteString("M")
+		} else {
+			d.WriteString(" L")
+		}
+		d.WriteString(svgNum(x) + " " + svgNum(y))
+	}
+	fmt.Fprintf(out, "<path d=\"%s\" fill=\"none\" stroke=\"%s\" stroke-opacity=\"%s\" stroke-width=\"%d\" stroke-linecap=\"round\" stroke-linejoin=\"round\"/>\n",
+		d.String(), svgColor(config.highlightColor(lightenColor(pen.baseColor))), svgNum(highlighterOpacity), calculateHighlighterWidth(config))
+}
+
+// strokePoint is a stroke point in image coordinates with its pen properties.
+type strokePoint struct {
+	x, y    float32
+	radius  float32
+	color   [3]uint8
+	opacity float32
+}
+
+// writeSVGStroke writes a stroke as filled outlines, one per run of points of
+// the same color and opacity.
+func writeSVGStroke(out *bufio.Writer, line rm.Line, bbox *boundingBox, scale float32, pen *PenRenderer, config VisualizationConfig) {
+	runs := strokeRuns(line, pen, config, func(x, y float32) (float32, float32) {
+		return transformPointF(x, y, bbox, scale)
+	})
+	for _, run := range runs {
+		writeSVGOutline(out, run)
+	}
+}
+
+// strokeRuns returns the points of a stroke, transformed to image
+// coordinates, in runs of the same color and quantized opacity. Runs share
+// their boundary point so that the stroke stays continuous. With
+// config.Texture, calligraphy strokes follow their nib and brush strokes
+// their bristles.
+func strokeRuns(line rm.Line, pen *PenRenderer, config VisualizationConfig, transform func(x, y float32) (float32, float32)) [][]strokePoint {
+	points := make([]strokePoint, 0, len(line.Points))
+	for _, p := range line.Points {
+		x, y := transform(p.X, p.Y)
+		if n := len(points); n > 0 && points[n-1].x == x && points[n-1].y == y {
+			continue
+		}
+		opacity := pen.GetStrokeOpacity(p.Speed, p.Direction, p.Width, p.Pressure)
+		points = append(points, strokePoint{
+			x:       x,
+			y:       y,
+			radius:  clampStrokeRadius(pen.GetStrokeWidth(p.Speed, p.Direction, p.Width, p.Pressure)*config.StrokeWidthScale, config),
+			color:   config.inkColor(pen.GetStrokeColor(p.Speed, p.Direction, p.Width, p.Pressure)),
+			opacity: quantizeOpacity(opacity),
+		})
+	}
+	texture := textureNone
+	if config.Texture {
+		texture = pen.texture()
+	}
+	if texture == textureNib {
+		applyNib(points, config)
+	}
+
+	var runs [][]strokePoint
+	start := 0
+	for i := 1; i <= len(points); i++ {
+		if i < len(points) && points[i].color == points[start].color && points[i].opacity == points[start].opacity {
+			continue
+		}
+		end := min(i+1, len(points))
+		if points[start].opacity > 0 {
+			runs = append(runs, points[start:end])
+		}
+		start = i
+	}
+	if texture == textureBristles {
+		return bristleRuns(runs)
+	}
+	return runs
+}
+
+// outlineSides offsets each point along the normal of the line by its
+// radius, on the left and on the right of the line.
+func outlineSides(points []strokePoint) (left, right [][2]float32) {
+	left = make([][2]float32, len(points))
+	right = make([][2]float32, len(points))
+	var nx, ny float32 = 0, -1
+	for i, p := range points {
+		prev, next := points[max(i-1, 0)], points[min(i+1, len(points)-1)]
+		dx, dy := next.x-prev.x, next.y-prev.y
+		if length := float32(math.Hypot(float64(dx), float64(dy))); length > 0 {
+			nx, ny = -dy/length, dx/length
+		}
+		left[i] = [2]float32{p.x + nx*p.radius, p.y + ny*p.radius}
+		right[i] = [2]float32{p.x - nx*p.radius, p.y - ny*p.radius}
+	}
+	return left, right
+}
+
+// writeSVGOutline writes points of the same color and opacity as the outline
+// of a variable width line with round caps.
+func writeSVGOutline(out *bufio.Writer, points []strokePoint) {
+	first := points[0]
+	fill := svgColor(first.color)
+	if first.opacity < 1 {
+		fill += "\" fill-opacity=\"" + svgNum(first.opacity)
+	}
+	if len(points) == 1 {
+		fmt.Fprintf(out, "<circle cx=\"%s\" cy=\"%s\" r=\"%s\" fill=\"%s\"/>\n", svgNum(first.x), svgNum(first.y), svgNum(first.radius), fill)
+		return
+	}
+
+	left, right := outlineSides(points)
+	last := points[len(points)-1]
+	var d strings.Builder
+	d.WriteString("M" + svgPoint(left[0]))
+	for _, l := range left[1:] {
+		d.WriteString(" L" + svgPoint(l))
+	}
+	r := svgNum(last.radius)
+	d.WriteString(" A" + r + " " + r + " 0 0 0 " + svgPoint(right[len(right)-1]))
+	for i := len(right) - 2; i >= 0; i-- {
+		d.WriteString(" L" + svgPoint(right[i]))
+	}
+	r = svgNum(first.radius)
+	d.WriteString(" A" + r + " " + r + " 0 0 0 " + svgPoint(left[0]) + " Z")
+	fmt.Fprintf(out, "<path d=\"%s\" fill=\"%s\"/>\n", d.String(), fill)
+}
+
+// clampStrokeRadius clamps a stroke radius to configured min/max widths.
+func clampStrokeRadius(radius float32, config VisualizationConfig) float32 {
+	if radius < float32(config.MinStrokeWidth) {
+		return float32(config.MinStrokeWidth)
+	}
+	if radius > float32(config.MaxStrokeWidth) {
+		return float32(config.MaxStrokeWidth)
+	}
+	return radius
+}
+
+// transformPointF transforms a point from document coordinates to image
+// coordinates, as transformPoint without rounding.
+func transformPointF(x, y float32, bbox *boundingBox, scale float32) (float32, float32) {
+	return (x - bbox.minX + bbox.paddingX) * scale, (y - bbox.minY + bbox.paddingY) * scale
+}
+
+// svgNum formats a coordinate with two decimals at most.
+func svgNum(v float32) string {
+	s := strconv.FormatFloat(float64(v), 'f', 2, 32)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+func svgPoint(p [2]float32) string {
+	return svgNum(p[0]) + " " + svgNum(p[1])
+}
+
+func svgColor(c [3]uint8) string {
+	return fmt.Sprintf("#%02x%02x%02x", c[0], c[1], c[2])
+}
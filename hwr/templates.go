@@ -0,0 +1,72 @@
+package hwr
+
+import (
+	"strings"
+
+	"github.com/juruen/rmapi/encoding/rm"
+)
+
+// Template constants, in device pixels
+const (
+	templateSpacingSmall  = 52
+	templateSpacingMedium = 70
+	templateSpacingLarge  = 92
+	templateTop           = 180 // First line of lined templates
+	templateMargin        = 180 // Margin line of templates with a margin
+	templateLineWidth     = 2
+	templateDotSize       = 6
+)
+
+// templateColor is the color of template lines, lighter than the gray pen.
+var templateColor = [3]uint8{200, 200, 200}
+
+// templateRect is a filled rectangle of a page template in device coordinates.
+type templateRect struct {
+	x, y, w, h float32
+}
+
+// pageTemplate returns the rectangles drawing a template of the device, named
+// as in .pagedata or the .content pages, such as "P Lines small", "P Grid
+// medium" or "P Dots S". Lines, grids and dots are drawn, landscape ("LS")
+// templates as their portrait version. Blank and other templates return nil.
+func pageTemplate(name string) []templateRect {
+	lower := strings.ToLower(name)
+	spacing := float32(templateSpacingMedium)
+	for _, word := range strings.Fields(lower) {
+		switch word {
+		case "small", "s":
+			spacing = templateSpacingSmall
+		case "large", "l":
+			spacing = templateSpacingLarge
+		}
+	}
+
+	width, height := float32(rm.Width), float32(rm.Height)
+	var rects []templateRect
+	switch {
+	case strings.Contains(lower, "grid"):
+		for x := spacing; x < width; x += spacing {
+			rects = append(rects, templateRect{x - templateLineWidth/2, 0, templateLineWidth, height})
+		}
+		for y := spacing; y < height; y += spacing {
+			rects = append(rects, templateRect{0, y - templateLineWidth/2, width, templateLineWidth})
+		}
+	case strings.Contains(lower, "dot"):
+		for y := spacing; y < height; y += spacing {
+			for x := spacing; x < width; x += spacing {
+				rects = append(rects, templateRect{x - templateDotSize/2, y - templateDotSize/2, templateDotSize, templateDotSize})
+			}
+		}
+	case strings.Contains(lower, "line"), strings.Contains(lower, "margin"), strings.Contains(lower, "checklist"):
+		for y := float32(templateTop); y < height; y += spacing {
+			rects = append(rects, templateRect{0, y - templateLineWidth/2, width, templateLineWidth})
+		}
+	default:
+		return nil
+	}
+
+	if strings.Contains(lower, "margin") {
+		rects = append(rects, templateRect{templateMargin - templateLineWidth/2, 0, templateLineWidth, height})
+	}
+	return rects
+}
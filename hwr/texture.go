@@ -0,0 +1,152 @@
+package hwr
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/juruen/rmapi/encoding/rm"
+)
+
+// Pen texture constants, see VisualizationConfig.Texture
+const (
+	grainDepth   = 0.6          // Largest share of the opacity of pencils taken away by the paper grain
+	grainCell    = 16           // Size of the PDF grain pattern in device pixels
+	bristleCount = 5            // Bristles streaking a brush stroke
+	bristleBody  = 0.5          // Opacity of the body of a brush stroke, under its bristles
+	nibAngle     = -math.Pi / 4 // Angle of the flat nib of the calligraphy pen, y pointing down
+	nibThinRatio = 0.25         // Width of calligraphy strokes drawn along the nib
+)
+
+// calligraphyPen is the calligraphy pen of v6 pages, which rmapi has no
+// brush type for.
+const calligraphyPen rm.BrushType = 21
+
+// penTexture is how a pen marks the paper, beyond its width, color and
+// opacity.
+type penTexture int
+
+const (
+	textureNone     penTexture = iota
+	textureGrain               // Paper grain showing through pencil strokes
+	textureBristles            // Brush strokes streaked by their bristles
+	textureNib                 // Calligraphy strokes thinner along their flat nib
+)
+
+// texture returns the texture of the pen.
+func (pr *PenRenderer) texture() penTexture {
+	switch pr.penType {
+	case rm.TiltPencil, rm.TiltPencilV5, rm.SharpPencil, rm.SharpPencilV5:
+		return textureGrain
+	case rm.Brush, rm.BrushV5:
+		return textureBristles
+	case calligraphyPen:
+		return textureNib
+	default:
+		return textureNone
+	}
+}
+
+// applyNib narrows the points of a calligraphy stroke as their direction
+// comes close to the angle of the nib.
+func applyNib(points []strokePoint, config VisualizationConfig) {
+	for i := range points {
+		prev, next := points[max(i-1, 0)], points[min(i+1, len(points)-1)]
+		dx, dy := next.x-prev.x, next.y-prev.y
+		if dx == 0 && dy == 0 {
+			continue
+		}
+		angle := math.Atan2(float64(dy), float64(dx)) - nibAngle
+		ratio := nibThinRatio + (1-nibThinRatio)*float32(math.Abs(math.Sin(angle)))
+		points[i].radius = clampStrokeRadius(points[i].radius*ratio, config)
+	}
+}
+
+// bristleRuns streaks the runs of a brush stroke: the body of the stroke is
+// drawn lighter, then each bristle as a thinner run across the stroke, more
+// or less loaded with paint from run to run.
+func bristleRuns(runs [][]strokePoint) [][]strokePoint {
+	textured := make([][]strokePoint, 0, len(runs)*(bristleCount+1))
+	for _, run := range runs {
+		body := make([]strokePoint, len(run))
+		for i, p := range run {
+			p.opacity = quantizeOpacity(p.opacity * bristleBody)
+			body[i] = p
+		}
+		textured = append(textured, body)
+	}
+
+	for b := 0; b < bristleCount; b++ {
+		// position of the bristle from the right (0) to the left (1) side
+		t := (float32(b) + 0.5) / bristleCount
+		for r, run := range runs {
+			load := 1 - grainNoise(b, r)*(1-bristleBody)
+			left, right := outlineSides(run)
+			bristle := make([]strokePoint, len(run))
+			for i, p := range run {
+				p.x = right[i][0] + (left[i][0]-right[i][0])*t
+				p.y = right[i][1] + (left[i][1]-right[i][1])*t
+				p.radius /= bristleCount
+				p.opacity = quantizeOpacity(p.opacity * load)
+				bristle[i] = p
+			}
+			if bristle[0].opacity > 0 {
+				textured = append(textured, bristle)
+			}
+		}
+	}
+	return textured
+}
+
+// quantizeOpacity rounds an opacity to the steps of PDF and SVG output.
+func quantizeOpacity(opacity float32) float32 {
+	return float32(math.Round(float64(opacity*opacitySteps))) / opacitySteps
+}
+
+// grainNoise returns a pseudo-random value in [0, 1) for a cell of paper
+// grain, the same for every rendering.
+func grainNoise(x, y int) float32 {
+	h := uint32(x)*374761393 + uint32(y)*668265263
+	h = (h ^ h>>13) * 1274126177
+	h ^= h >> 16
+	return float32(h&0xffff) / 0x10000
+}
+
+// paperGrain is a pen color whose opacity is taken away by the grain of the
+// paper, with a cell of grain per pixel of the output image.
+type paperGrain struct {
+	c    color.NRGBA
+	cell int // Pixels of the image per cell of grain
+}
+
+func (g *paperGrain) ColorModel() color.Model {
+	return color.NRGBAModel
+}
+
+func (g *paperGrain) Bounds() image.Rectangle {
+	return image.Rect(-1e9, -1e9, 1e9, 1e9)
+}
+
+func (g *paperGrain) At(x, y int) color.Color {
+	c := g.c
+	c.A = uint8(float32(c.A) * (1 - grainDepth*grainNoise(x/g.cell, y/g.cell)))
+	return c
+}
+
+// pdfGrainPattern returns the content of an uncolored tiling pattern of
+// paper grain, a cell of grainCell device pixels that fills the pixels the
+// grain doesn't take away, as paperGrain on average.
+func pdfGrainPattern() []byte {
+	var out strings.Builder
+	for y := 0; y < grainCell; y++ {
+		for x := 0; x < grainCell; x++ {
+			if grainNoise(x, y) >= grainDepth/2 {
+				fmt.Fprintf(&out, "%d %d 1 1 re\n", x, y)
+			}
+		}
+	}
+	out.WriteString("f\n")
+	return []byte(out.String())
+}
@@ -0,0 +1,190 @@
+package hwr
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Visualization themes
+const (
+	ThemeLight       = "light"       // Ink on white paper (default)
+	ThemeDark        = "dark"        // Ink of inverted lightness on a dark background
+	ThemeTransparent = "transparent" // Ink on a transparent background
+	ThemeEInk        = "eink"        // Grays of the reMarkable 2 display on its paper
+)
+
+// Theme colors
+var (
+	whitePaper = [3]uint8{255, 255, 255}
+	darkPaper  = [3]uint8{30, 30, 30}
+	einkPaper  = [3]uint8{232, 232, 232}
+)
+
+// einkLevels is the number of gray levels of the reMarkable 2 display.
+const einkLevels = 16
+
+// colorNames maps the names of palette files to Remarkable color IDs, as
+// commented in ColorPalette.
+var colorNames = map[string]uint32{
+	"black":        0,
+	"gray":         1,
+	"white":        2,
+	"yellow":       3,
+	"green":        4,
+	"pink":         5,
+	"blue":         6,
+	"red":          7,
+	"gray_overlap": 8,
+	"highlight":    9,
+	"green_2":      10,
+	"cyan":         11,
+	"magenta":      12,
+	"yellow_2":     13,
+}
+
+// Themes returns the supported visualization themes.
+func Themes() []string {
+	return []string{ThemeLight, ThemeDark, ThemeTransparent, ThemeEInk}
+}
+
+// IsTheme reports whether theme is supported, the empty theme being the
+// light one.
+func IsTheme(theme string) bool {
+	if theme == "" {
+		return true
+	}
+	for _, t := range Themes() {
+		if t == theme {
+			return true
+		}
+	}
+	return false
+}
+
+// paperColor returns the background color of the theme, and false if the
+// background is transparent.
+func (c VisualizationConfig) paperColor() ([3]uint8, bool) {
+	switch c.Theme {
+	case ThemeDark:
+		return darkPaper, true
+	case ThemeTransparent:
+		return [3]uint8{}, false
+	case ThemeEInk:
+		return einkPaper, true
+	default:
+		return whitePaper, true
+	}
+}
+
+// inkColor returns the color of strokes and template lines in the theme.
+func (c VisualizationConfig) inkColor(ink [3]uint8) [3]uint8 {
+	switch c.Theme {
+	case ThemeDark:
+		return invertLightness(ink)
+	case ThemeEInk:
+		return einkGray(ink)
+	default:
+		return ink
+	}
+}
+
+// highlightColor returns the color of highlighters in the theme. They keep
+// their color on dark backgrounds, as they color the paper.
+func (c VisualizationConfig) highlightColor(highlight [3]uint8) [3]uint8 {
+	if c.Theme == ThemeEInk {
+		return einkGray(highlight)
+	}
+	return highlight
+}
+
+// invertLightness turns dark colors light and light colors dark, keeping
+// their hue and chroma: black ink becomes white, blue ink a lighter blue.
+func invertLightness(c [3]uint8) [3]uint8 {
+	lo, hi := c[0], c[0]
+	for _, v := range c[1:] {
+		if v < lo {
+			lo = v
+		}
+		hi = max(hi, v)
+	}
+	shift := 255 - int(hi) - int(lo)
+	return [3]uint8{uint8(int(c[0]) + shift), uint8(int(c[1]) + shift), uint8(int(c[2]) + shift)}
+}
+
+// einkGray returns the gray of the display for a color, never lighter than
+// its paper.
+func einkGray(c [3]uint8) [3]uint8 {
+	luma := 0.299*float64(c[0]) + 0.587*float64(c[1]) + 0.114*float64(c[2])
+	step := 255.0 / (einkLevels - 1)
+	gray := uint8(min(int(float64(int(luma/step+0.5))*step), int(einkPaper[0])))
+	return [3]uint8{gray, gray, gray}
+}
+
+// LoadPalette reads a YAML or JSON palette file, see ParsePalette.
+func LoadPalette(path string) (map[uint32][3]uint8, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read palette: %w", err)
+	}
+	palette, err := ParsePalette(data)
+	if err != nil {
+		return nil, fmt.Errorf("palette %s: %w", path, err)
+	}
+	return palette, nil
+}
+
+// ParsePalette parses a YAML or JSON palette mapping Remarkable colors, by
+// name (black, blue, yellow_2...) or ID, to #rrggbb colors, such as
+// {"blue": "#1e40af", "7": "#dc2626"}. Colors it leaves out keep their
+// ColorPalette value.
+func ParsePalette(data []byte) (map[uint32][3]uint8, error) {
+	var raw map[string]string
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("can't parse: %w", err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty palette")
+	}
+
+	palette := make(map[uint32][3]uint8, len(raw))
+	for key, value := range raw {
+		id, ok := colorNames[strings.ToLower(key)]
+		if !ok {
+			n, err := strconv.ParseUint(key, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("unknown color %q, expected an ID or one of %v", key, paletteColorNames())
+			}
+			id = uint32(n)
+		}
+		c, err := parseHexColor(value)
+		if err != nil {
+			return nil, fmt.Errorf("color %s: %w", key, err)
+		}
+		palette[id] = c
+	}
+	return palette, nil
+}
+
+func paletteColorNames() []string {
+	names := make([]string, 0, len(colorNames))
+	for name := range colorNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseHexColor parses a #rrggbb color.
+func parseHexColor(s string) ([3]uint8, error) {
+	hex := strings.TrimPrefix(s, "#")
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return [3]uint8{}, fmt.Errorf("invalid color %q, expected #rrggbb", s)
+	}
+	return [3]uint8{uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
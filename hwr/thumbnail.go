@@ -0,0 +1,123 @@
+package hwr
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+
+	"github.com/juruen/rmapi/archive"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Thumbnail constants
+const (
+	DefaultThumbnailWidth      = 156 // A ninth of the device screen
+	DefaultThumbnailHeight     = 208
+	DefaultContactSheetColumns = 4
+	contactSheetGap            = 16 // Space around the thumbnails of a contact sheet
+	contactSheetLabelHeight    = 20 // Height of the page numbers under the thumbnails
+)
+
+// Thumbnails renders every page of a document, in one pass, to a thumbnail
+// of exactly width x height pixels: the page as RenderPage draws it, cropped
+// to its strokes or whole with config.FullPage, scaled down to fit and
+// centered on the paper of the theme. Pages without data are blank. Each
+// thumbnail is handed to fn as soon as it is rendered, so that only one is
+// held at a time; an error of fn stops the rendering.
+func Thumbnails(ctx context.Context, zip *archive.Zip, width, height int, config VisualizationConfig, fn func(page int, thumbnail *image.RGBA) error) error {
+	for p := range zip.Pages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		thumbnail := newPaperImage(width, height, config)
+		if page := RenderPage(ctx, zip, p, config); page != nil {
+			fitImage(thumbnail, page)
+		}
+		if err := fn(p, thumbnail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fitImage scales src to fit dst, keeping its aspect ratio, and draws it
+// centered over dst.
+func fitImage(dst *image.RGBA, src image.Image) {
+	db, sb := dst.Bounds(), src.Bounds()
+	scale := float64(db.Dx()) / float64(sb.Dx())
+	if s := float64(db.Dy()) / float64(sb.Dy()); s < scale {
+		scale = s
+	}
+	w, h := int(float64(sb.Dx())*scale+0.5), int(float64(sb.Dy())*scale+0.5)
+	x, y := db.Min.X+(db.Dx()-w)/2, db.Min.Y+(db.Dy()-h)/2
+	xdraw.CatmullRom.Scale(dst, image.Rect(x, y, x+w, y+h), src, sb, xdraw.Over, nil)
+}
+
+// ContactSheetSize returns the width and height of the contact sheet of
+// pages thumbnails of width x height, in rows of columns.
+func ContactSheetSize(pages, width, height, columns int) (int, int) {
+	if columns < 1 {
+		columns = DefaultContactSheetColumns
+	}
+	columns = min(columns, max(pages, 1))
+	rows := (pages + columns - 1) / columns
+	return contactSheetGap + columns*(width+contactSheetGap),
+		contactSheetGap + rows*(height+contactSheetLabelHeight+contactSheetGap)
+}
+
+// ContactSheet renders every page of a document to a thumbnail of width x
+// height, as Thumbnails, and tiles them in rows of columns, each framed and
+// over its page number (1-indexed), on the paper of the theme. Thumbnails are
+// drawn onto the sheet as they are rendered.
+func ContactSheet(ctx context.Context, zip *archive.Zip, width, height, columns int, config VisualizationConfig) (*image.RGBA, error) {
+	if columns < 1 {
+		columns = DefaultContactSheetColumns
+	}
+	columns = min(columns, max(len(zip.Pages), 1))
+	sheetWidth, sheetHeight := ContactSheetSize(len(zip.Pages), width, height, columns)
+	sheet := newPaperImage(sheetWidth, sheetHeight, config)
+
+	ink := config.inkColor(ColorPalette[0])
+	frame := config.inkColor(templateColor)
+	label := &font.Drawer{
+		Dst:  sheet,
+		Src:  image.NewUniform(color.RGBA{ink[0], ink[1], ink[2], 255}),
+		Face: basicfont.Face7x13,
+	}
+	err := Thumbnails(ctx, zip, width, height, config, func(i int, thumbnail *image.RGBA) error {
+		x := contactSheetGap + (i%columns)*(width+contactSheetGap)
+		y := contactSheetGap + (i/columns)*(height+contactSheetLabelHeight+contactSheetGap)
+		r := image.Rect(x, y, x+width, y+height)
+		draw.Draw(sheet, r, thumbnail, image.Point{}, draw.Over)
+		drawFrame(sheet, r.Inset(-1), frame)
+
+		// page number centered under the thumbnail
+		number := strconv.Itoa(i + 1)
+		baseline := y + height + (contactSheetLabelHeight+basicfont.Face7x13.Ascent)/2
+		label.Dot = fixed.P(x+(width-label.MeasureString(number).Round())/2, baseline)
+		label.DrawString(number)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sheet, nil
+}
+
+// drawFrame draws the one pixel border of r.
+func drawFrame(img *image.RGBA, r image.Rectangle, c [3]uint8) {
+	fill := &image.Uniform{color.RGBA{c[0], c[1], c[2], 255}}
+	for _, side := range []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+1),
+		image.Rect(r.Min.X, r.Max.Y-1, r.Max.X, r.Max.Y),
+		image.Rect(r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y),
+		image.Rect(r.Max.X-1, r.Min.Y, r.Max.X, r.Max.Y),
+	} {
+		draw.Draw(img, side, fill, image.Point{}, draw.Src)
+	}
+}
@@ -1,10 +1,13 @@
 package hwr
 
 import (
+	"context"
+	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"image/png"
-	"math"
+	"log/slog"
 	"os"
 
 	"github.com/juruen/rmapi/archive"
@@ -20,6 +23,7 @@ const (
 	defaultMinStrokeWidth  = 1     // Minimum stroke width in pixels
 	defaultMaxStrokeWidth  = 8     // Maximum stroke width in pixels
 	minImageHeight         = 100   // Minimum image height in pixels
+	defaultSupersampling   = 1     // Anti-aliasing only
 
 	// Highlighter-specific constants
 	highlighterBaseWidthPixels = 15.0  // Base width for highlighters
@@ -31,6 +35,43 @@ const (
 	highlighterWhiteMix        = 0.3  // White mixing factor for pastel effect
 )
 
+// Visualization formats
+const (
+	VisualizeFormatPNG = "png" // Raster image (default)
+	VisualizeFormatSVG = "svg" // Vector image, a path per stroke
+	VisualizeFormatPDF = "pdf" // Vector document, a page per page at its true size
+)
+
+// VisualizeFormats returns the supported visualization formats.
+func VisualizeFormats() []string {
+	return []string{VisualizeFormatPNG, VisualizeFormatSVG, VisualizeFormatPDF}
+}
+
+// IsVisualizeFormat reports whether format is a supported visualization format.
+func IsVisualizeFormat(format string) bool {
+	for _, f := range VisualizeFormats() {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// VisualizePageFormat renders a page's strokes to outputPath in the given
+// visualization format.
+func VisualizePageFormat(ctx context.Context, zip *archive.Zip, pageNumber int, outputPath, format string, config VisualizationConfig) error {
+	switch format {
+	case VisualizeFormatPNG:
+		return VisualizePageContext(ctx, zip, pageNumber, outputPath, config)
+	case VisualizeFormatSVG:
+		return VisualizePageSVGContext(ctx, zip, pageNumber, outputPath, config)
+	case VisualizeFormatPDF:
+		return VisualizePDF(ctx, zip, []int{pageNumber}, outputPath, config)
+	default:
+		return fmt.Errorf("unsupported visualization format %q, expected one of %v", format, VisualizeFormats())
+	}
+}
+
 // VisualizationConfig holds configuration for rendering strokes to PNG.
 type VisualizationConfig struct {
 	// OutputWidth is the fixed width of the output image in pixels (default: 1404 for ReMarkable2)
@@ -45,6 +86,20 @@ type VisualizationConfig struct {
 	MinStrokeWidth int
 	// MaxStrokeWidth is the maximum stroke width in pixels (default: 8)
 	MaxStrokeWidth int
+	// FullPage renders the whole device page at a fixed scale rather than cropping to the strokes (default: false)
+	FullPage bool
+	// Template draws the page template (lines, grid or dots) underneath the strokes of full pages and PDF pages (default: false)
+	Template bool
+	// Supersampling draws strokes at this many times the output resolution, then averages them down, on top of anti-aliasing (default: 1, PNG only)
+	Supersampling int
+	// Texture simulates the grain of pencils, the bristles of brushes and the flat nib of the calligraphy pen (default: false, grain in PNG and PDF only)
+	Texture bool
+	// Palette overrides the colors of ColorPalette by color ID (default: nil)
+	Palette map[uint32][3]uint8
+	// Theme is the background and ink colors, one of Themes() (default: light). Pages drawn over their document page are drawn as light
+	Theme string
+	// Background draws the strokes of annotated PDFs and EPUBs at their position over their document page, rather than cropped to the strokes (default: false, PNG and PDF only)
+	Background bool
 }
 
 // DefaultVisualizationConfig returns a config with ReMarkable2 defaults.
@@ -56,6 +111,7 @@ func DefaultVisualizationConfig() VisualizationConfig {
 		StrokeWidthScale: defaultStrokeWidthScale,
 		MinStrokeWidth:   defaultMinStrokeWidth,
 		MaxStrokeWidth:   defaultMaxStrokeWidth,
+		Supersampling:    defaultSupersampling,
 	}
 }
 
@@ -68,6 +124,21 @@ func VisualizePage(zip *archive.Zip, pageNumber int, outputPath string) error {
 // The output image has a fixed width (typically 1404px for ReMarkable2) and dynamic height
 // based on the content, maintaining aspect ratio.
 func VisualizePageWithConfig(zip *archive.Zip, pageNumber int, outputPath string, config VisualizationConfig) error {
+	return VisualizePageContext(context.Background(), zip, pageNumber, outputPath, config)
+}
+
+// VisualizePageContext is VisualizePageWithConfig, logging with ctx.
+func VisualizePageContext(ctx context.Context, zip *archive.Zip, pageNumber int, outputPath string, config VisualizationConfig) error {
+	img := RenderPage(ctx, zip, pageNumber, config)
+	if img == nil {
+		return nil
+	}
+	return savePNG(img, outputPath)
+}
+
+// RenderPage renders a page's strokes to an image, as VisualizePageContext
+// saves it. Pages out of range or without data return nil.
+func RenderPage(ctx context.Context, zip *archive.Zip, pageNumber int, config VisualizationConfig) *image.RGBA {
 	if pageNumber < 0 || pageNumber >= len(zip.Pages) {
 		return nil
 	}
@@ -77,10 +148,20 @@ func VisualizePageWithConfig(zip *archive.Zip, pageNumber int, outputPath string
 		return nil
 	}
 
-	// Calculate bounding box of all strokes
-	bbox := calculateBoundingBox(page.Data, config)
+	// Annotations are drawn where they are on their document page
+	if drawnOverDocument(zip, page, config) {
+		img, err := renderOverDocument(ctx, zip, page, config)
+		if err == nil {
+			return img
+		}
+		slog.WarnContext(ctx, "Can't render the document page, rendering without background", "page", pageNumber, "err", err)
+	}
+
+	// Calculate bounding box of all strokes, or of the page
+	bbox := pageBoundingBox(page.Data, config)
 	if bbox == nil {
-		return createEmptyImage(outputPath, config.OutputWidth, minImageHeight)
+		slog.DebugContext(ctx, "Page has no visible strokes, rendering an empty image", "page", pageNumber)
+		return newPaperImage(config.OutputWidth, minImageHeight, config)
 	}
 
 	// Calculate scale factors and image dimensions
@@ -89,15 +170,36 @@ func VisualizePageWithConfig(zip *archive.Zip, pageNumber int, outputPath string
 		imgHeight = minImageHeight
 	}
 
-	// Create image and fill with white background
-	img := image.NewRGBA(image.Rect(0, 0, imgWidth, imgHeight))
-	fillWhiteBackground(img, imgWidth, imgHeight)
+	slog.DebugContext(ctx, "Rendering page", "page", pageNumber, "width", imgWidth, "height", imgHeight)
+
+	// Create image filled with the background of the theme
+	img := newPaperImage(imgWidth, imgHeight, config)
+	if config.FullPage && config.Template {
+		drawTemplate(img, pageTemplate(page.Pagedata), config.inkColor(templateColor), bbox, scaleX, scaleY)
+	}
 
 	// Draw all strokes (highlighters first, then other strokes)
 	drawStrokes(img, page.Data, bbox, scaleX, scaleY, imgWidth, imgHeight, config)
+	return img
+}
 
-	// Save PNG
-	return savePNG(img, outputPath)
+// renderOverDocument draws the strokes of a page at their true position
+// over its document page, rasterized at the output width, in the light theme.
+func renderOverDocument(ctx context.Context, zip *archive.Zip, page archive.Page, config VisualizationConfig) (*image.RGBA, error) {
+	config.Theme = ThemeLight
+	reader, err := openDocumentPDF(zip.Payload)
+	if err != nil {
+		return nil, err
+	}
+	img, scale, err := rasterizeDocumentPage(reader, page.DocPage, config.OutputWidth)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	slog.DebugContext(ctx, "Rendering page over its document page", "doc_page", page.DocPage, "width", bounds.Dx(), "height", bounds.Dy())
+	drawStrokes(img, page.Data, &boundingBox{}, scale, scale, bounds.Dx(), bounds.Dy(), config)
+	return img, nil
 }
 
 // boundingBox represents the bounding box of strokes with padding.
@@ -106,6 +208,21 @@ type boundingBox struct {
 	paddingX, paddingY     float32
 }
 
+// pageBoundingBox returns the rendered box of a page: the strokes with their
+// padding, or the device page extended down to the strokes below it in
+// FullPage mode. Returns nil if a cropped page has no strokes.
+func pageBoundingBox(pageData *rm.Rm, config VisualizationConfig) *boundingBox {
+	bbox := calculateBoundingBox(pageData, config)
+	if !config.FullPage {
+		return bbox
+	}
+	page := &boundingBox{maxX: float32(rm.Width), maxY: float32(rm.Height)}
+	if bbox != nil && bbox.maxY > page.maxY {
+		page.maxY = bbox.maxY
+	}
+	return page
+}
+
 // calculateBoundingBox calculates the bounding box of all strokes in the page.
 // Returns nil if no valid strokes are found.
 func calculateBoundingBox(pageData *rm.Rm, config VisualizationConfig) *boundingBox {
@@ -189,16 +306,30 @@ func calculateImageDimensions(bbox *boundingBox, config VisualizationConfig) (sc
 
 // drawStrokes draws all strokes onto the image with proper scaling.
 // Highlighters are drawn first (background layer), then other strokes on top (foreground layer).
+// With supersampling, strokes are drawn onto a larger layer, then averaged down over the image.
 func drawStrokes(img *image.RGBA, pageData *rm.Rm, bbox *boundingBox, scaleX, scaleY float32, imgWidth, imgHeight int, config VisualizationConfig) {
+	factor := max(config.Supersampling, 1)
+	r := &strokeRasterizer{img: img, scale: float32(factor)}
+	if factor > 1 {
+		r.img = image.NewRGBA(image.Rect(0, 0, imgWidth*factor, imgHeight*factor))
+	}
+	transform := func(x, y float32) (float32, float32) {
+		return (x - bbox.minX + bbox.paddingX) * scaleX * r.scale, (y - bbox.minY + bbox.paddingY) * scaleY * r.scale
+	}
+
 	// First pass: draw all highlighters (background layer)
-	drawStrokesByType(img, pageData, bbox, scaleX, scaleY, imgWidth, imgHeight, config, true)
+	drawStrokesByType(r, pageData, transform, config, true)
 
 	// Second pass: draw all other strokes (foreground layer)
-	drawStrokesByType(img, pageData, bbox, scaleX, scaleY, imgWidth, imgHeight, config, false)
+	drawStrokesByType(r, pageData, transform, config, false)
+
+	if factor > 1 {
+		downsample(img, r.img, factor)
+	}
 }
 
 // drawStrokesByType draws strokes filtered by type (highlighters or non-highlighters).
-func drawStrokesByType(img *image.RGBA, pageData *rm.Rm, bbox *boundingBox, scaleX, scaleY float32, imgWidth, imgHeight int, config VisualizationConfig, drawHighlighters bool) {
+func drawStrokesByType(r *strokeRasterizer, pageData *rm.Rm, transform func(x, y float32) (float32, float32), config VisualizationConfig, drawHighlighters bool) {
 	for _, layer := range pageData.Layers {
 		for _, line := range layer.Lines {
 			if line.BrushType == rm.EraseArea || len(line.Points) < 2 {
@@ -210,89 +341,59 @@ func drawStrokesByType(img *image.RGBA, pageData *rm.Rm, bbox *boundingBox, scal
 				continue
 			}
 
-			pen := NewPenRenderer(line.BrushType, uint32(line.BrushColor), line.BrushSize)
-			drawLine(img, line, bbox, scaleX, scaleY, imgWidth, imgHeight, pen, config)
+			pen := NewPenRendererWithPalette(line.BrushType, uint32(line.BrushColor), line.BrushSize, config.Palette)
+			drawLine(r, line, transform, pen, config)
 		}
 	}
 }
 
 // drawLine draws a single line with variable width, color, and opacity based on pen type.
 // Highlighters are rendered using a special method for thick, semi-transparent background fills.
-func drawLine(img *image.RGBA, line rm.Line, bbox *boundingBox, scaleX, scaleY float32, imgWidth, imgHeight int, pen *PenRenderer, config VisualizationConfig) {
+func drawLine(r *strokeRasterizer, line rm.Line, transform func(x, y float32) (float32, float32), pen *PenRenderer, config VisualizationConfig) {
+	shapes, grain := lineShapes(line, transform, pen, config)
+	for _, shape := range shapes {
+		r.fill(shape, grain)
+	}
+}
+
+// lineShapes returns the shapes filled to draw a line, and whether the grain
+// of the paper shows through them.
+func lineShapes(line rm.Line, transform func(x, y float32) (float32, float32), pen *PenRenderer, config VisualizationConfig) ([][]strokePoint, bool) {
 	if len(line.Points) == 0 {
-		return
+		return nil, false
 	}
 
 	// Highlighters use special rendering (thick, semi-transparent background fills)
 	isHighlighter := line.BrushType == rm.Highlighter || line.BrushType == rm.HighlighterV5
 	if isHighlighter {
-		drawHighlighterLine(img, line, bbox, scaleX, scaleY, imgWidth, imgHeight, pen, config)
-		return
+		return highlighterShapes(line, transform, pen, config), false
 	}
 
-	// Regular strokes: draw with variable width, color, and opacity
-	drawRegularStroke(img, line, bbox, scaleX, scaleY, imgWidth, imgHeight, pen, config)
-}
-
-// drawRegularStroke draws a regular stroke with variable width, color, and opacity.
-func drawRegularStroke(img *image.RGBA, line rm.Line, bbox *boundingBox, scaleX, scaleY float32, imgWidth, imgHeight int, pen *PenRenderer, config VisualizationConfig) {
-	// Draw first point
-	p0 := line.Points[0]
-	x0, y0 := transformPoint(p0.X, p0.Y, bbox, scaleX, scaleY)
-
-	width0 := pen.GetStrokeWidth(p0.Speed, p0.Direction, p0.Width, p0.Pressure)
-	color0 := pen.GetStrokeColor(p0.Speed, p0.Direction, p0.Width, p0.Pressure)
-	opacity0 := pen.GetStrokeOpacity(p0.Speed, p0.Direction, p0.Width, p0.Pressure)
-
-	radius0 := clampStrokeWidth(int(width0*config.StrokeWidthScale), config)
-	strokeColor0 := color.RGBA{color0[0], color0[1], color0[2], uint8(255 * opacity0)}
-	drawFilledCircle(img, x0, y0, radius0, strokeColor0, imgWidth, imgHeight)
-
-	// Draw segments between points
-	for i := 0; i < len(line.Points)-1; i++ {
-		p1, p2 := line.Points[i], line.Points[i+1]
-		x1, y1 := transformPoint(p1.X, p1.Y, bbox, scaleX, scaleY)
-		x2, y2 := transformPoint(p2.X, p2.Y, bbox, scaleX, scaleY)
-
-		width1 := pen.GetStrokeWidth(p1.Speed, p1.Direction, p1.Width, p1.Pressure)
-		width2 := pen.GetStrokeWidth(p2.Speed, p2.Direction, p2.Width, p2.Pressure)
-		color1 := pen.GetStrokeColor(p1.Speed, p1.Direction, p1.Width, p1.Pressure)
-		color2 := pen.GetStrokeColor(p2.Speed, p2.Direction, p2.Width, p2.Pressure)
-		opacity1 := pen.GetStrokeOpacity(p1.Speed, p1.Direction, p1.Width, p1.Pressure)
-		opacity2 := pen.GetStrokeOpacity(p2.Speed, p2.Direction, p2.Width, p2.Pressure)
-
-		pixelWidth1 := clampStrokeWidth(int(width1*config.StrokeWidthScale), config)
-		pixelWidth2 := clampStrokeWidth(int(width2*config.StrokeWidthScale), config)
-
-		drawVariableWidthLineWithColor(img, x1, y1, pixelWidth1, x2, y2, pixelWidth2,
-			color1, color2, opacity1, opacity2, imgWidth, imgHeight)
-	}
+	// Regular strokes: a shape per run of points of the same color and opacity
+	grain := config.Texture && pen.texture() == textureGrain
+	return strokeRuns(line, pen, config, transform), grain
 }
 
-// drawHighlighterLine draws a highlighter line as thick, semi-transparent filled shapes.
+// highlighterShapes returns a highlighter line as a thick, semi-transparent shape.
 // Highlighters color the background rather than drawing strokes on top.
-func drawHighlighterLine(img *image.RGBA, line rm.Line, bbox *boundingBox, scaleX, scaleY float32, imgWidth, imgHeight int, pen *PenRenderer, config VisualizationConfig) {
+func highlighterShapes(line rm.Line, transform func(x, y float32) (float32, float32), pen *PenRenderer, config VisualizationConfig) [][]strokePoint {
 	if len(line.Points) < 2 {
-		return
+		return nil
 	}
 
 	// Lighten the color for highlighters (make it more pastel)
-	lightColor := lightenColor(pen.baseColor)
+	lightColor := config.highlightColor(lightenColor(pen.baseColor))
 
 	// Calculate highlighter width (thick stroke)
-	width := calculateHighlighterWidth(config)
+	radius := float32(calculateHighlighterWidth(config)) / 2
 
 	// Convert all points to image coordinates
-	points := make([]struct{ x, y int }, len(line.Points))
+	points := make([]strokePoint, len(line.Points))
 	for i, p := range line.Points {
-		points[i].x, points[i].y = transformPoint(p.X, p.Y, bbox, scaleX, scaleY)
+		x, y := transform(p.X, p.Y)
+		points[i] = strokePoint{x: x, y: y, radius: radius, color: lightColor, opacity: highlighterOpacity}
 	}
-
-	// Draw thick continuous stroke with alpha blending
-	alphaValue := float32(255) * highlighterOpacity
-	alpha := uint8(alphaValue)
-	strokeColor := color.RGBA{lightColor[0], lightColor[1], lightColor[2], alpha}
-	drawThickContinuousStroke(img, points, width, strokeColor, imgWidth, imgHeight)
+	return [][]strokePoint{points}
 }
 
 // lightenColor lightens a color by mixing it with white for a pastel effect.
@@ -316,17 +417,6 @@ func calculateHighlighterWidth(config VisualizationConfig) int {
 	return width
 }
 
-// clampStrokeWidth clamps stroke width to configured min/max values.
-func clampStrokeWidth(width int, config VisualizationConfig) int {
-	if width < config.MinStrokeWidth {
-		return config.MinStrokeWidth
-	}
-	if width > config.MaxStrokeWidth {
-		return config.MaxStrokeWidth
-	}
-	return width
-}
-
 // transformPoint transforms a point from document coordinates to image coordinates.
 func transformPoint(x, y float32, bbox *boundingBox, scaleX, scaleY float32) (int, int) {
 	imgX := (x - bbox.minX + bbox.paddingX) * scaleX
@@ -336,21 +426,33 @@ func transformPoint(x, y float32, bbox *boundingBox, scaleX, scaleY float32) (in
 
 // Image creation and saving functions
 
-// fillWhiteBackground fills the entire image with white.
-func fillWhiteBackground(img *image.RGBA, width, height int) {
-	white := color.RGBA{255, 255, 255, 255}
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			img.Set(x, y, white)
-		}
+// drawTemplate fills the rectangles of a page template.
+func drawTemplate(img *image.RGBA, rects []templateRect, c [3]uint8, bbox *boundingBox, scaleX, scaleY float32) {
+	fill := &image.Uniform{color.RGBA{c[0], c[1], c[2], 255}}
+	for _, r := range rects {
+		x0, y0 := transformPoint(r.x, r.y, bbox, scaleX, scaleY)
+		x1, y1 := transformPoint(r.x+r.w, r.y+r.h, bbox, scaleX, scaleY)
+		// keep thin lines visible once scaled down
+		x1, y1 = max(x1, x0+1), max(y1, y0+1)
+		draw.Draw(img, image.Rect(x0, y0, x1, y1), fill, image.Point{}, draw.Src)
 	}
 }
 
-// createEmptyImage creates an empty white image.
-func createEmptyImage(outputPath string, width, height int) error {
+// fillBackground fills the entire image with the paper of the theme, if not transparent.
+func fillBackground(img *image.RGBA, width, height int, config VisualizationConfig) {
+	paper, ok := config.paperColor()
+	if !ok {
+		return
+	}
+	c := &image.Uniform{color.RGBA{paper[0], paper[1], paper[2], 255}}
+	draw.Draw(img, image.Rect(0, 0, width, height), c, image.Point{}, draw.Src)
+}
+
+// newPaperImage creates an image filled with the background of the theme.
+func newPaperImage(width, height int, config VisualizationConfig) *image.RGBA {
 	img := image.NewRGBA(image.Rect(0, 0, width, height))
-	fillWhiteBackground(img, width, height)
-	return savePNG(img, outputPath)
+	fillBackground(img, width, height, config)
+	return img
 }
 
 // savePNG saves an image as a PNG file.
@@ -362,232 +464,3 @@ func savePNG(img image.Image, outputPath string) error {
 	defer file.Close()
 	return png.Encode(file, img)
 }
-
-// Drawing primitives
-
-// drawFilledCircle draws a filled circle (opaque, no blending).
-func drawFilledCircle(img *image.RGBA, cx, cy, radius int, c color.RGBA, imgWidth, imgHeight int) {
-	if radius <= 0 {
-		return
-	}
-	for dy := -radius; dy <= radius; dy++ {
-		for dx := -radius; dx <= radius; dx++ {
-			if dx*dx+dy*dy <= radius*radius {
-				px := cx + dx
-				py := cy + dy
-				if px >= 0 && px < imgWidth && py >= 0 && py < imgHeight {
-					img.Set(px, py, c)
-				}
-			}
-		}
-	}
-}
-
-// drawFilledCircleBlended draws a filled circle with alpha blending.
-func drawFilledCircleBlended(img *image.RGBA, cx, cy, radius int, c color.RGBA, imgWidth, imgHeight int) {
-	if radius <= 0 {
-		return
-	}
-	for dy := -radius; dy <= radius; dy++ {
-		for dx := -radius; dx <= radius; dx++ {
-			if dx*dx+dy*dy <= radius*radius {
-				px := cx + dx
-				py := cy + dy
-				if px >= 0 && px < imgWidth && py >= 0 && py < imgHeight {
-					existing := img.RGBAAt(px, py)
-					blended := blendColors(existing, c)
-					img.Set(px, py, blended)
-				}
-			}
-		}
-	}
-}
-
-// drawThickContinuousStroke draws a thick continuous stroke through multiple points.
-// Used for highlighters to create smooth, thick strokes without visible dots.
-func drawThickContinuousStroke(img *image.RGBA, points []struct{ x, y int }, width int, strokeColor color.RGBA, imgWidth, imgHeight int) {
-	if len(points) < 2 {
-		return
-	}
-
-	halfWidth := float32(width) / 2
-
-	// Draw segments between consecutive points
-	for i := 0; i < len(points)-1; i++ {
-		p1, p2 := points[i], points[i+1]
-
-		dx := float32(p2.x - p1.x)
-		dy := float32(p2.y - p1.y)
-		length := float32(math.Sqrt(float64(dx*dx + dy*dy)))
-
-		if length == 0 {
-			continue
-		}
-
-		// Normalize direction
-		dx /= length
-		dy /= length
-
-		// Perpendicular direction for width
-		px := -dy
-		py := dx
-
-		// Calculate the four corners of the segment (rectangle)
-		sx1 := float32(p1.x) + px*halfWidth
-		sy1 := float32(p1.y) + py*halfWidth
-		sx2 := float32(p1.x) - px*halfWidth
-		sy2 := float32(p1.y) - py*halfWidth
-
-		ex1 := float32(p2.x) + px*halfWidth
-		ey1 := float32(p2.y) + py*halfWidth
-		ex2 := float32(p2.x) - px*halfWidth
-		ey2 := float32(p2.y) - py*halfWidth
-
-		// Draw filled polygon (rectangle part) with alpha blending
-		drawFilledPolygonBlended(img,
-			[]int{int(sx1), int(sx2), int(ex2), int(ex1)},
-			[]int{int(sy1), int(sy2), int(ey2), int(ey1)},
-			strokeColor, imgWidth, imgHeight)
-
-		// Draw rounded cap at end point (except for last segment)
-		if i == len(points)-2 {
-			drawFilledCircleBlended(img, p2.x, p2.y, width/2, strokeColor, imgWidth, imgHeight)
-		}
-	}
-
-	// Draw rounded cap at start point
-	drawFilledCircleBlended(img, points[0].x, points[0].y, width/2, strokeColor, imgWidth, imgHeight)
-}
-
-// drawFilledPolygonBlended draws a filled polygon with alpha blending.
-func drawFilledPolygonBlended(img *image.RGBA, xs, ys []int, c color.RGBA, imgWidth, imgHeight int) {
-	if len(xs) != len(ys) || len(xs) < 3 {
-		return
-	}
-
-	// Find bounding box
-	minX, maxX := xs[0], xs[0]
-	minY, maxY := ys[0], ys[0]
-	for i := 1; i < len(xs); i++ {
-		if xs[i] < minX {
-			minX = xs[i]
-		}
-		if xs[i] > maxX {
-			maxX = xs[i]
-		}
-		if ys[i] < minY {
-			minY = ys[i]
-		}
-		if ys[i] > maxY {
-			maxY = ys[i]
-		}
-	}
-
-	// Clamp to image bounds
-	if minX < 0 {
-		minX = 0
-	}
-	if maxX >= imgWidth {
-		maxX = imgWidth - 1
-	}
-	if minY < 0 {
-		minY = 0
-	}
-	if maxY >= imgHeight {
-		maxY = imgHeight - 1
-	}
-
-	// Point-in-polygon test for each pixel in bounding box
-	for y := minY; y <= maxY; y++ {
-		for x := minX; x <= maxX; x++ {
-			if pointInPolygon(x, y, xs, ys) {
-				if x >= 0 && x < imgWidth && y >= 0 && y < imgHeight {
-					existing := img.RGBAAt(x, y)
-					blended := blendColors(existing, c)
-					img.Set(x, y, blended)
-				}
-			}
-		}
-	}
-}
-
-// drawVariableWidthLineWithColor draws a line with variable width, color, and opacity.
-// Interpolates width, color, and opacity smoothly between start and end points.
-func drawVariableWidthLineWithColor(img *image.RGBA, x1, y1 int, width1 int, x2, y2 int, width2 int,
-	color1, color2 [3]uint8, opacity1, opacity2 float32, imgWidth, imgHeight int) {
-	dx := float32(x2 - x1)
-	dy := float32(y2 - y1)
-	length := float32(math.Sqrt(float64(dx*dx + dy*dy)))
-
-	if length == 0 {
-		c := color.RGBA{color1[0], color1[1], color1[2], uint8(255 * opacity1)}
-		drawFilledCircle(img, x1, y1, width1, c, imgWidth, imgHeight)
-		return
-	}
-
-	// Normalize direction
-	dx /= length
-	dy /= length
-
-	// Draw line with variable width, color, and opacity
-	steps := int(length) + 1
-	if steps < 2 {
-		steps = 2
-	}
-
-	for i := 0; i <= steps; i++ {
-		t := float32(i) / float32(steps)
-
-		// Interpolate position
-		x := float32(x1) + dx*length*t
-		y := float32(y1) + dy*length*t
-
-		// Interpolate width
-		width := float32(width1) + (float32(width2)-float32(width1))*t
-		radius := int(width + 0.5)
-		if radius < 1 {
-			radius = 1
-		}
-
-		// Interpolate color
-		r := uint8(float32(color1[0]) + (float32(color2[0])-float32(color1[0]))*t)
-		g := uint8(float32(color1[1]) + (float32(color2[1])-float32(color1[1]))*t)
-		b := uint8(float32(color1[2]) + (float32(color2[2])-float32(color1[2]))*t)
-
-		// Interpolate opacity
-		opacity := opacity1 + (opacity2-opacity1)*t
-		a := uint8(255 * opacity)
-
-		c := color.RGBA{r, g, b, a}
-		drawFilledCircle(img, int(x+0.5), int(y+0.5), radius, c, imgWidth, imgHeight)
-	}
-}
-
-// Utility functions
-
-// pointInPolygon tests if a point is inside a polygon using ray casting algorithm.
-func pointInPolygon(x, y int, xs, ys []int) bool {
-	inside := false
-	j := len(xs) - 1
-	for i := 0; i < len(xs); i++ {
-		if ((ys[i] > y) != (ys[j] > y)) &&
-			(x < (xs[j]-xs[i])*(y-ys[i])/(ys[j]-ys[i])+xs[i]) {
-			inside = !inside
-		}
-		j = i
-	}
-	return inside
-}
-
-// blendColors blends two colors using alpha compositing (over operator).
-// Used for semi-transparent rendering (e.g., highlighters).
-func blendColors(bg color.RGBA, fg color.RGBA) color.RGBA {
-	alpha := float32(fg.A) / 255.0
-	invAlpha := 1.0 - alpha
-
-	r := uint8(float32(fg.R)*alpha + float32(bg.R)*invAlpha)
-	g := uint8(float32(fg.G)*alpha + float32(bg.G)*invAlpha)
-	b := uint8(float32(fg.B)*alpha + float32(bg.B)*invAlpha)
-
-	return color.RGBA{r, g, b, 255}
-}